@@ -9,6 +9,7 @@ import (
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
+	"github.com/grafana/grafana-aws-sdk/pkg/common"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 )
 
@@ -20,19 +21,59 @@ func NewConfigProvider() ConfigProvider {
 	return newAWSConfigProviderWithClient(awsAPIClient{})
 }
 
+var (
+	sharedConfigProviderMu sync.RWMutex
+	sharedConfigProvider   = NewConfigProvider()
+)
+
+// SharedConfigProvider returns the process-wide ConfigProvider. Clients that
+// use it share a single config cache, so assume-role credentials are fetched
+// once per set of Settings instead of once per client.
+func SharedConfigProvider() ConfigProvider {
+	sharedConfigProviderMu.RLock()
+	defer sharedConfigProviderMu.RUnlock()
+	return sharedConfigProvider
+}
+
+// SetSharedConfigProvider replaces the process-wide ConfigProvider and returns
+// a function that restores the previous one. It is intended for tests.
+func SetSharedConfigProvider(provider ConfigProvider) func() {
+	sharedConfigProviderMu.Lock()
+	defer sharedConfigProviderMu.Unlock()
+	previous := sharedConfigProvider
+	sharedConfigProvider = provider
+	return func() {
+		sharedConfigProviderMu.Lock()
+		defer sharedConfigProviderMu.Unlock()
+		sharedConfigProvider = previous
+	}
+}
+
+// NewConfigProviderWithClient returns a ConfigProvider making its calls to
+// the AWS SDK through client, e.g. a fake from the awstest package.
+func NewConfigProviderWithClient(client AWSAPIClient) ConfigProvider {
+	return newAWSConfigProviderWithClient(client)
+}
+
 func newAWSConfigProviderWithClient(client AWSAPIClient) *awsConfigProvider {
 	return &awsConfigProvider{client: client}
 }
 
 type awsConfigProvider struct {
 	client AWSAPIClient
-	cache  sync.Map
+	cache  configCache
 }
 
-func (rcp *awsConfigProvider) GetConfig(ctx context.Context, authSettings Settings) (aws.Config, error) {
+func (rcp *awsConfigProvider) GetConfig(ctx context.Context, authSettings Settings) (cfg aws.Config, err error) {
+	authType := authSettings.GetAuthType()
+	ctx, span := common.StartSpan(ctx, "awsauth.GetConfig",
+		common.AttributeAuthType.String(string(authType)),
+		common.AttributeRegion.String(authSettings.Region),
+		common.AttributeAssumeRole.Bool(authSettings.AssumeRoleARN != ""),
+	)
+	defer func() { common.EndSpan(span, err) }()
 	logger := backend.Logger.FromContext(ctx)
 
-	authType := authSettings.GetAuthType()
 	grafanaAuthSettings, _ := awsds.ReadAuthSettingsFromContext(ctx)
 	if !slices.Contains(grafanaAuthSettings.AllowedAuthProviders, string(authType)) {
 		return aws.Config{}, backend.DownstreamErrorf("trying to use non-allowed auth method %s", authType)
@@ -42,10 +83,11 @@ func (rcp *awsConfigProvider) GetConfig(ctx context.Context, authSettings Settin
 	}
 
 	key := authSettings.Hash()
-	cached, exists := rcp.cache.Load(key)
+	cached, exists := rcp.cache.load(key)
+	span.SetAttributes(common.AttributeCacheHit.Bool(exists))
 	if exists {
 		logger.Debug("returning config from cache")
-		return cached.(aws.Config), nil
+		return cached, nil
 	}
 	logger.Debug("creating new config")
 
@@ -69,23 +111,46 @@ func (rcp *awsConfigProvider) GetConfig(ctx context.Context, authSettings Settin
 		return aws.Config{}, backend.DownstreamErrorf("unknown auth type: %s", authType)
 	}
 
-	cfg, err := rcp.client.LoadDefaultConfig(ctx, options...)
+	cfg, err = rcp.client.LoadDefaultConfig(ctx, options...)
 	if err != nil {
-		return aws.Config{}, err
+		return aws.Config{}, awsds.ClassifyAWSError(err)
 	}
 
 	if authSettings.AssumeRoleARN != "" {
 		options = append(authSettings.BaseOptionsWithAuthSettings(ctx, grafanaAuthSettings), authSettings.WithAssumeRole(cfg, rcp.client, grafanaAuthSettings.SessionDuration))
 		cfg, err = rcp.client.LoadDefaultConfig(ctx, options...)
 		if err != nil {
-			return aws.Config{}, err
+			return aws.Config{}, awsds.ClassifyAWSError(err)
 		}
 	}
 
-	rcp.cache.Store(key, cfg)
+	// the credentials cache of the SDK only calls its provider once the
+	// credentials expired, and so does this one, which has no expiry window
+	if cfg.Credentials != nil {
+		cfg.Credentials = rcp.client.NewCredentialsCache(countingCredentialsProvider{cfg.Credentials, authType})
+	}
+
+	rcp.cache.store(key, cfg)
 	return cfg, nil
 }
 
+// countingCredentialsProvider counts the credentials retrieved by provider,
+// e.g. from STS or the instance metadata, by auth type and outcome.
+type countingCredentialsProvider struct {
+	provider aws.CredentialsProvider
+	authType AuthType
+}
+
+func (p countingCredentialsProvider) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	credentials, err := p.provider.Retrieve(ctx)
+	outcome := fetchOutcomeSuccess
+	if err != nil {
+		outcome = fetchOutcomeError
+	}
+	credentialFetchesMetric.WithLabelValues(string(p.authType), outcome).Inc()
+	return credentials, err
+}
+
 var stsEndpointPrefixes = []string{
 	"sts.",
 	"sts-fips.",
@@ -0,0 +1,72 @@
+package awsauth
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// defaultConfigCacheSize bounds how many configs a provider keeps. The
+// provider is shared by the whole process, so it holds the configs of every
+// datasource served by the plugin.
+const defaultConfigCacheSize = 1024
+
+// configCache holds the configs resolved for each Settings.Hash, evicting the
+// least recently used one once it holds maxSize of them. The zero value
+// holds up to defaultConfigCacheSize configs.
+type configCache struct {
+	maxSize int
+
+	mu      sync.Mutex
+	entries map[uint64]*list.Element
+	lru     list.List
+}
+
+type configCacheEntry struct {
+	key uint64
+	cfg aws.Config
+}
+
+func (c *configCache) load(key uint64) (aws.Config, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return aws.Config{}, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*configCacheEntry).cfg, true
+}
+
+func (c *configCache) store(key uint64, cfg aws.Config) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*configCacheEntry).cfg = cfg
+		c.lru.MoveToFront(e)
+		return
+	}
+	if c.entries == nil {
+		c.entries = map[uint64]*list.Element{}
+	}
+	c.entries[key] = c.lru.PushFront(&configCacheEntry{key: key, cfg: cfg})
+	configCacheSizeMetric.Inc()
+
+	maxSize := c.maxSize
+	if maxSize <= 0 {
+		maxSize = defaultConfigCacheSize
+	}
+	for c.lru.Len() > maxSize {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*configCacheEntry).key)
+		configCacheSizeMetric.Dec()
+	}
+}
+
+func (c *configCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
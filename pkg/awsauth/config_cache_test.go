@@ -0,0 +1,31 @@
+package awsauth
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigCache(t *testing.T) {
+	before := testutil.ToFloat64(configCacheSizeMetric)
+	c := configCache{maxSize: 2}
+	c.store(1, aws.Config{Region: "us-east-1"})
+	c.store(2, aws.Config{Region: "us-east-2"})
+	_, ok := c.load(1)
+	assert.True(t, ok)
+
+	c.store(3, aws.Config{Region: "us-west-1"})
+	assert.Equal(t, 2, c.len())
+	_, ok = c.load(2)
+	assert.False(t, ok, "the least recently used config is evicted")
+	cfg, ok := c.load(1)
+	assert.True(t, ok)
+	assert.Equal(t, "us-east-1", cfg.Region)
+
+	c.store(3, aws.Config{Region: "eu-west-1"})
+	cfg, _ = c.load(3)
+	assert.Equal(t, "eu-west-1", cfg.Region)
+	assert.Equal(t, float64(2), testutil.ToFloat64(configCacheSizeMetric)-before)
+}
@@ -0,0 +1,151 @@
+package awsauth
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/grafana/grafana-aws-sdk/pkg/common"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+const (
+	// defaultCredentialsFetchTimeout bounds a single config and credentials
+	// retrieval, independently of the deadline of the request that triggered it.
+	defaultCredentialsFetchTimeout = 30 * time.Second
+
+	// defaultCredentialsFailureTTL is how long a failed retrieval is remembered,
+	// so that requests made during an STS outage fail fast instead of each
+	// making their own call.
+	defaultCredentialsFailureTTL = 5 * time.Second
+)
+
+// sharedCredentialsFetcher is the credentialsFetcher of the clients created in
+// this process, so clients using the same ConfigProvider and Settings share
+// their retrievals and recent failures.
+var sharedCredentialsFetcher = newCredentialsFetcher()
+
+// credentialsFetcherFor returns the fetcher for clients using provider: the
+// shared one, or a fetcher of their own if provider cannot be a map key.
+func credentialsFetcherFor(provider ConfigProvider) *credentialsFetcher {
+	if isComparable(provider) {
+		return sharedCredentialsFetcher
+	}
+	return newCredentialsFetcher()
+}
+
+func isComparable(provider ConfigProvider) bool {
+	return provider == nil || reflect.TypeOf(provider).Comparable()
+}
+
+// credentialsFetcher retrieves credentials for a set of Settings on behalf of
+// concurrent requests. Only one retrieval per ConfigProvider and Settings
+// runs at a time and its
+// result is handed to every request waiting on it. The retrieval is detached
+// from the cancellation of the requests, so a caller giving up does not fail
+// the fetch for the others; it is bounded by its own timeout instead.
+type credentialsFetcher struct {
+	timeout    time.Duration
+	failureTTL time.Duration
+	clock      Clock
+
+	mu       sync.Mutex
+	inflight map[credentialsKey]*credentialsCall
+	failures map[credentialsKey]credentialsFailure
+}
+
+// credentialsKey identifies a retrieval. provider is left nil when it cannot
+// be compared, in which case the fetcher is not shared between providers.
+type credentialsKey struct {
+	provider ConfigProvider
+	settings uint64
+}
+
+func newCredentialsKey(provider ConfigProvider, settings Settings) credentialsKey {
+	key := credentialsKey{settings: settings.Hash()}
+	if isComparable(provider) {
+		key.provider = provider
+	}
+	return key
+}
+
+type credentialsCall struct {
+	done        chan struct{}
+	cfg         aws.Config
+	credentials aws.Credentials
+	err         error
+}
+
+type credentialsFailure struct {
+	err     error
+	expires time.Time
+}
+
+func newCredentialsFetcher() *credentialsFetcher {
+	return &credentialsFetcher{
+		timeout:    defaultCredentialsFetchTimeout,
+		failureTTL: defaultCredentialsFailureTTL,
+		clock:      systemClock{},
+		inflight:   map[credentialsKey]*credentialsCall{},
+		failures:   map[credentialsKey]credentialsFailure{},
+	}
+}
+
+// fetch returns the config and credentials for settings, joining a retrieval
+// already in flight for the same provider and settings or returning a recent
+// failure.
+func (f *credentialsFetcher) fetch(ctx context.Context, provider ConfigProvider, settings Settings) (aws.Config, aws.Credentials, error) {
+	key := newCredentialsKey(provider, settings)
+
+	f.mu.Lock()
+	if failure, ok := f.failures[key]; ok {
+		if f.clock.Now().Before(failure.expires) {
+			f.mu.Unlock()
+			backend.Logger.FromContext(ctx).Debug("returning recent credentials retrieval failure")
+			return aws.Config{}, aws.Credentials{}, failure.err
+		}
+		delete(f.failures, key)
+	}
+	call, ok := f.inflight[key]
+	if !ok {
+		call = &credentialsCall{done: make(chan struct{})}
+		f.inflight[key] = call
+		go f.retrieve(ctx, provider, settings, key, call)
+	}
+	f.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.cfg, call.credentials, call.err
+	case <-ctx.Done():
+		return aws.Config{}, aws.Credentials{}, ctx.Err()
+	}
+}
+
+func (f *credentialsFetcher) retrieve(ctx context.Context, provider ConfigProvider, settings Settings, key credentialsKey, call *credentialsCall) {
+	fetchCtx, cancel := common.DetachedContext(ctx, f.timeout)
+	defer cancel()
+	defer func() {
+		if r := recover(); r != nil {
+			call.err = fmt.Errorf("panic caught while retrieving credentials: %v", r)
+		}
+		f.mu.Lock()
+		delete(f.inflight, key)
+		if call.err != nil && f.failureTTL > 0 {
+			now := f.clock.Now()
+			// forget the failures of settings that were not used again since
+			for k, failure := range f.failures {
+				if !now.Before(failure.expires) {
+					delete(f.failures, k)
+				}
+			}
+			f.failures[key] = credentialsFailure{err: call.err, expires: now.Add(f.failureTTL)}
+		}
+		f.mu.Unlock()
+		close(call.done)
+	}()
+	call.cfg, call.credentials, call.err = retrieveCredentials(fetchCtx, provider, settings)
+}
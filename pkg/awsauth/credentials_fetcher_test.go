@@ -0,0 +1,204 @@
+package awsauth
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blockingConfigProvider holds every GetConfig call until release is closed,
+// or until the call's context is done.
+type blockingConfigProvider struct {
+	calls   atomic.Int32
+	release chan struct{}
+	err     error
+}
+
+func (p *blockingConfigProvider) GetConfig(ctx context.Context, settings Settings) (aws.Config, error) {
+	p.calls.Add(1)
+	select {
+	case <-p.release:
+	case <-ctx.Done():
+		return aws.Config{}, ctx.Err()
+	}
+	if p.err != nil {
+		return aws.Config{}, p.err
+	}
+	return NewFakeConfigProvider(false).GetConfig(ctx, settings)
+}
+
+func TestCredentialsFetcher(t *testing.T) {
+	settings := Settings{AuthType: AuthTypeKeys, AccessKey: "good", SecretKey: "excellent", Region: "us-east-1"}
+
+	t.Run("concurrent fetches for the same settings share one retrieval", func(t *testing.T) {
+		provider := &blockingConfigProvider{release: make(chan struct{})}
+		f := newCredentialsFetcher()
+
+		var wg sync.WaitGroup
+		results := make([]aws.Credentials, 10)
+		for i := range results {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, results[i], _ = f.fetch(context.Background(), provider, settings)
+			}()
+		}
+		require.Eventually(t, func() bool { return provider.calls.Load() == 1 }, time.Second, time.Millisecond)
+		close(provider.release)
+		wg.Wait()
+
+		assert.Equal(t, int32(1), provider.calls.Load())
+		for _, credentials := range results {
+			assert.Equal(t, "hello", credentials.AccessKeyID)
+		}
+	})
+
+	t.Run("a cancelled caller does not cancel the retrieval", func(t *testing.T) {
+		provider := &blockingConfigProvider{release: make(chan struct{})}
+		f := newCredentialsFetcher()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancelled := make(chan error)
+		go func() {
+			_, _, err := f.fetch(ctx, provider, settings)
+			cancelled <- err
+		}()
+		require.Eventually(t, func() bool { return provider.calls.Load() == 1 }, time.Second, time.Millisecond)
+		cancel()
+		assert.ErrorIs(t, <-cancelled, context.Canceled)
+
+		f.mu.Lock()
+		call := f.inflight[newCredentialsKey(provider, settings)]
+		f.mu.Unlock()
+		require.NotNil(t, call, "retrieval should still be in flight")
+		close(provider.release)
+		<-call.done
+		require.NoError(t, call.err)
+		assert.Equal(t, "hello", call.credentials.AccessKeyID)
+		assert.Equal(t, int32(1), provider.calls.Load())
+	})
+
+	t.Run("retrieval is bounded by its own timeout", func(t *testing.T) {
+		provider := &blockingConfigProvider{release: make(chan struct{})}
+		f := newCredentialsFetcher()
+		f.timeout = 10 * time.Millisecond
+
+		_, _, err := f.fetch(context.Background(), provider, settings)
+		require.Error(t, err)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.True(t, backend.IsDownstreamError(err))
+	})
+
+	t.Run("failures are remembered for a short time", func(t *testing.T) {
+		release := make(chan struct{})
+		close(release)
+		provider := &blockingConfigProvider{release: release, err: errors.New("sts is down")}
+		f := newCredentialsFetcher()
+		f.clock = staticClock{OnceUponATime}
+
+		for range 3 {
+			_, _, err := f.fetch(context.Background(), provider, settings)
+			require.ErrorContains(t, err, "sts is down")
+		}
+		assert.Equal(t, int32(1), provider.calls.Load())
+
+		// other settings are not affected
+		other := settings
+		other.Region = "eu-west-1"
+		_, _, err := f.fetch(context.Background(), provider, other)
+		require.Error(t, err)
+		assert.Equal(t, int32(2), provider.calls.Load())
+
+		f.clock = staticClock{OnceUponATime.Add(defaultCredentialsFailureTTL + time.Second)}
+		provider.err = nil
+		_, credentials, err := f.fetch(context.Background(), provider, settings)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", credentials.AccessKeyID)
+		assert.Equal(t, int32(3), provider.calls.Load())
+	})
+
+	t.Run("expired failures are forgotten", func(t *testing.T) {
+		release := make(chan struct{})
+		close(release)
+		provider := &blockingConfigProvider{release: release, err: errors.New("sts is down")}
+		f := newCredentialsFetcher()
+		f.clock = staticClock{OnceUponATime}
+		_, _, err := f.fetch(context.Background(), provider, settings)
+		require.Error(t, err)
+
+		f.clock = staticClock{OnceUponATime.Add(defaultCredentialsFailureTTL + time.Second)}
+		other := settings
+		other.Region = "eu-west-1"
+		_, _, err = f.fetch(context.Background(), provider, other)
+		require.Error(t, err)
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		assert.Len(t, f.failures, 1)
+		assert.Contains(t, f.failures, newCredentialsKey(provider, other))
+	})
+}
+
+// configProviderFunc is a ConfigProvider that cannot be used as a map key.
+type configProviderFunc func(context.Context, Settings) (aws.Config, error)
+
+func (f configProviderFunc) GetConfig(ctx context.Context, settings Settings) (aws.Config, error) {
+	return f(ctx, settings)
+}
+
+func TestCredentialsFetcherFor(t *testing.T) {
+	settings := Settings{AuthType: AuthTypeKeys, AccessKey: "good", SecretKey: "excellent", Region: "us-east-1"}
+
+	t.Run("clients share one retrieval per provider and settings", func(t *testing.T) {
+		provider := &blockingConfigProvider{release: make(chan struct{})}
+		other := &blockingConfigProvider{release: make(chan struct{})}
+		roundTripper := NewSignerRoundTripperWithConfigProvider(httpclient.Options{}, nil, nil, provider)
+		streamSigner := NewEventStreamSignerWithConfigProvider(settings, "transcribe", provider)
+		dialer := NewWebSocketDialerWithConfigProvider(settings, "transcribe", other)
+		require.Same(t, roundTripper.fetcher, streamSigner.fetcher)
+		require.Same(t, roundTripper.fetcher, dialer.fetcher)
+
+		var wg sync.WaitGroup
+		for _, fetch := range []func() error{
+			func() error {
+				_, _, err := roundTripper.fetcher.fetch(context.Background(), provider, settings)
+				return err
+			},
+			func() error {
+				_, _, err := streamSigner.fetcher.fetch(context.Background(), provider, settings)
+				return err
+			},
+			func() error { _, _, err := dialer.fetcher.fetch(context.Background(), other, settings); return err },
+		} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				assert.NoError(t, fetch())
+			}()
+		}
+		require.Eventually(t, func() bool { return provider.calls.Load() == 1 && other.calls.Load() == 1 }, time.Second, time.Millisecond)
+		close(provider.release)
+		close(other.release)
+		wg.Wait()
+		assert.Equal(t, int32(1), provider.calls.Load())
+		assert.Equal(t, int32(1), other.calls.Load(), "other providers have their own retrieval")
+	})
+
+	t.Run("providers that are not comparable get their own fetcher", func(t *testing.T) {
+		provider := configProviderFunc(NewFakeConfigProvider(false).GetConfig)
+		f := credentialsFetcherFor(provider)
+		assert.NotSame(t, sharedCredentialsFetcher, f)
+		_, credentials, err := f.fetch(context.Background(), provider, settings)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", credentials.AccessKeyID)
+	})
+}
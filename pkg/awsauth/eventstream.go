@@ -0,0 +1,155 @@
+package awsauth
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// StreamingEventsPayloadHash is the payload hash used to sign the initial
+// request of an event stream, whose body is signed frame by frame instead.
+const StreamingEventsPayloadHash = "STREAMING-AWS4-HMAC-SHA256-EVENTS"
+
+const (
+	eventStreamHeaderTypeBytes     byte = 6
+	eventStreamHeaderTypeTimestamp byte = 8
+
+	eventStreamDateHeader      = ":date"
+	eventStreamSignatureHeader = ":chunk-signature"
+)
+
+// EventStreamSigner signs AWS event streams, as used by HTTP/2 streaming APIs
+// such as Transcribe streaming. SignRequest signs the request that opens the
+// stream, and SignFrame then wraps each encoded event message in a signed
+// envelope frame chained to the previous signature. An empty payload produces
+// the final frame that ends the stream.
+type EventStreamSigner struct {
+	settings       Settings
+	service        string
+	configProvider ConfigProvider
+	signer         v4.HTTPSigner
+	clock          Clock
+	fetcher        *credentialsFetcher
+
+	mu           sync.Mutex
+	streamSigner *v4.StreamSigner
+}
+
+// NewEventStreamSigner returns an EventStreamSigner that signs for service
+// using credentials resolved from settings through the SharedConfigProvider.
+func NewEventStreamSigner(settings Settings, service string) *EventStreamSigner {
+	return NewEventStreamSignerWithConfigProvider(settings, service, SharedConfigProvider())
+}
+
+// NewEventStreamSignerWithConfigProvider returns an EventStreamSigner that
+// resolves credentials through the given ConfigProvider.
+func NewEventStreamSignerWithConfigProvider(settings Settings, service string, provider ConfigProvider) *EventStreamSigner {
+	return &EventStreamSigner{
+		settings:       settings,
+		service:        service,
+		configProvider: provider,
+		signer:         v4.NewSigner(),
+		clock:          systemClock{},
+		fetcher:        credentialsFetcherFor(provider),
+	}
+}
+
+// SignRequest signs the request that opens the event stream and seeds the
+// frame signatures with its signature.
+func (s *EventStreamSigner) SignRequest(ctx context.Context, req *http.Request) error {
+	cfg, credentials, err := s.fetcher.fetch(ctx, s.configProvider, s.settings)
+	if err != nil {
+		return err
+	}
+	region := signingRegion(s.settings, cfg)
+	req.Header.Set("X-Amz-Content-Sha256", StreamingEventsPayloadHash)
+	err = s.signer.SignHTTP(ctx, credentials, req, StreamingEventsPayloadHash, s.service, region, s.clock.Now().UTC())
+	if err != nil {
+		return err
+	}
+	seed, err := seedSignature(req.Header.Get("Authorization"))
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.streamSigner = v4.NewStreamSigner(credentials, s.service, region, seed)
+	return nil
+}
+
+// SignFrame returns payload, an encoded event stream message, wrapped in a
+// signed envelope frame. Frames must be signed in the order they are sent.
+func (s *EventStreamSigner) SignFrame(ctx context.Context, payload []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.streamSigner == nil {
+		return nil, fmt.Errorf("event stream request has not been signed")
+	}
+
+	signingTime := s.clock.Now().UTC()
+	dateHeader := encodeEventStreamTimestampHeader(eventStreamDateHeader, signingTime)
+	signature, err := s.streamSigner.GetSignature(ctx, dateHeader, payload, signingTime)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := bytes.Join([][]byte{dateHeader, encodeEventStreamBytesHeader(eventStreamSignatureHeader, signature)}, nil)
+	return encodeEventStreamMessage(headers, payload), nil
+}
+
+// seedSignature extracts the signature from a SigV4 Authorization header value.
+func seedSignature(authorization string) ([]byte, error) {
+	for _, part := range strings.Split(authorization, ",") {
+		part = strings.TrimSpace(part)
+		if signature, ok := strings.CutPrefix(part, "Signature="); ok {
+			return hex.DecodeString(signature)
+		}
+	}
+	return nil, fmt.Errorf("no signature found in Authorization header")
+}
+
+func encodeEventStreamTimestampHeader(name string, t time.Time) []byte {
+	buf := bytes.NewBuffer(nil)
+	buf.WriteByte(byte(len(name)))
+	buf.WriteString(name)
+	buf.WriteByte(eventStreamHeaderTypeTimestamp)
+	_ = binary.Write(buf, binary.BigEndian, t.UnixMilli())
+	return buf.Bytes()
+}
+
+func encodeEventStreamBytesHeader(name string, value []byte) []byte {
+	buf := bytes.NewBuffer(nil)
+	buf.WriteByte(byte(len(name)))
+	buf.WriteString(name)
+	buf.WriteByte(eventStreamHeaderTypeBytes)
+	_ = binary.Write(buf, binary.BigEndian, uint16(len(value)))
+	buf.Write(value)
+	return buf.Bytes()
+}
+
+// encodeEventStreamMessage encodes a message in the event stream wire format:
+// a prelude with the total and headers lengths and its CRC, the headers, the
+// payload and a CRC of the whole message.
+func encodeEventStreamMessage(headers, payload []byte) []byte {
+	const preludeLen, crcLen = 12, 4
+	totalLen := preludeLen + len(headers) + len(payload) + crcLen
+
+	buf := bytes.NewBuffer(make([]byte, 0, totalLen))
+	_ = binary.Write(buf, binary.BigEndian, uint32(totalLen))
+	_ = binary.Write(buf, binary.BigEndian, uint32(len(headers)))
+	_ = binary.Write(buf, binary.BigEndian, crc32.ChecksumIEEE(buf.Bytes()))
+	buf.Write(headers)
+	buf.Write(payload)
+	_ = binary.Write(buf, binary.BigEndian, crc32.ChecksumIEEE(buf.Bytes()))
+	return buf.Bytes()
+}
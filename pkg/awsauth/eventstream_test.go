@@ -0,0 +1,93 @@
+package awsauth
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"net/http"
+	"testing"
+
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// decodedFrame is an event stream message split into its parts.
+type decodedFrame struct {
+	headers   []byte
+	payload   []byte
+	date      []byte
+	signature []byte
+}
+
+func decodeEventStreamFrame(t *testing.T, frame []byte) decodedFrame {
+	t.Helper()
+	require.GreaterOrEqual(t, len(frame), 16)
+	totalLen := binary.BigEndian.Uint32(frame[0:4])
+	headersLen := binary.BigEndian.Uint32(frame[4:8])
+	require.Equal(t, uint32(len(frame)), totalLen)
+	require.Equal(t, crc32.ChecksumIEEE(frame[0:8]), binary.BigEndian.Uint32(frame[8:12]), "prelude CRC")
+	require.Equal(t, crc32.ChecksumIEEE(frame[:len(frame)-4]), binary.BigEndian.Uint32(frame[len(frame)-4:]), "message CRC")
+
+	decoded := decodedFrame{
+		headers: frame[12 : 12+headersLen],
+		payload: frame[12+headersLen : len(frame)-4],
+	}
+	headers := decoded.headers
+	for len(headers) > 0 {
+		nameLen := int(headers[0])
+		name := string(headers[1 : 1+nameLen])
+		headerType := headers[1+nameLen]
+		rest := headers[2+nameLen:]
+		switch headerType {
+		case eventStreamHeaderTypeTimestamp:
+			decoded.date = headers[:2+nameLen+8]
+			headers = rest[8:]
+		case eventStreamHeaderTypeBytes:
+			valueLen := int(binary.BigEndian.Uint16(rest[0:2]))
+			if name == eventStreamSignatureHeader {
+				decoded.signature = rest[2 : 2+valueLen]
+			}
+			headers = rest[2+valueLen:]
+		default:
+			t.Fatalf("unexpected header type %d", headerType)
+		}
+	}
+	return decoded
+}
+
+func TestEventStreamSigner(t *testing.T) {
+	newSignedStream := func(t *testing.T) (*EventStreamSigner, []byte) {
+		s := NewEventStreamSignerWithConfigProvider(Settings{Region: "us-east-1"}, "transcribe", NewFakeConfigProvider(false))
+		s.clock = staticClock{OnceUponATime}
+		req, _ := http.NewRequest("POST", "https://transcribestreaming.us-east-1.amazonaws.com/stream-transcription", nil)
+		require.NoError(t, s.SignRequest(context.Background(), req))
+		assert.Equal(t, StreamingEventsPayloadHash, req.Header.Get("X-Amz-Content-Sha256"))
+		seed, err := seedSignature(req.Header.Get("Authorization"))
+		require.NoError(t, err)
+		return s, seed
+	}
+
+	t.Run("frames are chained signed envelopes", func(t *testing.T) {
+		s, seed := newSignedStream(t)
+		verifier := v4.NewStreamSigner(staticCredentials, "transcribe", "us-east-1", seed)
+
+		for _, payload := range [][]byte{[]byte("audio chunk"), []byte("audio chunk"), {}} {
+			frame, err := s.SignFrame(context.Background(), payload)
+			require.NoError(t, err)
+			decoded := decodeEventStreamFrame(t, frame)
+			assert.True(t, bytes.Equal(payload, decoded.payload))
+
+			expected, err := verifier.GetSignature(context.Background(), decoded.date, payload, OnceUponATime)
+			require.NoError(t, err)
+			assert.Equal(t, expected, decoded.signature)
+		}
+	})
+
+	t.Run("frames cannot be signed before the request", func(t *testing.T) {
+		s := NewEventStreamSignerWithConfigProvider(Settings{Region: "us-east-1"}, "transcribe", NewFakeConfigProvider(false))
+		_, err := s.SignFrame(context.Background(), []byte("audio chunk"))
+		assert.Error(t, err)
+	})
+}
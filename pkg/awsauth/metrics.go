@@ -0,0 +1,42 @@
+package awsauth
+
+import (
+	"github.com/grafana/grafana-aws-sdk/pkg/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Outcomes of a credentials retrieval, as labelled in credentialFetchesMetric.
+const (
+	fetchOutcomeSuccess = "success"
+	fetchOutcomeError   = "error"
+)
+
+var credentialFetchesMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: common.MetricsNamespace,
+	Subsystem: common.MetricsSubsystem,
+	Name:      "credential_fetches_total",
+	Help:      "Number of times AWS credentials were retrieved from their provider, by auth type and outcome",
+}, []string{"auth_type", "outcome"})
+
+var configCacheSizeMetric = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: common.MetricsNamespace,
+	Subsystem: common.MetricsSubsystem,
+	Name:      "config_cache_size",
+	Help:      "Number of AWS configs cached by the config providers",
+})
+
+var signingDurationMetric = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: common.MetricsNamespace,
+	Subsystem: common.MetricsSubsystem,
+	Name:      "sigv4_signing_duration_seconds",
+	Help:      "Time taken to sign requests with SigV4, by service",
+	Buckets:   prometheus.ExponentialBuckets(0.00005, 2, 12),
+}, []string{"service"})
+
+var clockSkewMetric = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: common.MetricsNamespace,
+	Subsystem: common.MetricsSubsystem,
+	Name:      "sigv4_clock_skew_seconds",
+	Help:      "Offset between the AWS server clock and the local clock observed on SigV4 clock skew errors",
+})
@@ -0,0 +1,91 @@
+package awsauth
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana-plugin-sdk-go/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func signingSamples(t *testing.T, service string) uint64 {
+	t.Helper()
+	var m dto.Metric
+	require.NoError(t, signingDurationMetric.WithLabelValues(service).(prometheus.Histogram).Write(&m))
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestSignerRoundTripper_metrics(t *testing.T) {
+	sigV4Config := &httpclient.SigV4Config{
+		AuthType:  "keys",
+		AccessKey: "good",
+		SecretKey: "excellent",
+		Region:    "us-east-1",
+		Service:   "metrics-test",
+	}
+	before := signingSamples(t, "metrics-test")
+	s := NewSignerRoundTripperWithConfigProvider(httpclient.Options{SigV4: sigV4Config}, &testRoundTripper{}, v4.NewSigner(), NewFakeConfigProvider(false))
+	req, _ := http.NewRequest(http.MethodGet, "https://service.aws.amazon.notreally", nil)
+	_, err := s.RoundTrip(req)
+	require.NoError(t, err)
+
+	assert.Equal(t, uint64(1), signingSamples(t, "metrics-test")-before)
+}
+
+func TestAWSConfigProvider_GetConfig_credentialFetchesMetric(t *testing.T) {
+	ctx := config.WithGrafanaConfig(context.Background(), config.NewGrafanaCfg(defaultGrafanaConfig))
+
+	t.Run("retrievals are counted, not cached credentials", func(t *testing.T) {
+		successes := credentialFetchesMetric.WithLabelValues("keys", fetchOutcomeSuccess)
+		before := testutil.ToFloat64(successes)
+		provider := newAWSConfigProviderWithClient(&mockAWSAPIClient{&mockAssumeRoleAPIClient{}})
+		settings := Settings{AuthType: AuthTypeKeys, AccessKey: "counted", SecretKey: "once", Region: "eu-north-1"}
+		for range 3 {
+			cfg, err := provider.GetConfig(ctx, settings)
+			require.NoError(t, err)
+			_, err = cfg.Credentials.Retrieve(ctx)
+			require.NoError(t, err)
+		}
+		assert.Equal(t, float64(1), testutil.ToFloat64(successes)-before)
+	})
+
+	t.Run("failed retrievals are counted", func(t *testing.T) {
+		errs := credentialFetchesMetric.WithLabelValues("default", fetchOutcomeError)
+		before := testutil.ToFloat64(errs)
+		client := &mockAWSAPIClient{&mockAssumeRoleAPIClient{}}
+		client.assumeRoleClient.On("AssumeRole").Return(true, nil)
+		provider := newAWSConfigProviderWithClient(client)
+		cfg, err := provider.GetConfig(ctx, Settings{AuthType: AuthTypeDefault, AssumeRoleARN: "arn:aws:iam::123:role/failing", Region: "eu-north-1"})
+		require.NoError(t, err)
+		_, err = cfg.Credentials.Retrieve(ctx)
+		require.Error(t, err)
+		_, err = cfg.Credentials.Retrieve(ctx)
+		require.Error(t, err)
+		assert.Equal(t, float64(2), testutil.ToFloat64(errs)-before)
+	})
+}
+
+func TestAWSConfigProvider_GetConfig_cacheSizeMetric(t *testing.T) {
+	ctx := config.WithGrafanaConfig(context.Background(), config.NewGrafanaCfg(defaultGrafanaConfig))
+	provider := newAWSConfigProviderWithClient(awsAPIClient{})
+	settings := Settings{AuthType: AuthTypeKeys, AccessKey: "tensile", SecretKey: "diaphanous", Region: "eu-north-1"}
+	before := testutil.ToFloat64(configCacheSizeMetric)
+
+	_, err := provider.GetConfig(ctx, settings)
+	require.NoError(t, err)
+	_, err = provider.GetConfig(ctx, settings)
+	require.NoError(t, err)
+	assert.Equal(t, float64(1), testutil.ToFloat64(configCacheSizeMetric)-before, "cache hits do not grow the cache")
+
+	settings.Region = "eu-west-1"
+	_, err = provider.GetConfig(ctx, settings)
+	require.NoError(t, err)
+	assert.Equal(t, float64(2), testutil.ToFloat64(configCacheSizeMetric)-before)
+}
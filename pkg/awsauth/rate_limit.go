@@ -0,0 +1,82 @@
+package awsauth
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	smithymiddleware "github.com/aws/smithy-go/middleware"
+)
+
+// requestRateLimiter is a client-side token bucket holding the requests of
+// the clients built from one config to rate requests per second. Up to rate
+// requests, rounded up, can be sent at once; the following ones wait for their
+// turn.
+type requestRateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRequestRateLimiter(rate float64) *requestRateLimiter {
+	burst := math.Max(math.Ceil(rate), 1)
+	return &requestRateLimiter{rate: rate, burst: burst, tokens: burst}
+}
+
+// reserve takes a token from the bucket as of now and returns how long to wait
+// before using it.
+func (l *requestRateLimiter) reserve(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.last.IsZero() {
+		l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// cancel gives back a token reserved by a request that stopped waiting.
+func (l *requestRateLimiter) cancel() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens = math.Min(l.burst, l.tokens+1)
+}
+
+// wait blocks until a request can be sent or ctx is done.
+func (l *requestRateLimiter) wait(ctx context.Context) error {
+	delay := l.reserve(time.Now())
+	if delay == 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.cancel()
+		return ctx.Err()
+	}
+}
+
+// addMiddleware makes every attempt of the requests sent by a client wait for
+// the limiter, retries included.
+func (l *requestRateLimiter) addMiddleware(stack *smithymiddleware.Stack) error {
+	rateLimit := smithymiddleware.FinalizeMiddlewareFunc("RequestRateLimit", func(ctx context.Context, in smithymiddleware.FinalizeInput, next smithymiddleware.FinalizeHandler) (smithymiddleware.FinalizeOutput, smithymiddleware.Metadata, error) {
+		if err := l.wait(ctx); err != nil {
+			return smithymiddleware.FinalizeOutput{}, smithymiddleware.Metadata{}, err
+		}
+		return next.HandleFinalize(ctx, in)
+	})
+	if _, ok := stack.Finalize.Get("Retry"); ok {
+		return stack.Finalize.Insert(rateLimit, "Retry", smithymiddleware.After)
+	}
+	return stack.Finalize.Add(rateLimit, smithymiddleware.After)
+}
@@ -0,0 +1,54 @@
+package awsauth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	smithymiddleware "github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestRateLimiter_reserve(t *testing.T) {
+	limiter := newRequestRateLimiter(2)
+	now := time.Now()
+
+	assert.Equal(t, time.Duration(0), limiter.reserve(now))
+	assert.Equal(t, time.Duration(0), limiter.reserve(now), "bursts of 2 requests are sent at once")
+	assert.Equal(t, 500*time.Millisecond, limiter.reserve(now))
+	assert.Equal(t, time.Second, limiter.reserve(now))
+
+	assert.Equal(t, time.Duration(0), limiter.reserve(now.Add(2*time.Second)), "the bucket refills at 2 tokens per second")
+	assert.Equal(t, time.Duration(0), limiter.reserve(now.Add(time.Hour)))
+	assert.Equal(t, time.Duration(0), limiter.reserve(now.Add(time.Hour)))
+	assert.Equal(t, 500*time.Millisecond, limiter.reserve(now.Add(time.Hour)), "no more than a burst is saved up")
+
+	slow := newRequestRateLimiter(0.5)
+	assert.Equal(t, time.Duration(0), slow.reserve(now), "bursts of at least one request")
+	assert.Equal(t, 2*time.Second, slow.reserve(now))
+}
+
+func TestRequestRateLimiter_wait(t *testing.T) {
+	limiter := newRequestRateLimiter(1)
+	require.NoError(t, limiter.wait(context.Background()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, limiter.wait(ctx), context.DeadlineExceeded)
+	assert.InDelta(t, time.Second, limiter.reserve(limiter.last), float64(10*time.Millisecond), "the token of a cancelled wait is given back")
+}
+
+func TestRequestRateLimiter_addMiddleware(t *testing.T) {
+	stack := smithymiddleware.NewStack("test", smithyhttp.NewStackRequest)
+	for _, id := range []string{"Retry", "Signing"} {
+		require.NoError(t, stack.Finalize.Add(smithymiddleware.FinalizeMiddlewareFunc(id, nil), smithymiddleware.After))
+	}
+	require.NoError(t, newRequestRateLimiter(1).addMiddleware(stack))
+	assert.Equal(t, []string{"Retry", "RequestRateLimit", "Signing"}, stack.Finalize.List(), "every attempt is rate limited")
+
+	stack = smithymiddleware.NewStack("test", smithyhttp.NewStackRequest)
+	require.NoError(t, newRequestRateLimiter(1).addMiddleware(stack))
+	assert.Equal(t, []string{"RequestRateLimit"}, stack.Finalize.List())
+}
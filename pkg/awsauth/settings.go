@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"hash/fnv"
+	"io"
 	"net/http"
 	"net/url"
 	"os"
@@ -18,6 +19,8 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws/middleware"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/ratelimit"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	smithymiddleware "github.com/aws/smithy-go/middleware"
@@ -86,6 +89,11 @@ type Settings struct {
 	SessionToken               string
 	HTTPClient                 *http.Client
 	ProxyOptions               *proxy.Options
+	// Retry is how the clients built from the config retry failed requests.
+	// Unset fields are taken from the Grafana config, if any. Plugins set it
+	// from AWSDatasourceSettings.Retry; SigV4 datasources read it from the same
+	// JSON keys.
+	Retry awsds.RetrySettings
 
 	PerDatasourceProxySettings *PerDatasourceProxySettings
 }
@@ -93,10 +101,11 @@ type Settings struct {
 // Hash returns a value suitable for caching the config associated with these settings
 func (s Settings) Hash() uint64 {
 	h := fnv.New64()
-	// In theory all of these except for region will be moot, because if any of them
-	// change the datasource instance will be recycled. However, to ensure no leakage
-	// of credentials between instances, we check everything except proxy options.
-	// If those change the datasource will definitely not be reused.
+	// Configs are cached by a provider shared by every datasource of the plugin,
+	// so everything the config is built from is part of the key: two datasources
+	// with the same credentials but different proxies must not share the HTTP
+	// client of the config. HTTPClient is left out as callers build a new one
+	// for each request; it only carries the proxies hashed below.
 	_, _ = h.Write([]byte(s.GetAuthType()))
 	_, _ = h.Write([]byte(s.AccessKey))
 	_, _ = h.Write([]byte(s.SecretKey))
@@ -112,15 +121,34 @@ func (s Settings) Hash() uint64 {
 	} else {
 		_, _ = h.Write([]byte{0})
 	}
+	_, _ = fmt.Fprintf(h, "%d/%d/%s/%d/%v", s.Retry.MaxAttempts, s.Retry.MaxBackoff, s.Retry.Mode, s.Retry.RetryQuotaTokens, s.Retry.RateLimit)
 	if s.PerDatasourceProxySettings != nil {
 		_, _ = h.Write([]byte(s.PerDatasourceProxySettings.ProxyType))
 		_, _ = h.Write([]byte(s.PerDatasourceProxySettings.ProxyUrl))
 		_, _ = h.Write([]byte(s.PerDatasourceProxySettings.ProxyUsername))
 		_, _ = h.Write([]byte(s.PerDatasourceProxySettings.ProxyPassword))
 	}
+	if s.ProxyOptions != nil {
+		writeProxyOptions(h, s.ProxyOptions)
+	}
 	return h.Sum64()
 }
 
+// writeProxyOptions writes the secure socks proxy options to h.
+func writeProxyOptions(h io.Writer, opts *proxy.Options) {
+	_, _ = fmt.Fprintf(h, "proxy/%t/%s/%s", opts.Enabled, opts.DatasourceName, opts.DatasourceType)
+	if opts.Auth != nil {
+		_, _ = fmt.Fprintf(h, "/auth/%s/%s", opts.Auth.Username, opts.Auth.Password)
+	}
+	if opts.Timeouts != nil {
+		_, _ = fmt.Fprintf(h, "/timeouts/%d/%d", opts.Timeouts.Timeout, opts.Timeouts.KeepAlive)
+	}
+	if c := opts.ClientCfg; c != nil {
+		_, _ = fmt.Fprintf(h, "/client/%s/%s/%q/%s/%s/%q/%s/%s/%t",
+			c.ClientCert, c.ClientKey, c.RootCAs, c.ClientCertVal, c.ClientKeyVal, c.RootCAsVals, c.ProxyAddress, c.ServerName, c.AllowInsecure)
+	}
+}
+
 func (s Settings) GetAuthType() AuthType {
 	if s.AuthType != AuthTypeMissing {
 		return s.AuthType
@@ -129,11 +157,11 @@ func (s Settings) GetAuthType() AuthType {
 }
 
 func (s Settings) BaseOptions() []LoadOptionsFunc {
-	return []LoadOptionsFunc{s.WithRegion(), s.WithEndpoint(), s.WithHTTPClient(), s.WithUserAgent()}
+	return []LoadOptionsFunc{s.WithRegion(), s.WithEndpoint(), s.WithHTTPClient(), s.WithUserAgent(), s.WithRetry()}
 }
 
 func (s Settings) BaseOptionsWithAuthSettings(ctx context.Context, authSettings *awsds.AuthSettings) []LoadOptionsFunc {
-	return []LoadOptionsFunc{s.WithRegion(), s.WithEndpoint(), s.WithHTTPClientFromAuthSettings(authSettings), s.WithUserAgent()}
+	return []LoadOptionsFunc{s.WithRegion(), s.WithEndpoint(), s.WithHTTPClientFromAuthSettings(authSettings), s.WithUserAgent(), s.WithRetryFromAuthSettings(authSettings)}
 }
 
 func (s Settings) WithRegion() LoadOptionsFunc {
@@ -206,7 +234,7 @@ func (s Settings) WithAssumeRole(cfg aws.Config, client AWSAPIClient, sessionDur
 	if common.IsOptInRegion(cfg.Region) {
 		cfg.Region = "us-east-1"
 	}
-	stsClient := client.NewSTSClientFromConfig(cfg)
+	stsClient := tracingAssumeRoleClient{client.NewSTSClientFromConfig(cfg), cfg.Region}
 	provider := client.NewAssumeRoleProvider(stsClient, s.AssumeRoleARN, func(options *stscreds.AssumeRoleOptions) {
 		if s.ExternalID != "" {
 			options.ExternalID = aws.String(s.ExternalID)
@@ -229,6 +257,60 @@ func (s Settings) WithEC2RoleCredentials(client AWSAPIClient) LoadOptionsFunc {
 	}
 }
 
+// WithRetry returns a LoadOptionsFunc setting the Retryer and the request rate
+// limit of the config from the retry settings, without those of the Grafana
+// config.
+func (s Settings) WithRetry() LoadOptionsFunc {
+	return s.WithRetryFromAuthSettings(nil)
+}
+
+// WithRetryFromAuthSettings returns a LoadOptionsFunc setting the Retryer and
+// the request rate limit of the config from the retry settings, completed with
+// those of the Grafana config. Without retry settings the retryer of the AWS
+// SDK is kept. The clients built from the config share its rate limit.
+func (s Settings) WithRetryFromAuthSettings(authSettings *awsds.AuthSettings) LoadOptionsFunc {
+	retrySettings := s.Retry
+	if authSettings != nil {
+		retrySettings = retrySettings.WithDefaults(authSettings.Retry)
+	}
+	return func(options *config.LoadOptions) error {
+		if retrySettings.IsZero() {
+			return nil
+		}
+		if retrySettings.RateLimit > 0 {
+			limiter := newRequestRateLimiter(retrySettings.RateLimit)
+			options.APIOptions = append(options.APIOptions, limiter.addMiddleware)
+		}
+		options.Retryer = func() aws.Retryer {
+			return newRetryer(retrySettings)
+		}
+		return nil
+	}
+}
+
+func newRetryer(settings awsds.RetrySettings) aws.Retryer {
+	standardOptions := func(options *retry.StandardOptions) {
+		if settings.MaxAttempts > 0 {
+			options.MaxAttempts = settings.MaxAttempts
+		}
+		if settings.MaxBackoff > 0 {
+			options.MaxBackoff = settings.MaxBackoff
+		}
+		switch {
+		case settings.RetryQuotaTokens > 0:
+			options.RateLimiter = ratelimit.NewTokenRateLimit(uint(settings.RetryQuotaTokens))
+		case settings.RetryQuotaTokens < 0:
+			options.RateLimiter = ratelimit.None
+		}
+	}
+	if settings.Mode == aws.RetryModeAdaptive {
+		return retry.NewAdaptiveMode(func(options *retry.AdaptiveModeOptions) {
+			options.StandardOptions = append(options.StandardOptions, standardOptions)
+		})
+	}
+	return retry.NewStandard(standardOptions)
+}
+
 func (s Settings) WithHTTPClient() LoadOptionsFunc {
 	return s.WithHTTPClientFromAuthSettings(nil)
 }
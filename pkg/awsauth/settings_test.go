@@ -1,8 +1,20 @@
 package awsauth
 
 import (
+	"context"
+	"errors"
+	"maps"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/config"
+	smithymiddleware "github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/proxy"
+	grafanaconfig "github.com/grafana/grafana-plugin-sdk-go/config"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -44,3 +56,110 @@ func TestGetProxyUrl(t *testing.T) {
 		})
 	}
 }
+
+func TestSettings_WithRetryFromAuthSettings(t *testing.T) {
+	t.Run("keeps the AWS SDK retryer without retry settings", func(t *testing.T) {
+		var options config.LoadOptions
+		require.NoError(t, Settings{}.WithRetryFromAuthSettings(&awsds.AuthSettings{})(&options))
+		assert.Nil(t, options.Retryer)
+	})
+
+	t.Run("datasource settings take precedence over the Grafana config", func(t *testing.T) {
+		var options config.LoadOptions
+		settings := Settings{Retry: awsds.RetrySettings{MaxAttempts: 7}}
+		authSettings := &awsds.AuthSettings{Retry: awsds.RetrySettings{MaxAttempts: 2, MaxBackoff: time.Second}}
+		require.NoError(t, settings.WithRetryFromAuthSettings(authSettings)(&options))
+		require.NotNil(t, options.Retryer)
+		retryer := options.Retryer()
+		assert.IsType(t, &retry.Standard{}, retryer)
+		assert.Equal(t, 7, retryer.MaxAttempts())
+		delay, err := retryer.RetryDelay(20, errors.New("throttled"))
+		require.NoError(t, err)
+		assert.LessOrEqual(t, delay, time.Second)
+	})
+
+	t.Run("request rate limit", func(t *testing.T) {
+		var options config.LoadOptions
+		settings := Settings{Retry: awsds.RetrySettings{RateLimit: 5}}
+		require.NoError(t, settings.WithRetry()(&options))
+		require.Len(t, options.APIOptions, 1)
+		stack := smithymiddleware.NewStack("test", smithyhttp.NewStackRequest)
+		require.NoError(t, options.APIOptions[0](stack))
+		_, ok := stack.Finalize.Get("RequestRateLimit")
+		assert.True(t, ok)
+	})
+
+	t.Run("adaptive mode", func(t *testing.T) {
+		var options config.LoadOptions
+		settings := Settings{Retry: awsds.RetrySettings{Mode: aws.RetryModeAdaptive, MaxAttempts: 4}}
+		require.NoError(t, settings.WithRetry()(&options))
+		retryer := options.Retryer()
+		assert.IsType(t, &retry.AdaptiveMode{}, retryer)
+		assert.Equal(t, 4, retryer.MaxAttempts())
+	})
+
+	t.Run("retry quota", func(t *testing.T) {
+		retryErr := errors.New("unavailable")
+		for _, tt := range []struct {
+			tokens  int
+			retries int
+		}{
+			{tokens: 10, retries: 2},
+			{tokens: -1, retries: 100},
+		} {
+			var options config.LoadOptions
+			settings := Settings{Retry: awsds.RetrySettings{RetryQuotaTokens: tt.tokens}}
+			require.NoError(t, settings.WithRetry()(&options))
+			retryer := options.Retryer()
+			retries := 0
+			for ; retries < 100; retries++ {
+				if _, err := retryer.GetRetryToken(context.Background(), retryErr); err != nil {
+					break
+				}
+			}
+			assert.Equal(t, tt.retries, retries, "retries paid from a quota of %d tokens", tt.tokens)
+		}
+	})
+}
+
+func TestGetConfig_retrySettings(t *testing.T) {
+	grafanaCfg := maps.Clone(defaultGrafanaConfig)
+	grafanaCfg[awsds.RetryMaxAttemptsEnvVarKeyName] = "6"
+	grafanaCfg[awsds.RetryModeEnvVarKeyName] = "adaptive"
+	ctx := grafanaconfig.WithGrafanaConfig(context.Background(), grafanaconfig.NewGrafanaCfg(grafanaCfg))
+	provider := newAWSConfigProviderWithClient(awsAPIClient{})
+	settings := Settings{AuthType: AuthTypeKeys, AccessKey: "tensile", SecretKey: "diaphanous", Region: "eu-north-1"}
+
+	cfg, err := provider.GetConfig(ctx, settings)
+	require.NoError(t, err)
+	require.NotNil(t, cfg.Retryer)
+	assert.IsType(t, &retry.AdaptiveMode{}, cfg.Retryer())
+	assert.Equal(t, 6, cfg.Retryer().MaxAttempts())
+
+	settings.Retry = awsds.RetrySettings{MaxAttempts: 2, Mode: aws.RetryModeStandard}
+	cfg, err = provider.GetConfig(ctx, settings)
+	require.NoError(t, err)
+	assert.IsType(t, &retry.Standard{}, cfg.Retryer())
+	assert.Equal(t, 2, cfg.Retryer().MaxAttempts(), "configs with other retry settings are cached apart")
+}
+
+func TestSettings_Hash(t *testing.T) {
+	base := Settings{AuthType: AuthTypeKeys, AccessKey: "key", SecretKey: "secret", Region: "us-east-1"}
+	withProxy := func(modify func(*proxy.Options)) Settings {
+		s := base
+		s.ProxyOptions = &proxy.Options{
+			Enabled:   true,
+			Auth:      &proxy.AuthOptions{Username: "ds1", Password: "pw"},
+			ClientCfg: &proxy.ClientCfg{ProxyAddress: "proxy:8080", ServerName: "proxy"},
+		}
+		modify(s.ProxyOptions)
+		return s
+	}
+
+	assert.Equal(t, base.Hash(), base.Hash())
+	assert.NotEqual(t, base.Hash(), withProxy(func(*proxy.Options) {}).Hash())
+	assert.Equal(t, withProxy(func(*proxy.Options) {}).Hash(), withProxy(func(*proxy.Options) {}).Hash())
+	assert.NotEqual(t, withProxy(func(*proxy.Options) {}).Hash(), withProxy(func(o *proxy.Options) { o.Auth.Username = "ds2" }).Hash())
+	assert.NotEqual(t, withProxy(func(*proxy.Options) {}).Hash(), withProxy(func(o *proxy.Options) { o.ClientCfg.ProxyAddress = "other:8080" }).Hash())
+	assert.NotEqual(t, withProxy(func(*proxy.Options) {}).Hash(), withProxy(func(o *proxy.Options) { o.Enabled = false }).Hash())
+}
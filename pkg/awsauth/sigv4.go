@@ -5,6 +5,7 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -13,8 +14,11 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/aws/signer/v4"
 
+	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
+	"github.com/grafana/grafana-aws-sdk/pkg/common"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const EmptySha256Hash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
@@ -38,13 +42,23 @@ func (s SignerMiddleware) MiddlewareName() string {
 	return "sigv4"
 }
 
+// NewSignerRoundTripper returns a SignerRoundTripper that resolves AWS
+// configuration through the process-wide SharedConfigProvider.
 func NewSignerRoundTripper(opts httpclient.Options, next http.RoundTripper, signer v4.HTTPSigner) SignerRoundTripper {
+	return NewSignerRoundTripperWithConfigProvider(opts, next, signer, SharedConfigProvider())
+}
+
+// NewSignerRoundTripperWithConfigProvider returns a SignerRoundTripper that
+// resolves AWS configuration through the given ConfigProvider.
+func NewSignerRoundTripperWithConfigProvider(opts httpclient.Options, next http.RoundTripper, signer v4.HTTPSigner, provider ConfigProvider) SignerRoundTripper {
 	return SignerRoundTripper{
 		httpOptions:       opts,
 		next:              next,
-		awsConfigProvider: NewConfigProvider(),
+		awsConfigProvider: provider,
 		signer:            signer,
 		clock:             systemClock{},
+		clockSkew:         &clockSkew{},
+		fetcher:           credentialsFetcherFor(provider),
 	}
 }
 
@@ -54,6 +68,8 @@ type SignerRoundTripper struct {
 	awsConfigProvider ConfigProvider
 	signer            v4.HTTPSigner
 	clock             Clock
+	clockSkew         *clockSkew
+	fetcher           *credentialsFetcher
 }
 
 func (s SignerRoundTripper) RoundTrip(req *http.Request) (resp *http.Response, e error) {
@@ -62,25 +78,54 @@ func (s SignerRoundTripper) RoundTrip(req *http.Request) (resp *http.Response, e
 			e = fmt.Errorf("panic caught in SignerRoundTripper.RoundTrip(): %v", err)
 		}
 	}()
-	awsAuthSettings := Settings{
-		AuthType:           AuthType(s.httpOptions.SigV4.AuthType),
-		AccessKey:          s.httpOptions.SigV4.AccessKey,
-		SecretKey:          s.httpOptions.SigV4.SecretKey,
-		SessionToken:       s.httpOptions.SigV4.SessionToken,
-		Region:             s.httpOptions.SigV4.Region,
-		CredentialsProfile: s.httpOptions.SigV4.Profile,
-		AssumeRoleARN:      s.httpOptions.SigV4.AssumeRoleARN,
-		ExternalID:         s.httpOptions.SigV4.ExternalID,
-		ProxyOptions:       s.httpOptions.ProxyOptions,
-		HTTPClient:         &http.Client{},
-	}
-	ctx := req.Context()
-	cfg, err := s.awsConfigProvider.GetConfig(ctx, awsAuthSettings)
+	awsAuthSettings := sigV4AuthSettings(s.httpOptions)
+	ctx, span := common.StartSpan(req.Context(), "awsauth.SignerRoundTripper.RoundTrip",
+		common.AttributeAuthType.String(string(awsAuthSettings.GetAuthType())),
+		common.AttributeRegion.String(awsAuthSettings.Region),
+		common.AttributeService.String(s.httpOptions.SigV4.Service),
+		attribute.String("http.request.method", req.Method),
+	)
+	defer func() {
+		if resp != nil {
+			span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+		}
+		common.EndSpan(span, e)
+	}()
+	_, credentials, err := s.fetcher.fetch(ctx, s.awsConfigProvider, awsAuthSettings)
+	if err != nil {
+		return nil, err
+	}
+	originalHeader := req.Header.Clone()
+	resp, err = s.signAndSend(ctx, req, credentials)
+	if err != nil {
+		return resp, err
+	}
+
+	// A request rejected because the local clock has drifted is re-signed once
+	// with the server's notion of time, provided the body can be sent again.
+	offset, skewed := clockSkewFromResponse(resp, s.clock.Now())
+	if !skewed || !isReplayable(req) {
+		return resp, nil
+	}
+	s.clockSkew.set(offset)
+	retryReq, err := cloneForRetry(req, originalHeader)
+	if err != nil {
+		return resp, nil
+	}
+	backend.Logger.FromContext(ctx).Warn("AWS rejected request due to clock skew, retrying with adjusted signing time", "skew", offset)
+	drainAndClose(resp)
+	return s.signAndSend(ctx, retryReq, credentials)
+}
+
+// retrieveCredentials resolves the AWS config for settings and retrieves
+// credentials from it.
+func retrieveCredentials(ctx context.Context, provider ConfigProvider, settings Settings) (aws.Config, aws.Credentials, error) {
+	cfg, err := provider.GetConfig(ctx, settings)
 	if err != nil {
 		// Resolving the AWS auth config (auth type, profile, assume-role setup)
 		// depends on the user's datasource configuration, so a failure here is a
 		// downstream error rather than a plugin fault.
-		return nil, backend.DownstreamError(err)
+		return aws.Config{}, aws.Credentials{}, credentialsError(err)
 	}
 	credentials, err := cfg.Credentials.Retrieve(ctx)
 	if err != nil {
@@ -88,13 +133,45 @@ func (s SignerRoundTripper) RoundTrip(req *http.Request) (resp *http.Response, e
 		// or invalid credentials) originate from the user's AWS account and IAM
 		// configuration, not the plugin. Mark them downstream so they are not
 		// misattributed to the plugin (which drops plugin error-rate SLOs).
-		return nil, backend.DownstreamError(err)
+		return aws.Config{}, aws.Credentials{}, credentialsError(err)
 	}
-	err = s.SignHTTP(ctx, req, credentials)
+	return cfg, credentials, nil
+}
+
+// credentialsError classifies err when it is a known AWS API error, and
+// marks it downstream otherwise.
+func credentialsError(err error) error {
+	err = awsds.ClassifyAWSError(err)
+	var withSource backend.ErrorWithSource
+	if errors.As(err, &withSource) {
+		return err
+	}
+	return backend.DownstreamError(err)
+}
+
+// signingRegion returns the region requests should be signed for: the one in
+// settings when set, otherwise the one resolved into cfg.
+func signingRegion(settings Settings, cfg aws.Config) string {
+	if settings.Region != "" && settings.Region != "default" {
+		return settings.Region
+	}
+	return cfg.Region
+}
+
+func (s SignerRoundTripper) signAndSend(ctx context.Context, req *http.Request, credentials aws.Credentials) (*http.Response, error) {
+	err := s.SignHTTP(ctx, req, credentials)
 	if err != nil {
 		return nil, err
 	}
-	return s.next.RoundTrip(req)
+	verbose := awsds.ReadSigV4Settings(ctx).VerboseLogging
+	if verbose {
+		logSignedRequest(backend.Logger.FromContext(ctx), req, s.httpOptions.SigV4.Service, s.httpOptions.SigV4.Region)
+	}
+	resp, err := s.next.RoundTrip(req)
+	if verbose {
+		logFailedResponse(backend.Logger.FromContext(ctx), req, resp, err)
+	}
+	return resp, err
 }
 
 func (s SignerRoundTripper) SignHTTP(ctx context.Context, req *http.Request, credentials aws.Credentials) error {
@@ -120,7 +197,17 @@ func (s SignerRoundTripper) SignHTTP(ctx context.Context, req *http.Request, cre
 	if err != nil {
 		return err
 	}
-	return s.signer.SignHTTP(ctx, credentials, req, payloadHash, s.httpOptions.SigV4.Service, s.httpOptions.SigV4.Region, s.clock.Now().UTC(), signerOptions...)
+	if awsds.ReadSigV4Settings(ctx).VerboseLogging {
+		signerOptions = append(signerOptions, func(options *v4.SignerOptions) {
+			options.LogSigning = true
+			options.Logger = signingLogger{backend.Logger.FromContext(ctx)}
+		})
+	}
+	start := time.Now()
+	defer func() {
+		signingDurationMetric.WithLabelValues(s.httpOptions.SigV4.Service).Observe(time.Since(start).Seconds())
+	}()
+	return s.signer.SignHTTP(ctx, credentials, req, payloadHash, s.httpOptions.SigV4.Service, s.httpOptions.SigV4.Region, s.signingTime(), signerOptions...)
 }
 
 func getRequestBodyHash(req *http.Request) (string, error) {
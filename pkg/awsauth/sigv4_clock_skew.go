@@ -0,0 +1,119 @@
+package awsauth
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// maxClockSkewBodyBytes bounds how much of an error response is read while
+// looking for a clock skew error code.
+const maxClockSkewBodyBytes = 64 * 1024
+
+// clockSkewErrorMarkers are the error codes and messages AWS services return
+// when a request was signed with a time too far from the server's clock.
+var clockSkewErrorMarkers = []string{
+	"RequestTimeTooSkewed",
+	"SignatureExpired",
+	"Signature expired",
+	"Signature not yet current",
+}
+
+// clockSkew holds the offset applied to the local clock when signing. It is
+// shared by copies of a SignerRoundTripper so an adjustment made by one
+// request applies to the following ones.
+type clockSkew struct {
+	offset atomic.Int64
+}
+
+func (c *clockSkew) get() time.Duration {
+	if c == nil {
+		return 0
+	}
+	return time.Duration(c.offset.Load())
+}
+
+func (c *clockSkew) set(offset time.Duration) {
+	if c == nil {
+		return
+	}
+	c.offset.Store(int64(offset))
+	clockSkewMetric.Set(offset.Seconds())
+}
+
+func (s SignerRoundTripper) signingTime() time.Time {
+	return s.clock.Now().Add(s.clockSkew.get()).UTC()
+}
+
+// clockSkewFromResponse reports whether resp was rejected because of clock
+// skew and, if so, the offset between the server's Date header and now. The
+// response body is read to find the error code and is left readable.
+func clockSkewFromResponse(resp *http.Response, now time.Time) (time.Duration, bool) {
+	if resp == nil || (resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusBadRequest) {
+		return 0, false
+	}
+	serverTime, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return 0, false
+	}
+	if !isClockSkewError(resp) {
+		return 0, false
+	}
+	return serverTime.Sub(now), true
+}
+
+func isClockSkewError(resp *http.Response) bool {
+	for _, marker := range clockSkewErrorMarkers {
+		if strings.Contains(resp.Header.Get("X-Amzn-Errortype"), marker) {
+			return true
+		}
+	}
+	if resp.Body == nil {
+		return false
+	}
+	peeked, err := io.ReadAll(io.LimitReader(resp.Body, maxClockSkewBodyBytes))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(peeked), resp.Body), resp.Body}
+	if err != nil {
+		return false
+	}
+	for _, marker := range clockSkewErrorMarkers {
+		if bytes.Contains(peeked, []byte(marker)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isReplayable reports whether the body of req can be sent a second time.
+func isReplayable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// cloneForRetry returns a copy of req with its original, unsigned headers and
+// a fresh body, ready to be signed again.
+func cloneForRetry(req *http.Request, originalHeader http.Header) (*http.Request, error) {
+	retryReq := req.Clone(req.Context())
+	retryReq.Header = originalHeader
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		retryReq.Body = body
+	}
+	return retryReq, nil
+}
+
+func drainAndClose(resp *http.Response) {
+	if resp.Body == nil {
+		return
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxClockSkewBodyBytes))
+	_ = resp.Body.Close()
+}
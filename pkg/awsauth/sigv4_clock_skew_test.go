@@ -0,0 +1,116 @@
+package awsauth
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// skewedRoundTripper rejects requests signed too far from serverTime with a
+// clock skew error, the way AWS services do.
+type skewedRoundTripper struct {
+	serverTime time.Time
+	errorBody  string
+	noDate     bool
+	amzDates   []string
+	bodies     []string
+}
+
+func (rt *skewedRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	amzDate := req.Header.Get("X-Amz-Date")
+	rt.amzDates = append(rt.amzDates, amzDate)
+	if req.Body != nil {
+		body, _ := io.ReadAll(req.Body)
+		rt.bodies = append(rt.bodies, string(body))
+	}
+	signedAt, _ := time.Parse("20060102T150405Z", amzDate)
+	if rt.serverTime.Sub(signedAt).Abs() <= 5*time.Minute {
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	}
+	header := http.Header{}
+	if !rt.noDate {
+		header.Set("Date", rt.serverTime.Format(http.TimeFormat))
+	}
+	return &http.Response{
+		StatusCode: http.StatusForbidden,
+		Header:     header,
+		Body:       io.NopCloser(strings.NewReader(rt.errorBody)),
+	}, nil
+}
+
+func TestSignerRoundTripper_ClockSkew(t *testing.T) {
+	sigV4Config := &httpclient.SigV4Config{AuthType: "keys", Region: "us-east-1", Service: "es"}
+	serverTime := OnceUponATime.Add(20 * time.Minute)
+	skewedBody := `<Error><Code>RequestTimeTooSkewed</Code><Message>The difference between the request time and the current time is too large.</Message></Error>`
+
+	newRoundTripper := func(next http.RoundTripper) SignerRoundTripper {
+		s := NewSignerRoundTripperWithConfigProvider(httpclient.Options{SigV4: sigV4Config}, next, v4.NewSigner(), NewFakeConfigProvider(false))
+		s.clock = staticClock{OnceUponATime}
+		return s
+	}
+
+	t.Run("re-signs with the server time and retries once", func(t *testing.T) {
+		next := &skewedRoundTripper{serverTime: serverTime, errorBody: skewedBody}
+		s := newRoundTripper(next)
+
+		req, _ := http.NewRequest("POST", "https://service.aws.amazon.notreally/_search", strings.NewReader(`{"query":{}}`))
+		resp, err := s.RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Len(t, next.amzDates, 2)
+		assert.Equal(t, serverTime.UTC().Format("20060102T150405Z"), next.amzDates[1])
+		assert.Equal(t, []string{`{"query":{}}`, `{"query":{}}`}, next.bodies)
+		assert.Equal(t, 20*time.Minute, s.clockSkew.get())
+
+		// the adjustment sticks for later requests
+		later, _ := http.NewRequest("GET", "https://service.aws.amazon.notreally/_search", nil)
+		resp, err = s.RoundTrip(later)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Len(t, next.amzDates, 3)
+	})
+
+	t.Run("signature expired message is detected", func(t *testing.T) {
+		next := &skewedRoundTripper{serverTime: serverTime, errorBody: `{"message":"Signature expired: 20090213T233130Z is now earlier than 20090213T234630Z"}`}
+		s := newRoundTripper(next)
+
+		req, _ := http.NewRequest("GET", "https://service.aws.amazon.notreally/_search", nil)
+		resp, err := s.RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Len(t, next.amzDates, 2)
+	})
+
+	t.Run("other errors are passed through untouched", func(t *testing.T) {
+		next := &skewedRoundTripper{serverTime: serverTime, errorBody: `<Error><Code>AccessDenied</Code></Error>`}
+		s := newRoundTripper(next)
+
+		req, _ := http.NewRequest("GET", "https://service.aws.amazon.notreally/_search", nil)
+		resp, err := s.RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+		assert.Len(t, next.amzDates, 1)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, `<Error><Code>AccessDenied</Code></Error>`, string(body))
+	})
+
+	t.Run("no retry without a server Date header", func(t *testing.T) {
+		next := &skewedRoundTripper{serverTime: serverTime, errorBody: skewedBody, noDate: true}
+		s := newRoundTripper(next)
+
+		req, _ := http.NewRequest("GET", "https://service.aws.amazon.notreally/_search", nil)
+		resp, err := s.RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+		assert.Len(t, next.amzDates, 1)
+		assert.Equal(t, time.Duration(0), s.clockSkew.get())
+	})
+}
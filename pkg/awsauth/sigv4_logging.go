@@ -0,0 +1,88 @@
+package awsauth
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/aws/smithy-go/logging"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+const redacted = "[REDACTED]"
+
+// sigV4SecretPatterns match the values that may show up in signing output but
+// must never be logged: session tokens (as a canonical header or a presigned
+// query parameter) and the signature of presigned URLs, which is a bearer
+// credential on its own.
+var sigV4SecretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?im)^(x-amz-security-token:).*$`),
+	regexp.MustCompile(`(?i)(X-Amz-Security-Token=)[^&\s]*`),
+	regexp.MustCompile(`(?i)(X-Amz-Signature=)[^&\s]*`),
+}
+
+func redactSigV4Secrets(msg string) string {
+	for _, pattern := range sigV4SecretPatterns {
+		msg = pattern.ReplaceAllString(msg, "${1}"+redacted)
+	}
+	return msg
+}
+
+// signingLogger adapts a plugin logger to the logger expected by the v4 signer,
+// which logs the canonical request and the string to sign when LogSigning is set.
+type signingLogger struct {
+	logger log.Logger
+}
+
+func (l signingLogger) Logf(_ logging.Classification, format string, v ...interface{}) {
+	l.logger.Info(redactSigV4Secrets(fmt.Sprintf(format, v...)))
+}
+
+// signedHeadersFromAuthorization extracts the SignedHeaders component of a
+// SigV4 Authorization header value.
+func signedHeadersFromAuthorization(authorization string) string {
+	for _, part := range strings.Split(authorization, ",") {
+		part = strings.TrimSpace(part)
+		if signedHeaders, ok := strings.CutPrefix(part, "SignedHeaders="); ok {
+			return signedHeaders
+		}
+	}
+	return ""
+}
+
+func logSignedRequest(logger log.Logger, req *http.Request, service, region string) {
+	logger.Info("SigV4 request signed",
+		"method", req.Method,
+		"url", redactSigV4Secrets(req.URL.String()),
+		"service", service,
+		"region", region,
+		"signedHeaders", signedHeadersFromAuthorization(req.Header.Get("Authorization")),
+		"amzDate", req.Header.Get("X-Amz-Date"),
+	)
+}
+
+// logFailedResponse logs the details AWS returns for a rejected request. The
+// request ID is what AWS support needs to trace a SignatureDoesNotMatch error.
+func logFailedResponse(logger log.Logger, req *http.Request, resp *http.Response, err error) {
+	if err != nil {
+		logger.Info("SigV4 request failed", "method", req.Method, "url", redactSigV4Secrets(req.URL.String()), "error", err)
+		return
+	}
+	if resp == nil || resp.StatusCode < http.StatusBadRequest {
+		return
+	}
+	requestID := resp.Header.Get("X-Amzn-Requestid")
+	if requestID == "" {
+		// S3 uses its own request ID header
+		requestID = resp.Header.Get("X-Amz-Request-Id")
+	}
+	logger.Info("SigV4 request rejected",
+		"method", req.Method,
+		"url", redactSigV4Secrets(req.URL.String()),
+		"status", resp.StatusCode,
+		"requestId", requestID,
+		"errorType", resp.Header.Get("X-Amzn-Errortype"),
+		"signedHeaders", signedHeadersFromAuthorization(req.Header.Get("Authorization")),
+	)
+}
@@ -0,0 +1,125 @@
+package awsauth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_redactSigV4Secrets(t *testing.T) {
+	tests := []struct {
+		name     string
+		msg      string
+		expected string
+	}{
+		{
+			name:     "canonical header",
+			msg:      "host:example.com\nx-amz-security-token:supersecret\nx-amz-date:20090213T233130Z",
+			expected: "host:example.com\nx-amz-security-token:[REDACTED]\nx-amz-date:20090213T233130Z",
+		},
+		{
+			name:     "presigned query",
+			msg:      "https://example.com/?X-Amz-Credential=AKID&X-Amz-Security-Token=supersecret&X-Amz-Signature=abc123",
+			expected: "https://example.com/?X-Amz-Credential=AKID&X-Amz-Security-Token=[REDACTED]&X-Amz-Signature=[REDACTED]",
+		},
+		{
+			name:     "nothing to redact",
+			msg:      "GET\n/\n\nhost:example.com",
+			expected: "GET\n/\n\nhost:example.com",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, redactSigV4Secrets(tt.msg))
+		})
+	}
+}
+
+func Test_signedHeadersFromAuthorization(t *testing.T) {
+	authorization := "AWS4-HMAC-SHA256 Credential=AKID/20090213/us-east-1/es/aws4_request, SignedHeaders=host;x-amz-date;x-amz-security-token, Signature=abc"
+	assert.Equal(t, "host;x-amz-date;x-amz-security-token", signedHeadersFromAuthorization(authorization))
+	assert.Equal(t, "", signedHeadersFromAuthorization(""))
+}
+
+// capturingLogger records every message and its key/value pairs as one line.
+type capturingLogger struct {
+	lines *[]string
+}
+
+func (l capturingLogger) record(msg string, args ...interface{}) {
+	*l.lines = append(*l.lines, fmt.Sprint(append([]interface{}{msg}, args...)...))
+}
+func (l capturingLogger) Debug(msg string, args ...interface{})    { l.record(msg, args...) }
+func (l capturingLogger) Info(msg string, args ...interface{})     { l.record(msg, args...) }
+func (l capturingLogger) Warn(msg string, args ...interface{})     { l.record(msg, args...) }
+func (l capturingLogger) Error(msg string, args ...interface{})    { l.record(msg, args...) }
+func (l capturingLogger) With(_ ...interface{}) log.Logger         { return l }
+func (l capturingLogger) Level() log.Level                         { return log.Debug }
+func (l capturingLogger) FromContext(_ context.Context) log.Logger { return l }
+
+// sessionConfigProvider returns credentials with a recognizable session token.
+type sessionConfigProvider struct{}
+
+func (sessionConfigProvider) GetConfig(_ context.Context, _ Settings) (aws.Config, error) {
+	return aws.Config{Credentials: credentials.NewStaticCredentialsProvider("AKID", "topsecretkey", "topsecrettoken")}, nil
+}
+
+type rejectingRoundTripper struct{}
+
+func (rejectingRoundTripper) RoundTrip(_ *http.Request) (*http.Response, error) {
+	header := http.Header{}
+	header.Set("X-Amzn-Requestid", "req-1234")
+	header.Set("X-Amzn-Errortype", "InvalidSignatureException")
+	return &http.Response{StatusCode: http.StatusForbidden, Header: header}, nil
+}
+
+func TestSignerRoundTripper_VerboseLogging(t *testing.T) {
+	sigV4Config := &httpclient.SigV4Config{AuthType: "keys", Region: "us-east-1", Service: "es"}
+
+	run := func(t *testing.T, verbose string) string {
+		var lines []string
+		originalLogger := backend.Logger
+		backend.Logger = capturingLogger{&lines}
+		defer func() { backend.Logger = originalLogger }()
+
+		ctx := config.WithGrafanaConfig(context.Background(), config.NewGrafanaCfg(map[string]string{
+			awsds.SigV4VerboseLoggingEnvVarKeyName: verbose,
+		}))
+		s := NewSignerRoundTripperWithConfigProvider(httpclient.Options{SigV4: sigV4Config}, rejectingRoundTripper{}, v4.NewSigner(), sessionConfigProvider{})
+		s.clock = staticClock{OnceUponATime}
+		req, _ := http.NewRequestWithContext(ctx, "GET", "https://service.aws.amazon.notreally/_search", nil)
+		resp, err := s.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusForbidden, resp.StatusCode)
+		return strings.Join(lines, "\n")
+	}
+
+	t.Run("logs signing details and failures without secrets", func(t *testing.T) {
+		output := run(t, "true")
+		assert.Contains(t, output, "CANONICAL STRING")
+		assert.Contains(t, output, "STRING TO SIGN")
+		assert.Contains(t, output, "x-amz-security-token:"+redacted)
+		assert.Contains(t, output, "host;x-amz-date;x-amz-security-token")
+		assert.Contains(t, output, "req-1234")
+		assert.Contains(t, output, "InvalidSignatureException")
+		assert.NotContains(t, output, "topsecrettoken")
+		assert.NotContains(t, output, "topsecretkey")
+	})
+
+	t.Run("logs nothing when disabled", func(t *testing.T) {
+		assert.Empty(t, run(t, "false"))
+	})
+}
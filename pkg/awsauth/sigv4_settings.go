@@ -0,0 +1,81 @@
+package awsauth
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+)
+
+// Datasource JSON keys for the SigV4 settings that httpclient.SigV4Config does
+// not carry. They are read from the datasource JSON data the plugin SDK puts in
+// httpclient.Options.CustomOptions.
+const (
+	SigV4EndpointKey                   = "sigV4Endpoint"
+	SigV4GrafanaExternalIDKey          = "sigV4GrafanaExternalId"
+	SigV4UsePerDatasourceExternalIDKey = "sigV4UsePerDatasourceExternalId"
+	SigV4ProxyTypeKey                  = "sigV4ProxyType"
+	SigV4ProxyUrlKey                   = "sigV4ProxyUrl"
+	SigV4ProxyUsernameKey              = "sigV4ProxyUsername"
+	// SigV4ProxyPasswordKey is read from the secure JSON data
+	SigV4ProxyPasswordKey = "sigV4ProxyPassword"
+)
+
+// sigV4AuthSettings builds the Settings used to sign requests for a SigV4
+// datasource, so it authenticates the same way as one configured through
+// AWSDatasourceSettings.
+func sigV4AuthSettings(opts httpclient.Options) Settings {
+	settings := Settings{
+		AuthType:           AuthType(opts.SigV4.AuthType),
+		AccessKey:          opts.SigV4.AccessKey,
+		SecretKey:          opts.SigV4.SecretKey,
+		SessionToken:       opts.SigV4.SessionToken,
+		Region:             opts.SigV4.Region,
+		CredentialsProfile: opts.SigV4.Profile,
+		AssumeRoleARN:      opts.SigV4.AssumeRoleARN,
+		ExternalID:         opts.SigV4.ExternalID,
+		ProxyOptions:       opts.ProxyOptions,
+		HTTPClient:         &http.Client{},
+	}
+
+	jsonData := backend.JSONDataFromHTTPClientOptions(opts)
+	settings.Endpoint = stringOption(jsonData, SigV4EndpointKey)
+	settings.GrafanaExternalID = stringOption(jsonData, SigV4GrafanaExternalIDKey)
+	if usePerDatasourceExternalID, ok := boolOption(jsonData, SigV4UsePerDatasourceExternalIDKey); ok {
+		settings.UsePerDatasourceExternalID = &usePerDatasourceExternalID
+	}
+	if proxyType := stringOption(jsonData, SigV4ProxyTypeKey); proxyType != "" {
+		settings.PerDatasourceProxySettings = &PerDatasourceProxySettings{
+			ProxyType:     GetProxyTypeFromString(proxyType),
+			ProxyUrl:      stringOption(jsonData, SigV4ProxyUrlKey),
+			ProxyUsername: stringOption(jsonData, SigV4ProxyUsernameKey),
+			ProxyPassword: backend.SecureJSONDataFromHTTPClientOptions(opts)[SigV4ProxyPasswordKey],
+		}
+	}
+	// the retry settings use the same keys as AWSDatasourceSettings.Retry
+	if rawJSONData, err := json.Marshal(jsonData); err == nil {
+		settings.Retry = awsds.ReadRetrySettings(rawJSONData)
+	}
+	return settings
+}
+
+func stringOption(jsonData map[string]interface{}, key string) string {
+	v, _ := jsonData[key].(string)
+	return v
+}
+
+// boolOption reads a boolean that may have been stored as a string.
+func boolOption(jsonData map[string]interface{}, key string) (bool, bool) {
+	switch v := jsonData[key].(type) {
+	case bool:
+		return v, true
+	case string:
+		b, err := strconv.ParseBool(v)
+		return b, err == nil
+	default:
+		return false, false
+	}
+}
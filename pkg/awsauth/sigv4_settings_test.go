@@ -0,0 +1,168 @@
+package awsauth
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	ststypes "github.com/aws/aws-sdk-go-v2/service/sts/types"
+	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana-plugin-sdk-go/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// capturingConfigProvider records the Settings it is asked for.
+type capturingConfigProvider struct {
+	settings Settings
+}
+
+func (c *capturingConfigProvider) GetConfig(ctx context.Context, settings Settings) (aws.Config, error) {
+	c.settings = settings
+	return NewFakeConfigProvider(false).GetConfig(ctx, settings)
+}
+
+func httpClientOptions(t *testing.T, jsonData string, secureJSONData map[string]string) httpclient.Options {
+	t.Helper()
+	settings := backend.DataSourceInstanceSettings{
+		JSONData:                []byte(jsonData),
+		DecryptedSecureJSONData: secureJSONData,
+	}
+	opts, err := settings.HTTPClientOptions(context.Background())
+	require.NoError(t, err)
+	require.NotNil(t, opts.SigV4)
+	return opts
+}
+
+func TestSignerRoundTripper_AuthSettingsParity(t *testing.T) {
+	tests := []struct {
+		name           string
+		jsonData       string
+		secureJSONData map[string]string
+		expected       Settings
+	}{
+		{
+			name:           "keys",
+			jsonData:       `{"sigV4Auth":true,"sigV4AuthType":"keys","sigV4Region":"eu-west-1","sigV4Endpoint":"https://es.example.com"}`,
+			secureJSONData: map[string]string{"sigV4AccessKey": "AKID", "sigV4SecretKey": "secret"},
+			expected: Settings{
+				AuthType:  AuthTypeKeys,
+				AccessKey: "AKID",
+				SecretKey: "secret",
+				Region:    "eu-west-1",
+				Endpoint:  "https://es.example.com",
+			},
+		},
+		{
+			name:     "shared credentials",
+			jsonData: `{"sigV4Auth":true,"sigV4AuthType":"credentials","sigV4Profile":"dev","sigV4Region":"eu-west-1"}`,
+			expected: Settings{
+				AuthType:           AuthTypeSharedCreds,
+				CredentialsProfile: "dev",
+				Region:             "eu-west-1",
+			},
+		},
+		{
+			name:     "default with assume role",
+			jsonData: `{"sigV4Auth":true,"sigV4AuthType":"default","sigV4Region":"eu-west-1","sigV4AssumeRoleArn":"arn:aws:iam::123:role/r","sigV4ExternalId":"ext"}`,
+			expected: Settings{
+				AuthType:      AuthTypeDefault,
+				Region:        "eu-west-1",
+				AssumeRoleARN: "arn:aws:iam::123:role/r",
+				ExternalID:    "ext",
+			},
+		},
+		{
+			name:     "ec2 iam role",
+			jsonData: `{"sigV4Auth":true,"sigV4AuthType":"ec2_iam_role","sigV4Region":"eu-west-1"}`,
+			expected: Settings{
+				AuthType: AuthTypeEC2IAMRole,
+				Region:   "eu-west-1",
+			},
+		},
+		{
+			name:     "grafana assume role with per-datasource external ID",
+			jsonData: `{"sigV4Auth":true,"sigV4AuthType":"grafana_assume_role","sigV4Region":"eu-west-1","sigV4AssumeRoleArn":"arn:aws:iam::123:role/r","sigV4GrafanaExternalId":"stack-ds","sigV4UsePerDatasourceExternalId":true}`,
+			expected: Settings{
+				AuthType:                   AuthTypeGrafanaAssumeRole,
+				Region:                     "eu-west-1",
+				AssumeRoleARN:              "arn:aws:iam::123:role/r",
+				GrafanaExternalID:          "stack-ds",
+				UsePerDatasourceExternalID: boolPtr(true),
+			},
+		},
+		{
+			name:           "per-datasource proxy",
+			jsonData:       `{"sigV4Auth":true,"sigV4AuthType":"keys","sigV4Region":"eu-west-1","sigV4ProxyType":"url","sigV4ProxyUrl":"http://proxy:3128","sigV4ProxyUsername":"user"}`,
+			secureJSONData: map[string]string{"sigV4AccessKey": "AKID", "sigV4SecretKey": "secret", "sigV4ProxyPassword": "pass"},
+			expected: Settings{
+				AuthType:  AuthTypeKeys,
+				AccessKey: "AKID",
+				SecretKey: "secret",
+				Region:    "eu-west-1",
+				PerDatasourceProxySettings: &PerDatasourceProxySettings{
+					ProxyType:     ProxyTypeUrl,
+					ProxyUrl:      "http://proxy:3128",
+					ProxyUsername: "user",
+					ProxyPassword: "pass",
+				},
+			},
+		},
+		{
+			name:     "retry",
+			jsonData: `{"sigV4Auth":true,"sigV4AuthType":"default","sigV4Region":"eu-west-1","retryMaxAttempts":"5","retryMode":"adaptive","rateLimit":10}`,
+			expected: Settings{
+				AuthType: AuthTypeDefault,
+				Region:   "eu-west-1",
+				Retry:    awsds.RetrySettings{MaxAttempts: 5, Mode: aws.RetryModeAdaptive, RateLimit: 10},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := &capturingConfigProvider{}
+			s := NewSignerRoundTripperWithConfigProvider(httpClientOptions(t, tt.jsonData, tt.secureJSONData), &testRoundTripper{}, v4.NewSigner(), provider)
+
+			req, _ := http.NewRequest("GET", "https://service.aws.amazon.notreally", nil)
+			_, err := s.RoundTrip(req)
+			require.NoError(t, err)
+
+			got := provider.settings
+			assert.NotNil(t, got.HTTPClient)
+			got.HTTPClient = nil
+			got.ProxyOptions = nil
+			assert.Equal(t, tt.expected, got)
+		})
+	}
+}
+
+func TestSignerRoundTripper_GrafanaAssumeRoleUsesPerDatasourceExternalID(t *testing.T) {
+	defer setUpAndRestoreEnvironment(map[string]string{
+		"AWS_SHARED_CREDENTIALS_FILE": testDataPath("assume_role_credentials"),
+	})()
+	ctx := config.WithGrafanaConfig(context.Background(), config.NewGrafanaCfg(map[string]string{
+		awsds.GrafanaAssumeRoleExternalIdKeyName: "stack-external-id",
+		awsds.AllowedAuthProvidersEnvVarKeyName:  "grafana_assume_role",
+	}))
+	client := &mockAWSAPIClient{&mockAssumeRoleAPIClient{}}
+	client.assumeRoleClient.On("AssumeRole").Return(false, &ststypes.Credentials{
+		AccessKeyId:     aws.String("horses"),
+		SecretAccessKey: aws.String("unicorns"),
+		SessionToken:    aws.String("riding"),
+		Expiration:      aws.Time(time.Now().Add(time.Hour)),
+	})
+
+	opts := httpClientOptions(t, `{"sigV4Auth":true,"sigV4AuthType":"grafana_assume_role","sigV4Region":"us-east-1","sigV4AssumeRoleArn":"arn:aws:iam::123:role/customer","sigV4GrafanaExternalId":"stack-ds","sigV4UsePerDatasourceExternalId":true}`, nil)
+	s := NewSignerRoundTripperWithConfigProvider(opts, &testRoundTripper{}, v4.NewSigner(), newAWSConfigProviderWithClient(client))
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", "https://service.aws.amazon.notreally", nil)
+	_, err := s.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, "stack-ds", client.assumeRoleClient.calledExternalId)
+	assert.Contains(t, req.Header.Get("Authorization"), "Credential=horses/")
+}
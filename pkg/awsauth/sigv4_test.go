@@ -3,6 +3,7 @@ package awsauth
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"strings"
@@ -11,6 +12,8 @@ import (
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/smithy-go"
+	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
 	"github.com/stretchr/testify/assert"
@@ -229,6 +232,18 @@ func (retrieveFailConfigProvider) GetConfig(_ context.Context, _ Settings) (aws.
 	return aws.Config{Credentials: failingCredentialsProvider{}}, nil
 }
 
+// apiErrorConfigProvider returns a config whose credential retrieval fails
+// with an AWS API error.
+type apiErrorConfigProvider struct {
+	err error
+}
+
+func (p apiErrorConfigProvider) GetConfig(_ context.Context, _ Settings) (aws.Config, error) {
+	return aws.Config{Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+		return aws.Credentials{}, fmt.Errorf("operation error STS: AssumeRole, %w", p.err)
+	})}, nil
+}
+
 // AWS auth/credential failures are the user's responsibility, not the plugin's,
 // so the signer must surface them as downstream errors. Otherwise Grafana
 // defaults the (unlabeled) error to "plugin" and drops plugin error-rate SLOs.
@@ -251,6 +266,21 @@ func TestSignerRoundTripper_AuthFailuresAreDownstream(t *testing.T) {
 		assert.True(t, backend.IsDownstreamError(err), "assume-role/credential failures must be downstream, got: %v", err)
 	})
 
+	t.Run("AWS API errors are classified", func(t *testing.T) {
+		s := NewSignerRoundTripper(httpclient.Options{SigV4: sigV4Config}, &testRoundTripper{}, v4.NewSigner())
+		s.awsConfigProvider = apiErrorConfigProvider{&smithy.GenericAPIError{Code: "ExpiredToken", Message: "The security token included in the request is expired"}}
+
+		req, _ := http.NewRequest("GET", "https://service.aws.amazon.notreally", nil)
+		_, err := s.RoundTrip(req)
+
+		require.Error(t, err)
+		assert.True(t, backend.IsDownstreamError(err))
+		class, ok := awsds.AWSErrorClassOf(err)
+		require.True(t, ok)
+		assert.Equal(t, backend.StatusUnauthorized, class.Status)
+		assert.Contains(t, err.Error(), class.Hint)
+	})
+
 	t.Run("config resolution failure is downstream", func(t *testing.T) {
 		s := NewSignerRoundTripper(httpclient.Options{SigV4: sigV4Config}, &testRoundTripper{}, v4.NewSigner())
 		s.awsConfigProvider = NewFakeConfigProvider(true)
@@ -262,3 +292,54 @@ func TestSignerRoundTripper_AuthFailuresAreDownstream(t *testing.T) {
 		assert.True(t, backend.IsDownstreamError(err), "config resolution failures must be downstream, got: %v", err)
 	})
 }
+
+// countingConfigProvider records how many times GetConfig is called.
+type countingConfigProvider struct {
+	calls int
+}
+
+func (c *countingConfigProvider) GetConfig(ctx context.Context, settings Settings) (aws.Config, error) {
+	c.calls++
+	return NewFakeConfigProvider(false).GetConfig(ctx, settings)
+}
+
+func TestNewSignerRoundTripper_ConfigProvider(t *testing.T) {
+	sigV4Config := &httpclient.SigV4Config{
+		AuthType:  "keys",
+		AccessKey: "good",
+		SecretKey: "excellent",
+		Region:    "us-east-1",
+	}
+
+	t.Run("round trippers share the process-wide provider", func(t *testing.T) {
+		first := NewSignerRoundTripper(httpclient.Options{SigV4: sigV4Config}, &testRoundTripper{}, v4.NewSigner())
+		second := NewSignerRoundTripper(httpclient.Options{SigV4: sigV4Config}, &testRoundTripper{}, v4.NewSigner())
+		assert.Same(t, first.awsConfigProvider, second.awsConfigProvider)
+		assert.Same(t, SharedConfigProvider(), first.awsConfigProvider)
+	})
+
+	t.Run("shared provider can be replaced and restored", func(t *testing.T) {
+		original := SharedConfigProvider()
+		provider := &countingConfigProvider{}
+		restore := SetSharedConfigProvider(provider)
+
+		s := NewSignerRoundTripper(httpclient.Options{SigV4: sigV4Config}, &testRoundTripper{}, v4.NewSigner())
+		req, _ := http.NewRequest("GET", "https://service.aws.amazon.notreally", nil)
+		_, err := s.RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, 1, provider.calls)
+
+		restore()
+		assert.Same(t, original, SharedConfigProvider())
+	})
+
+	t.Run("explicit provider is used", func(t *testing.T) {
+		provider := &countingConfigProvider{}
+		s := NewSignerRoundTripperWithConfigProvider(httpclient.Options{SigV4: sigV4Config}, &testRoundTripper{}, v4.NewSigner(), provider)
+		req, _ := http.NewRequest("GET", "https://service.aws.amazon.notreally", nil)
+		_, err := s.RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, 1, provider.calls)
+		assert.NotSame(t, SharedConfigProvider(), s.awsConfigProvider)
+	})
+}
@@ -49,8 +49,7 @@ func (m *mockAWSAPIClient) NewCredentialsCache(provider aws.CredentialsProvider,
 }
 
 func (m *mockAWSAPIClient) NewEC2RoleCreds() aws.CredentialsProvider {
-	// TODO
-	panic("not implemented")
+	return credentials.NewStaticCredentialsProvider("ec2-access-key", "ec2-secret-key", "")
 }
 
 type mockAssumeRoleAPIClient struct {
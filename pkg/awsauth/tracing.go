@@ -0,0 +1,25 @@
+package awsauth
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/grafana/grafana-aws-sdk/pkg/common"
+)
+
+// tracingAssumeRoleClient records a span for each AssumeRole call, which
+// happens when credentials are first retrieved or refreshed.
+type tracingAssumeRoleClient struct {
+	stscreds.AssumeRoleAPIClient
+	region string
+}
+
+func (c tracingAssumeRoleClient) AssumeRole(ctx context.Context, params *sts.AssumeRoleInput, optFns ...func(*sts.Options)) (output *sts.AssumeRoleOutput, err error) {
+	ctx, span := common.StartSpan(ctx, "sts.AssumeRole",
+		common.AttributeService.String("sts"),
+		common.AttributeRegion.String(c.region),
+	)
+	defer func() { common.EndSpan(span, err) }()
+	return c.AssumeRoleAPIClient.AssumeRole(ctx, params, optFns...)
+}
@@ -0,0 +1,118 @@
+package awsauth
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	ststypes "github.com/aws/aws-sdk-go-v2/service/sts/types"
+	"github.com/grafana/grafana-aws-sdk/pkg/common"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
+	"github.com/grafana/grafana-plugin-sdk-go/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans makes the plugin SDK tracer record spans for the rest of the
+// test.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	tracing.InitDefaultTracer(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test"))
+	t.Cleanup(func() { tracing.InitDefaultTracer(otel.Tracer("test")) })
+	return recorder
+}
+
+func spanAttributes(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attributes := map[attribute.Key]attribute.Value{}
+	for _, kv := range span.Attributes() {
+		attributes[kv.Key] = kv.Value
+	}
+	return attributes
+}
+
+func assertNoSecrets(t *testing.T, span sdktrace.ReadOnlySpan, secrets ...string) {
+	t.Helper()
+	for _, kv := range span.Attributes() {
+		for _, secret := range secrets {
+			assert.NotContains(t, kv.Value.Emit(), secret, "attribute %s of span %s", kv.Key, span.Name())
+		}
+	}
+}
+
+func TestAWSConfigProvider_GetConfig_spans(t *testing.T) {
+	recorder := recordSpans(t)
+	ctx := config.WithGrafanaConfig(context.Background(), config.NewGrafanaCfg(defaultGrafanaConfig))
+	client := &mockAWSAPIClient{&mockAssumeRoleAPIClient{}}
+	client.assumeRoleClient.On("AssumeRole").Return(false, &ststypes.Credentials{
+		AccessKeyId:     aws.String("assumed-key"),
+		SecretAccessKey: aws.String("assumed-secret"),
+		SessionToken:    aws.String("assumed-token"),
+		Expiration:      aws.Time(time.Now().Add(time.Hour)),
+	})
+	provider := newAWSConfigProviderWithClient(client)
+	settings := Settings{
+		AuthType:      AuthTypeKeys,
+		AccessKey:     "source-key",
+		SecretKey:     "source-secret",
+		Region:        "eu-west-1",
+		AssumeRoleARN: "arn:aws:iam::123456789012:role/test",
+		ExternalID:    "external-id",
+	}
+
+	cfg, err := provider.GetConfig(ctx, settings)
+	require.NoError(t, err)
+	_, err = cfg.Credentials.Retrieve(ctx)
+	require.NoError(t, err)
+	_, err = provider.GetConfig(ctx, settings)
+	require.NoError(t, err)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 3)
+	assert.Equal(t, "awsauth.GetConfig", spans[0].Name())
+	assert.Equal(t, "sts.AssumeRole", spans[1].Name())
+	assert.Equal(t, "awsauth.GetConfig", spans[2].Name())
+	miss, hit := spanAttributes(spans[0]), spanAttributes(spans[2])
+	assert.Equal(t, "keys", miss[common.AttributeAuthType].AsString())
+	assert.Equal(t, "eu-west-1", miss[common.AttributeRegion].AsString())
+	assert.True(t, miss[common.AttributeAssumeRole].AsBool())
+	assert.False(t, miss[common.AttributeCacheHit].AsBool())
+	assert.True(t, hit[common.AttributeCacheHit].AsBool())
+	assert.Equal(t, "sts", spanAttributes(spans[1])[common.AttributeService].AsString())
+	for _, span := range spans {
+		assertNoSecrets(t, span, "source-key", "source-secret", "external-id", "assumed-secret", "assumed-token")
+	}
+}
+
+func TestSignerRoundTripper_RoundTrip_span(t *testing.T) {
+	recorder := recordSpans(t)
+	sigV4Config := &httpclient.SigV4Config{
+		AuthType:  "keys",
+		AccessKey: "good",
+		SecretKey: "excellent",
+		Region:    "us-east-1",
+		Service:   "aps",
+	}
+	s := NewSignerRoundTripperWithConfigProvider(httpclient.Options{SigV4: sigV4Config}, &testRoundTripper{}, v4.NewSigner(), NewFakeConfigProvider(false))
+
+	req, _ := http.NewRequest(http.MethodGet, "https://service.aws.amazon.notreally", nil)
+	_, err := s.RoundTrip(req)
+	require.NoError(t, err)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 1)
+	attributes := spanAttributes(spans[0])
+	assert.Equal(t, "awsauth.SignerRoundTripper.RoundTrip", spans[0].Name())
+	assert.Equal(t, "keys", attributes[common.AttributeAuthType].AsString())
+	assert.Equal(t, "us-east-1", attributes[common.AttributeRegion].AsString())
+	assert.Equal(t, "aps", attributes[common.AttributeService].AsString())
+	assert.Equal(t, int64(http.StatusOK), attributes["http.response.status_code"].AsInt64())
+	assertNoSecrets(t, spans[0], "good", "excellent", staticCredentials.SecretAccessKey)
+}
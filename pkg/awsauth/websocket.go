@@ -0,0 +1,348 @@
+package awsauth
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1" // #nosec G505 -- required by the WebSocket handshake (RFC 6455)
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/proxy"
+)
+
+const (
+	// defaultWebSocketURLExpiry is how long a presigned WebSocket URL stays
+	// valid. Five minutes is the maximum most streaming services accept.
+	defaultWebSocketURLExpiry = 5 * time.Minute
+
+	// webSocketAcceptGUID is appended to the handshake key by the server (RFC 6455)
+	webSocketAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+// WebSocketDialer opens WebSocket connections to AWS services that
+// authenticate the upgrade request with a SigV4 presigned URL, such as IoT,
+// Transcribe streaming and AppSync realtime. Credentials are resolved through
+// the same ConfigProvider used for SigV4 HTTP requests, and connections go
+// through the same proxies.
+//
+// Dial performs the opening handshake and returns the raw connection, leaving
+// WebSocket framing to the caller. Libraries that do their own handshake can
+// use PresignURL instead.
+type WebSocketDialer struct {
+	// Service is the signing name of the AWS service, e.g. "iotdevicegateway"
+	Service string
+	// Expires is how long the presigned URL is valid for. Defaults to five minutes.
+	Expires time.Duration
+	// TLSConfig is used for wss:// URLs
+	TLSConfig *tls.Config
+
+	settings       Settings
+	configProvider ConfigProvider
+	presigner      v4.HTTPPresigner
+	clock          Clock
+	fetcher        *credentialsFetcher
+	netDialer      *net.Dialer
+}
+
+// NewWebSocketDialer returns a WebSocketDialer that signs for service using
+// credentials resolved from settings through the SharedConfigProvider.
+func NewWebSocketDialer(settings Settings, service string) *WebSocketDialer {
+	return NewWebSocketDialerWithConfigProvider(settings, service, SharedConfigProvider())
+}
+
+// NewWebSocketDialerWithConfigProvider returns a WebSocketDialer that resolves
+// credentials through the given ConfigProvider.
+func NewWebSocketDialerWithConfigProvider(settings Settings, service string, provider ConfigProvider) *WebSocketDialer {
+	return &WebSocketDialer{
+		Service:        service,
+		Expires:        defaultWebSocketURLExpiry,
+		settings:       settings,
+		configProvider: provider,
+		presigner:      v4.NewSigner(),
+		clock:          systemClock{},
+		fetcher:        credentialsFetcherFor(provider),
+		netDialer:      &net.Dialer{},
+	}
+}
+
+// PresignURL returns rawURL (ws:// or wss://) with SigV4 query authentication added.
+func (d *WebSocketDialer) PresignURL(ctx context.Context, rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", backend.DownstreamError(err)
+	}
+	wsScheme := u.Scheme
+	switch wsScheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	default:
+		return "", backend.DownstreamErrorf("unsupported WebSocket URL scheme %q", wsScheme)
+	}
+
+	cfg, credentials, err := d.fetcher.fetch(ctx, d.configProvider, d.settings)
+	if err != nil {
+		return "", err
+	}
+
+	expires := d.Expires
+	if expires <= 0 {
+		expires = defaultWebSocketURLExpiry
+	}
+	query := u.Query()
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expires.Seconds())))
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	signed, _, err := d.presigner.PresignHTTP(ctx, credentials, req, EmptySha256Hash, d.Service, signingRegion(d.settings, cfg), d.clock.Now().UTC())
+	if err != nil {
+		return "", err
+	}
+	signedURL, err := url.Parse(signed)
+	if err != nil {
+		return "", err
+	}
+	signedURL.Scheme = wsScheme
+	return signedURL.String(), nil
+}
+
+// Dial presigns rawURL and performs the WebSocket opening handshake with the
+// given extra headers. On success the returned connection is positioned at
+// the first WebSocket frame; the handshake response is returned either way
+// when the server answered.
+func (d *WebSocketDialer) Dial(ctx context.Context, rawURL string, header http.Header) (net.Conn, *http.Response, error) {
+	signedURL, err := d.PresignURL(ctx, rawURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	u, err := url.Parse(signedURL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn, err := d.dialNetConn(ctx, u)
+	if err != nil {
+		return nil, nil, backend.DownstreamError(err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	resp, reader, err := webSocketHandshake(conn, u, header)
+	if err != nil {
+		_ = conn.Close()
+		return nil, resp, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return &bufferedConn{Conn: conn, reader: reader}, resp, nil
+}
+
+// dialNetConn connects to the host of u through the same proxies as the HTTP
+// clients built from the settings: the secure socks proxy, then the HTTP proxy
+// of the datasource or of the environment.
+func (d *WebSocketDialer) dialNetConn(ctx context.Context, u *url.URL) (net.Conn, error) {
+	host := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "wss" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+	dial, err := d.dialer()
+	if err != nil {
+		return nil, err
+	}
+	proxyURL, err := d.httpProxyURL(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	if proxyURL == nil {
+		conn, err = dial(ctx, "tcp", host)
+	} else {
+		conn, err = dialThroughHTTPProxy(ctx, dial, proxyURL, host)
+	}
+	if err != nil || u.Scheme != "wss" {
+		return conn, err
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if d.TLSConfig != nil {
+		tlsConfig = d.TLSConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = u.Hostname()
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// dialer returns how to open connections: through the secure socks proxy
+// when the settings enable it, directly otherwise.
+func (d *WebSocketDialer) dialer() (dialFunc, error) {
+	if d.settings.ProxyOptions == nil {
+		return d.netDialer.DialContext, nil
+	}
+	// the proxy client fills in the defaults of the options it is given
+	opts := *d.settings.ProxyOptions
+	socksProxy := proxy.New(&opts)
+	if !socksProxy.SecureSocksProxyEnabled() {
+		return d.netDialer.DialContext, nil
+	}
+	dialer, err := socksProxy.NewSecureSocksProxyContextDialer()
+	if err != nil {
+		return nil, fmt.Errorf("error configuring Secure Socks proxy: %w", err)
+	}
+	contextDialer, ok := dialer.(interface {
+		DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+	})
+	if !ok {
+		return nil, errors.New("unable to cast socks proxy dialer to context proxy dialer")
+	}
+	return contextDialer.DialContext, nil
+}
+
+// httpProxyURL returns the HTTP proxy to reach u through, if any, picked like
+// WithHTTPClientFromAuthSettings does.
+func (d *WebSocketDialer) httpProxyURL(ctx context.Context, u *url.URL) (*url.URL, error) {
+	authSettings, _ := awsds.ReadAuthSettingsFromContext(ctx)
+	if proxySettings := d.settings.PerDatasourceProxySettings; authSettings.PerDatasourceHTTPProxyEnabled && proxySettings != nil {
+		switch proxySettings.ProxyType {
+		case ProxyTypeUrl:
+			return GetProxyUrl(*proxySettings)
+		case ProxyTypeNone:
+			return nil, nil
+		}
+	}
+	httpURL := *u
+	httpURL.Scheme = strings.Replace(u.Scheme, "ws", "http", 1)
+	return http.ProxyFromEnvironment(&http.Request{URL: &httpURL})
+}
+
+// dialThroughHTTPProxy opens a tunnel to addr through the HTTP proxy at
+// proxyURL with a CONNECT request.
+func dialThroughHTTPProxy(ctx context.Context, dial dialFunc, proxyURL *url.URL, addr string) (net.Conn, error) {
+	proxyHost := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyHost = net.JoinHostPort(proxyURL.Hostname(), "80")
+	}
+	conn, err := dial(ctx, "tcp", proxyHost)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password)))
+	}
+	if err := req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	// the proxy sends nothing after its response until the tunnel is used
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("proxy refused the connection to %s: %s", addr, resp.Status)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func webSocketHandshake(conn net.Conn, u *url.URL, header http.Header) (*http.Response, *bufio.Reader, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        u,
+		Host:       u.Host,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(conn); err != nil {
+		return nil, nil, backend.DownstreamError(err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, nil, backend.DownstreamError(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return resp, nil, backend.DownstreamErrorf("WebSocket handshake failed with status %s", resp.Status)
+	}
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+		return resp, nil, backend.DownstreamErrorf("WebSocket handshake failed: unexpected Upgrade header %q", resp.Header.Get("Upgrade"))
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(key) {
+		return resp, nil, fmt.Errorf("WebSocket handshake failed: invalid Sec-WebSocket-Accept header")
+	}
+	return resp, reader, nil
+}
+
+// webSocketAccept computes the Sec-WebSocket-Accept value expected for key.
+func webSocketAccept(key string) string {
+	h := sha1.New() // #nosec G401 -- required by the WebSocket handshake (RFC 6455)
+	h.Write([]byte(key + webSocketAcceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// bufferedConn reads through the reader used for the handshake, which may
+// already hold the first frames sent by the server.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
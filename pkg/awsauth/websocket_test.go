@@ -0,0 +1,220 @@
+package awsauth
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/proxy"
+	"github.com/grafana/grafana-plugin-sdk-go/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newEchoWebSocketServer accepts presigned WebSocket upgrades and echoes back
+// whatever the client sends once the handshake is done.
+func newEchoWebSocketServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("X-Amz-Algorithm") != "AWS4-HMAC-SHA256" || query.Get("X-Amz-Signature") == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+		_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: websocket\r\n" +
+			"Connection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + webSocketAccept(r.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n")
+		_ = rw.Flush()
+		_, _ = io.Copy(conn, rw.Reader)
+	}))
+}
+
+func TestWebSocketDialer_PresignURL(t *testing.T) {
+	d := NewWebSocketDialerWithConfigProvider(Settings{Region: "us-east-1"}, "iotdevicegateway", NewFakeConfigProvider(false))
+	d.clock = staticClock{OnceUponATime}
+
+	signed, err := d.PresignURL(context.Background(), "wss://example.iot.us-east-1.amazonaws.com/mqtt?client=grafana")
+	require.NoError(t, err)
+
+	u, err := url.Parse(signed)
+	require.NoError(t, err)
+	assert.Equal(t, "wss", u.Scheme)
+	query := u.Query()
+	assert.Equal(t, "grafana", query.Get("client"))
+	assert.Equal(t, "AWS4-HMAC-SHA256", query.Get("X-Amz-Algorithm"))
+	assert.Equal(t, "hello/20090213/us-east-1/iotdevicegateway/aws4_request", query.Get("X-Amz-Credential"))
+	assert.Equal(t, "300", query.Get("X-Amz-Expires"))
+	assert.Equal(t, "(no)", query.Get("X-Amz-Security-Token"))
+	assert.NotEmpty(t, query.Get("X-Amz-Signature"))
+
+	_, err = d.PresignURL(context.Background(), "https://example.iot.us-east-1.amazonaws.com/mqtt")
+	assert.Error(t, err)
+}
+
+func TestWebSocketDialer_Dial(t *testing.T) {
+	srv := newEchoWebSocketServer(t)
+	defer srv.Close()
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/realtime"
+
+	t.Run("handshake succeeds against a local server", func(t *testing.T) {
+		d := NewWebSocketDialerWithConfigProvider(Settings{Region: "us-east-1"}, "appsync", NewFakeConfigProvider(false))
+		conn, resp, err := d.Dial(context.Background(), wsURL, http.Header{"Sec-Websocket-Protocol": []string{"graphql-ws"}})
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+		assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+		_, err = conn.Write([]byte("ping"))
+		require.NoError(t, err)
+		echoed := make([]byte, 4)
+		_, err = io.ReadFull(conn, echoed)
+		require.NoError(t, err)
+		assert.Equal(t, "ping", string(echoed))
+	})
+
+	t.Run("credential failures are downstream and never dial", func(t *testing.T) {
+		d := NewWebSocketDialerWithConfigProvider(Settings{Region: "us-east-1"}, "appsync", NewFakeConfigProvider(true))
+		_, resp, err := d.Dial(context.Background(), wsURL, nil)
+		require.Error(t, err)
+		assert.Nil(t, resp)
+	})
+
+	t.Run("rejected upgrade returns the response", func(t *testing.T) {
+		rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+		}))
+		defer rejecting.Close()
+
+		d := NewWebSocketDialerWithConfigProvider(Settings{Region: "us-east-1"}, "appsync", NewFakeConfigProvider(false))
+		_, resp, err := d.Dial(context.Background(), "ws"+strings.TrimPrefix(rejecting.URL, "http"), nil)
+		require.Error(t, err)
+		require.NotNil(t, resp)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
+}
+
+// newConnectProxy tunnels CONNECT requests carrying the expected credentials.
+// The returned function lists the addresses asked for.
+func newConnectProxy(t *testing.T, user, password string) (*url.URL, func() []string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+	var (
+		mu        sync.Mutex
+		requested []string
+	)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				mu.Lock()
+				requested = append(requested, req.Host)
+				mu.Unlock()
+				expected := "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+				if req.Header.Get("Proxy-Authorization") != expected {
+					_, _ = conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+					return
+				}
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					_, _ = conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+					return
+				}
+				defer func() { _ = target.Close() }()
+				_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+				go func() { _, _ = io.Copy(target, conn) }()
+				_, _ = io.Copy(conn, target)
+			}()
+		}
+	}()
+	return &url.URL{Scheme: "http", Host: listener.Addr().String()}, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(requested)
+	}
+}
+
+func TestWebSocketDialer_Dial_proxies(t *testing.T) {
+	srv := newEchoWebSocketServer(t)
+	defer srv.Close()
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/realtime"
+	proxyURL, requested := newConnectProxy(t, "user", "pass")
+	ctx := config.WithGrafanaConfig(context.Background(), config.NewGrafanaCfg(map[string]string{
+		awsds.PerDatasourceHTTPProxyEnabledEnvVarKeyName: "true",
+	}))
+
+	t.Run("through the proxy of the datasource", func(t *testing.T) {
+		settings := Settings{Region: "us-east-1", PerDatasourceProxySettings: &PerDatasourceProxySettings{
+			ProxyType: ProxyTypeUrl, ProxyUrl: proxyURL.String(), ProxyUsername: "user", ProxyPassword: "pass",
+		}}
+		d := NewWebSocketDialerWithConfigProvider(settings, "appsync", NewFakeConfigProvider(false))
+		conn, _, err := d.Dial(ctx, wsURL, nil)
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+		assert.Equal(t, []string{strings.TrimPrefix(srv.URL, "http://")}, requested())
+
+		_, err = conn.Write([]byte("ping"))
+		require.NoError(t, err)
+		echoed := make([]byte, 4)
+		_, err = io.ReadFull(conn, echoed)
+		require.NoError(t, err)
+		assert.Equal(t, "ping", string(echoed))
+	})
+
+	t.Run("proxy refusing the tunnel", func(t *testing.T) {
+		settings := Settings{Region: "us-east-1", PerDatasourceProxySettings: &PerDatasourceProxySettings{
+			ProxyType: ProxyTypeUrl, ProxyUrl: proxyURL.String(), ProxyUsername: "user", ProxyPassword: "wrong",
+		}}
+		d := NewWebSocketDialerWithConfigProvider(settings, "appsync", NewFakeConfigProvider(false))
+		_, _, err := d.Dial(ctx, wsURL, nil)
+		assert.ErrorContains(t, err, "407")
+	})
+
+	t.Run("through the secure socks proxy", func(t *testing.T) {
+		socks, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer func() { _ = socks.Close() }()
+		accepted := make(chan struct{}, 1)
+		go func() {
+			conn, err := socks.Accept()
+			if err == nil {
+				accepted <- struct{}{}
+				_ = conn.Close()
+			}
+		}()
+
+		settings := Settings{Region: "us-east-1", ProxyOptions: &proxy.Options{
+			Enabled:   true,
+			ClientCfg: &proxy.ClientCfg{ProxyAddress: socks.Addr().String(), AllowInsecure: true},
+		}}
+		d := NewWebSocketDialerWithConfigProvider(settings, "appsync", NewFakeConfigProvider(false))
+		_, _, err = d.Dial(ctx, wsURL, nil)
+		require.Error(t, err, "the socks proxy closed the connection")
+		select {
+		case <-accepted:
+		case <-time.After(time.Second):
+			t.Fatal("the connection should go through the secure socks proxy")
+		}
+	})
+}
@@ -0,0 +1,144 @@
+package awsds
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/sqlds/v5"
+)
+
+const (
+	// defaultAlertMaxPollInterval is the longest wait between two polls of a
+	// query run for an alert when AlertMaxPollInterval is not set
+	defaultAlertMaxPollInterval = 5 * time.Second
+
+	// initialAlertPollInterval is the wait before the first poll of a query
+	// run for an alert. It doubles after each poll.
+	initialAlertPollInterval = 500 * time.Millisecond
+)
+
+// ErrQueryStillRunning is returned for queries of alerting and expression
+// requests that did not finish within AlertQueryTimeout.
+var ErrQueryStillRunning = errors.New("query is still running")
+
+// alertQueryData runs the queries of an alerting or expression request through
+// the async flow, polling each of them on the server until it finishes.
+func (ds *AsyncAWSDatasource) alertQueryData(ctx context.Context, req *backend.QueryDataRequest) *backend.QueryDataResponse {
+	var (
+		response = sqlds.NewResponse(backend.NewQueryDataResponse())
+		wg       = sync.WaitGroup{}
+	)
+	for _, q := range req.Queries {
+		wg.Add(1)
+		go func(query backend.DataQuery) {
+			defer wg.Done()
+			response.Set(query.RefID, ds.executeAlertQuery(ctx, query, req.PluginContext.DataSourceInstanceSettings.UID))
+		}(q)
+	}
+	wg.Wait()
+	return response.Response()
+}
+
+// executeAlertQuery starts query and polls it until it finishes, fails or
+// AlertQueryTimeout elapses, in which case it is cancelled.
+func (ds *AsyncAWSDatasource) executeAlertQuery(ctx context.Context, query backend.DataQuery, datasourceUID string) backend.DataResponse {
+	timeoutCtx, cancel := context.WithTimeout(ctx, ds.AlertQueryTimeout)
+	defer cancel()
+
+	res := ds.asyncQueryData(timeoutCtx, query, datasourceUID)
+	meta, ok := asyncResponseMeta(res)
+	if res.Error != nil || !ok {
+		return res
+	}
+	if meta.Status == QueryFinished.String() {
+		// served from the result cache
+		return res
+	}
+	pollQuery, err := alertPollQuery(query, meta.QueryID)
+	if err != nil {
+		return backend.ErrorResponseWithErrorSource(err)
+	}
+
+	maxInterval := ds.AlertMaxPollInterval
+	if maxInterval <= 0 {
+		maxInterval = defaultAlertMaxPollInterval
+	}
+	interval := min(initialAlertPollInterval, maxInterval)
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timeoutCtx.Done():
+			return ds.alertQueryNotFinished(ctx, datasourceUID, meta.QueryID)
+		case <-timer.C:
+		}
+
+		res = ds.asyncQueryData(timeoutCtx, pollQuery, datasourceUID)
+		if res.Error != nil {
+			if timeoutCtx.Err() != nil {
+				return ds.alertQueryNotFinished(ctx, datasourceUID, meta.QueryID)
+			}
+			return res
+		}
+		meta, ok = asyncResponseMeta(res)
+		if !ok {
+			return res
+		}
+		switch meta.Status {
+		case QueryFinished.String():
+			return res
+		case QueryFailed.String(), QueryCanceled.String(), queryStatusTimeout:
+			return backend.ErrorResponseWithErrorSource(backend.DownstreamErrorf("query %s %s", meta.QueryID, meta.Status))
+		}
+
+		interval = min(interval*2, maxInterval)
+		timer.Reset(interval)
+	}
+}
+
+// alertQueryNotFinished cancels queryID, which did not finish in time, and
+// returns the response reporting it. When the request itself was cancelled
+// the query is left to the other requests that may share it.
+func (ds *AsyncAWSDatasource) alertQueryNotFinished(ctx context.Context, datasourceUID string, queryID string) backend.DataResponse {
+	if err := ctx.Err(); err != nil {
+		return backend.ErrorResponseWithErrorSource(err)
+	}
+	if err := ds.CancelAsyncQuery(ctx, datasourceUID, queryID); err != nil {
+		backend.Logger.FromContext(ctx).Warn("Could not cancel alert query that did not finish in time", "queryID", queryID, "error", err)
+	}
+	res := backend.ErrorResponseWithErrorSource(backend.DownstreamError(
+		fmt.Errorf("%w: query %s did not finish within %s", ErrQueryStillRunning, queryID, ds.AlertQueryTimeout),
+	))
+	res.Status = backend.StatusTimeout
+	return res
+}
+
+func asyncResponseMeta(res backend.DataResponse) (queryMeta, bool) {
+	if len(res.Frames) == 0 || res.Frames[0].Meta == nil {
+		return queryMeta{}, false
+	}
+	meta, ok := res.Frames[0].Meta.Custom.(queryMeta)
+	return meta, ok
+}
+
+// alertPollQuery returns query with its JSON model pointing to queryID, as
+// the frontend does when polling a query. Alerts need all the results in the
+// response, so they are neither paged nor streamed.
+func alertPollQuery(query backend.DataQuery, queryID string) (backend.DataQuery, error) {
+	model := map[string]interface{}{}
+	if err := json.Unmarshal(query.JSON, &model); err != nil {
+		return query, err
+	}
+	model["queryID"] = queryID
+	model["pageSize"] = -1
+	delete(model, "pageToken")
+	delete(model, "streamResults")
+	var err error
+	query.JSON, err = json.Marshal(model)
+	return query, err
+}
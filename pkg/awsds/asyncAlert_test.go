@@ -0,0 +1,144 @@
+package awsds
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// eventuallyFinishedDB is a query that finishes after it was polled a number
+// of times.
+type eventuallyFinishedDB struct {
+	pagedDB
+	mu           sync.Mutex
+	runningPolls int
+	polls        int
+	pages        int
+}
+
+func (db *eventuallyFinishedDB) StartQuery(context.Context, string, ...interface{}) (string, error) {
+	return "qid", nil
+}
+
+func (db *eventuallyFinishedDB) QueryStatus(context.Context, string) (QueryStatus, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.polls++
+	if db.polls <= db.runningPolls {
+		return QueryRunning, nil
+	}
+	return QueryFinished, nil
+}
+
+func (db *eventuallyFinishedDB) GetRowsPage(ctx context.Context, queryID string, pageToken string, pageSize int) (driver.Rows, string, error) {
+	db.mu.Lock()
+	db.pages++
+	db.mu.Unlock()
+	return db.pagedDB.GetRowsPage(ctx, queryID, pageToken, pageSize)
+}
+
+func Test_QueryData_alertQueriesArePolledOnTheServer(t *testing.T) {
+	settings := backend.DataSourceInstanceSettings{UID: "uid1"}
+	query := backend.DataQuery{RefID: "A", JSON: []byte(`{"rawSql":"SELECT n"}`)}
+	newRequest := func(header string) *backend.QueryDataRequest {
+		return &backend.QueryDataRequest{
+			Headers:       map[string]string{header: "true"},
+			PluginContext: backend.PluginContext{DataSourceInstanceSettings: &settings},
+			Queries:       []backend.DataQuery{query},
+		}
+	}
+	newDatasource := func(db AsyncDB) *AsyncAWSDatasource {
+		ds := NewAsyncAWSDatasource(fakeDriver{})
+		ds.AlertQueryTimeout = time.Second
+		ds.AlertMaxPollInterval = time.Millisecond
+		ds.PageSize = 100
+		ds.sqldsQueryDataHandler = func(context.Context, *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+			t.Fatal("alert queries should not run through the synchronous flow")
+			return nil, nil
+		}
+		ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, settings})
+		return ds
+	}
+
+	for _, header := range []string{fromAlertHeader, fromExpressionHeader} {
+		t.Run("fetches all the results of a query once it finished for "+header, func(t *testing.T) {
+			db := &eventuallyFinishedDB{pagedDB: pagedDB{values: pagedValues(3)}, runningPolls: 2}
+			ds := newDatasource(db)
+
+			_, err := ds.QueryData(context.Background(), newRequest(header))
+			require.NoError(t, err)
+			assert.Equal(t, 3, db.polls)
+			assert.Zero(t, db.pages, "alert results should not be paged")
+		})
+	}
+
+	t.Run("cancels a query still running after the timeout", func(t *testing.T) {
+		db := new(MockDB)
+		db.On("GetQueryID", mock.Anything, "SELECT n", mock.Anything).Return(false, "", nil)
+		db.On("StartQuery", mock.Anything, "SELECT n", mock.Anything).Return("qid", nil)
+		db.On("QueryStatus", mock.Anything, "qid").Return(QueryRunning, nil)
+		db.On("CancelQuery", mock.Anything, "qid").Return(nil)
+		ds := newDatasource(db)
+		ds.AlertQueryTimeout = 20 * time.Millisecond
+
+		res, err := ds.QueryData(context.Background(), newRequest(fromAlertHeader))
+		require.NoError(t, err)
+		r := res.Responses["A"]
+		require.Error(t, r.Error)
+		assert.True(t, errors.Is(r.Error, ErrQueryStillRunning))
+		assert.Equal(t, backend.StatusTimeout, r.Status)
+		assert.Equal(t, backend.ErrorSourceDownstream, r.ErrorSource)
+		db.AssertCalled(t, "CancelQuery", mock.Anything, "qid")
+	})
+
+	t.Run("fails when the query fails", func(t *testing.T) {
+		db := new(MockDB)
+		db.On("GetQueryID", mock.Anything, "SELECT n", mock.Anything).Return(false, "", nil)
+		db.On("StartQuery", mock.Anything, "SELECT n", mock.Anything).Return("qid", nil)
+		db.On("QueryStatus", mock.Anything, "qid").Return(QueryFailed, nil)
+		ds := newDatasource(db)
+
+		res, err := ds.QueryData(context.Background(), newRequest(fromAlertHeader))
+		require.NoError(t, err)
+		r := res.Responses["A"]
+		require.Error(t, r.Error)
+		assert.False(t, errors.Is(r.Error, ErrQueryStillRunning))
+		assert.Equal(t, backend.ErrorSourceDownstream, r.ErrorSource)
+		db.AssertNotCalled(t, "CancelQuery", mock.Anything, mock.Anything)
+	})
+
+	t.Run("uses the synchronous flow when not enabled", func(t *testing.T) {
+		ds := newDatasource(fakeAsyncDB{})
+		ds.AlertQueryTimeout = 0
+		syncCalled := false
+		ds.sqldsQueryDataHandler = func(context.Context, *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+			syncCalled = true
+			return backend.NewQueryDataResponse(), nil
+		}
+
+		_, err := ds.QueryData(context.Background(), newRequest(fromAlertHeader))
+		require.NoError(t, err)
+		assert.True(t, syncCalled)
+	})
+}
+
+func Test_alertPollQuery(t *testing.T) {
+	q, err := alertPollQuery(backend.DataQuery{RefID: "A", JSON: []byte(`{"rawSql":"SELECT 1","queryID":"old","pageSize":10,"pageToken":"2","streamResults":true}`)}, "qid")
+	require.NoError(t, err)
+	parsed, err := GetQuery(q)
+	require.NoError(t, err)
+	assert.Equal(t, "qid", parsed.QueryID)
+	assert.Equal(t, "SELECT 1", parsed.RawSQL)
+	assert.Equal(t, "A", parsed.RefID)
+	assert.Equal(t, -1, parsed.PageSize)
+	assert.Empty(t, parsed.PageToken)
+	assert.False(t, parsed.StreamResults)
+}
@@ -0,0 +1,225 @@
+package awsds
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// auditStatusError is the status of the audit events of requests that failed
+// without a query status, e.g. because the query could not be started.
+const auditStatusError = "error"
+
+// AuditEvent describes a step in the life of an async query: it was started,
+// changed status or failed.
+type AuditEvent struct {
+	Time time.Time `json:"time"`
+	// User is the login of the user who ran the query, if known
+	User          string `json:"user,omitempty"`
+	DatasourceUID string `json:"datasourceUID"`
+	DashboardUID  string `json:"dashboardUID,omitempty"`
+	PanelID       string `json:"panelID,omitempty"`
+	RefID         string `json:"refID"`
+	RawSQL        string `json:"rawSql,omitempty"`
+	QueryID       string `json:"queryID,omitempty"`
+	Status        string `json:"status"`
+	CacheHit      bool   `json:"cacheHit,omitempty"`
+	// Duration is how long the query has been running, as seen by the plugin
+	Duration time.Duration `json:"-"`
+	Error    string        `json:"error,omitempty"`
+	// ErrorCause is "user" or "internal" for query execution errors,
+	// "downstream" for other errors of the database and "plugin" otherwise
+	ErrorCause string `json:"errorCause,omitempty"`
+}
+
+// MarshalJSON encodes the duration of e in milliseconds.
+func (e AuditEvent) MarshalJSON() ([]byte, error) {
+	type event AuditEvent
+	return json.Marshal(struct {
+		event
+		DurationMs int64 `json:"durationMs"`
+	}{event(e), e.Duration.Milliseconds()})
+}
+
+// AuditSink receives the audit events of async queries. Emit is called while
+// the request is served, so it should not block.
+type AuditSink interface {
+	Emit(ctx context.Context, event AuditEvent)
+}
+
+// LoggerAuditSink writes each audit event as a line of JSON to a plugin
+// logger.
+type LoggerAuditSink struct {
+	Logger log.Logger
+}
+
+// NewLoggerAuditSink returns a sink writing to logger, or to the plugin logger
+// when logger is nil.
+func NewLoggerAuditSink(logger log.Logger) *LoggerAuditSink {
+	if logger == nil {
+		logger = backend.Logger
+	}
+	return &LoggerAuditSink{Logger: logger}
+}
+
+func (s *LoggerAuditSink) Emit(_ context.Context, event AuditEvent) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		s.Logger.Warn("Could not encode audit event", "error", err)
+		return
+	}
+	s.Logger.Info(string(line))
+}
+
+type auditedQuery struct {
+	started time.Time
+	status  string
+}
+
+// auditedQueries remembers the last status reported for each running query,
+// so each status is reported once however often the query is polled, for at
+// most maxSharedQueryAge.
+type auditedQueries struct {
+	mu      sync.Mutex
+	queries map[string]*auditedQuery
+}
+
+// transition records that queryID has status as of now. It returns how long
+// the query has been running and whether the status should be reported.
+func (a *auditedQueries) transition(queryID string, status string, now time.Time) (time.Duration, bool) {
+	if queryID == "" {
+		return 0, true
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.queries == nil {
+		a.queries = map[string]*auditedQuery{}
+	}
+	q, ok := a.queries[queryID]
+	if !ok {
+		for id, other := range a.queries {
+			if now.Sub(other.started) > maxSharedQueryAge {
+				delete(a.queries, id)
+			}
+		}
+		q = &auditedQuery{started: now}
+		a.queries[queryID] = q
+	} else if status == q.status && status != "started" {
+		// every request starting the query is reported, shared or not
+		return now.Sub(q.started), false
+	}
+	q.status = status
+	if isEndStatus(status) {
+		delete(a.queries, queryID)
+	}
+	return now.Sub(q.started), true
+}
+
+// forget stops tracking queryID, which will not be polled anymore.
+func (a *auditedQueries) forget(queryID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.queries, queryID)
+}
+
+func isEndStatus(status string) bool {
+	switch status {
+	case QueryFinished.String(), QueryFailed.String(), QueryCanceled.String(), queryStatusTimeout, auditStatusError:
+		return true
+	}
+	return false
+}
+
+type auditRequestKey struct{}
+
+// auditRequest holds what identifies who sent a request and from where.
+type auditRequest struct {
+	user         string
+	dashboardUID string
+	panelID      string
+}
+
+// withAuditRequest stores in ctx who sent req and from which dashboard panel.
+func withAuditRequest(ctx context.Context, req *backend.QueryDataRequest) context.Context {
+	r := auditRequest{
+		dashboardUID: req.GetHTTPHeader("X-Dashboard-Uid"),
+		panelID:      req.GetHTTPHeader("X-Panel-Id"),
+	}
+	if req.PluginContext.User != nil {
+		r.user = req.PluginContext.User.Login
+	}
+	return context.WithValue(ctx, auditRequestKey{}, r)
+}
+
+func auditRequestFromContext(ctx context.Context) auditRequest {
+	if r, ok := ctx.Value(auditRequestKey{}).(auditRequest); ok {
+		return r
+	}
+	if user := backend.UserFromContext(ctx); user != nil {
+		return auditRequest{user: user.Login}
+	}
+	return auditRequest{}
+}
+
+// auditQuery reports to the AuditSink what happened to query during a
+// request, given the frames or error returned for it.
+func (ds *AsyncAWSDatasource) auditQuery(ctx context.Context, query backend.DataQuery, datasourceUID string, frames data.Frames, err error) {
+	if ds.AuditSink == nil {
+		return
+	}
+	request := auditRequestFromContext(ctx)
+	event := AuditEvent{
+		Time:          time.Now(),
+		User:          request.user,
+		DatasourceUID: datasourceUID,
+		DashboardUID:  request.dashboardUID,
+		PanelID:       request.panelID,
+		RefID:         query.RefID,
+	}
+	if q, qErr := GetQuery(query); qErr == nil {
+		event.RawSQL, event.QueryID = q.RawSQL, q.QueryID
+	}
+	if len(frames) > 0 && frames[0].Meta != nil {
+		if frames[0].Meta.ExecutedQueryString != "" {
+			event.RawSQL = frames[0].Meta.ExecutedQueryString
+		}
+		if meta, ok := frames[0].Meta.Custom.(queryMeta); ok {
+			event.QueryID, event.Status, event.CacheHit = meta.QueryID, meta.Status, meta.CacheHit
+		}
+	}
+	if err != nil {
+		event.Status = auditStatusError
+		event.Error = err.Error()
+		event.ErrorCause = errorCause(err)
+	}
+	if event.Status == "" {
+		return
+	}
+
+	duration, report := ds.auditedQueries.transition(event.QueryID, event.Status, event.Time)
+	if !report {
+		return
+	}
+	event.Duration = duration
+	ds.AuditSink.Emit(ctx, event)
+}
+
+func errorCause(err error) string {
+	var qeError *QueryExecutionError
+	switch {
+	case errors.As(err, &qeError) && qeError.Cause == QueryFailedUser:
+		return "user"
+	case errors.As(err, &qeError):
+		return "internal"
+	case backend.IsDownstreamError(err):
+		return "downstream"
+	default:
+		return "plugin"
+	}
+}
@@ -0,0 +1,166 @@
+package awsds
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingAuditSink struct {
+	mu     sync.Mutex
+	events []AuditEvent
+}
+
+func (s *recordingAuditSink) Emit(_ context.Context, event AuditEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+}
+
+func (s *recordingAuditSink) statuses() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var statuses []string
+	for _, e := range s.events {
+		statuses = append(statuses, e.Status)
+	}
+	return statuses
+}
+
+func TestAsyncAWSDatasource_QueryData_audit(t *testing.T) {
+	settings := backend.DataSourceInstanceSettings{UID: "uid1"}
+	db := new(MockDB)
+	db.On("GetQueryID", mock.Anything, "SELECT 1", mock.Anything).Return(false, "", nil)
+	db.On("StartQuery", mock.Anything, "SELECT 1", mock.Anything).Return("qid", nil)
+	db.On("QueryStatus", mock.Anything, "qid").Return(QueryRunning, nil).Twice()
+	db.On("QueryStatus", mock.Anything, "qid").Return(QueryFailed, &QueryExecutionError{Err: errors.New("syntax error"), Cause: QueryFailedUser}).Once()
+	sink := &recordingAuditSink{}
+	ds := NewAsyncAWSDatasource(fakeDriver{})
+	ds.AuditSink = sink
+	ds.Retry = RetryPolicy{MaxAttempts: 1}
+	ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, settings})
+
+	request := func(queryJSON string) *backend.QueryDataRequest {
+		return &backend.QueryDataRequest{
+			Headers: map[string]string{"http_X-Dashboard-Uid": "dash1", "http_X-Panel-Id": "2"},
+			PluginContext: backend.PluginContext{
+				DataSourceInstanceSettings: &settings,
+				User:                       &backend.User{Login: "alice"},
+			},
+			Queries: []backend.DataQuery{{RefID: "A", JSON: []byte(queryJSON)}},
+		}
+	}
+	for _, queryJSON := range []string{
+		`{"rawSql":"SELECT 1","meta":{"queryFlow":"async"}}`,
+		`{"rawSql":"SELECT 1","queryID":"qid","meta":{"queryFlow":"async"}}`,
+		`{"rawSql":"SELECT 1","queryID":"qid","meta":{"queryFlow":"async"}}`,
+		`{"rawSql":"SELECT 1","queryID":"qid","meta":{"queryFlow":"async"}}`,
+	} {
+		_, err := ds.QueryData(context.Background(), request(queryJSON))
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, []string{"started", "running", "error"}, sink.statuses(), "each status is reported once")
+	started, failed := sink.events[0], sink.events[2]
+	assert.Equal(t, "alice", started.User)
+	assert.Equal(t, "uid1", started.DatasourceUID)
+	assert.Equal(t, "dash1", started.DashboardUID)
+	assert.Equal(t, "2", started.PanelID)
+	assert.Equal(t, "A", started.RefID)
+	assert.Equal(t, "SELECT 1", started.RawSQL)
+	assert.Equal(t, "qid", started.QueryID)
+	assert.Equal(t, "qid", failed.QueryID)
+	assert.Equal(t, "syntax error", failed.Error)
+	assert.Equal(t, "user", failed.ErrorCause)
+	assert.GreaterOrEqual(t, failed.Duration, time.Duration(0))
+	ds.auditedQueries.mu.Lock()
+	assert.Empty(t, ds.auditedQueries.queries, "ended queries are not tracked anymore")
+	ds.auditedQueries.mu.Unlock()
+}
+
+func Test_auditedQueries_transition(t *testing.T) {
+	var a auditedQueries
+	now := time.Now()
+
+	_, report := a.transition("qid", "started", now)
+	assert.True(t, report)
+	_, report = a.transition("qid", "started", now.Add(time.Second))
+	assert.True(t, report, "every request starting a query is reported")
+	_, report = a.transition("qid", "running", now.Add(2*time.Second))
+	assert.True(t, report)
+	_, report = a.transition("qid", "running", now.Add(3*time.Second))
+	assert.False(t, report)
+	duration, report := a.transition("qid", "finished", now.Add(4*time.Second))
+	assert.True(t, report)
+	assert.Equal(t, 4*time.Second, duration)
+	assert.Empty(t, a.queries)
+
+	_, report = a.transition("", "error", now)
+	assert.True(t, report, "errors before a query is started are reported")
+	assert.Empty(t, a.queries)
+}
+
+func Test_auditedQueries_expire(t *testing.T) {
+	var a auditedQueries
+	now := time.Now()
+	a.transition("abandoned", "started", now)
+	a.transition("abandoned", "running", now.Add(time.Minute))
+
+	a.transition("qid", "started", now.Add(maxSharedQueryAge+time.Second))
+	assert.NotContains(t, a.queries, "abandoned", "queries never polled to completion are forgotten")
+	assert.Contains(t, a.queries, "qid")
+}
+
+func Test_errorCause(t *testing.T) {
+	assert.Equal(t, "user", errorCause(&QueryExecutionError{Cause: QueryFailedUser}))
+	assert.Equal(t, "internal", errorCause(&QueryExecutionError{Cause: QueryFailedInternal}))
+	assert.Equal(t, "downstream", errorCause(backend.DownstreamError(errors.New("throttled"))))
+	assert.Equal(t, "plugin", errorCause(errors.New("bug")))
+}
+
+type lineLogger struct {
+	log.Logger
+	lines []string
+}
+
+func (l *lineLogger) Info(msg string, _ ...interface{}) { l.lines = append(l.lines, msg) }
+
+func TestLoggerAuditSink(t *testing.T) {
+	logger := &lineLogger{Logger: log.NewNullLogger()}
+	sink := NewLoggerAuditSink(logger)
+	event := AuditEvent{
+		Time:          time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		User:          "alice",
+		DatasourceUID: "uid1",
+		RefID:         "A",
+		RawSQL:        "SELECT 1",
+		QueryID:       "qid",
+		Status:        "finished",
+		Duration:      1500 * time.Millisecond,
+	}
+
+	sink.Emit(context.Background(), event)
+
+	require.Len(t, logger.lines, 1)
+	var line map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(logger.lines[0]), &line))
+	assert.Equal(t, map[string]interface{}{
+		"time":          "2024-01-02T03:04:05Z",
+		"user":          "alice",
+		"datasourceUID": "uid1",
+		"refID":         "A",
+		"rawSql":        "SELECT 1",
+		"queryID":       "qid",
+		"status":        "finished",
+		"durationMs":    float64(1500),
+	}, line)
+}
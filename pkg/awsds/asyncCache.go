@@ -0,0 +1,352 @@
+package awsds
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-aws-sdk/pkg/common"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+)
+
+// ResultCacheStorage stores serialized query results by key. Implementations
+// bound their own size and must be safe for concurrent use.
+type ResultCacheStorage interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte) error
+	Delete(key string)
+}
+
+// ResultCache caches the frames of finished async queries so dashboards that
+// are loaded again do not re-run the same query. Entries are keyed by
+// datasource UID, connection args, interpolated SQL, time range and everything
+// shaping the frames: format, fill mode and row limit.
+type ResultCache struct {
+	// TTL is how long a result is served from the cache
+	TTL time.Duration
+
+	storage ResultCacheStorage
+	now     func() time.Time
+}
+
+// NewResultCache returns a ResultCache that keeps results in storage for ttl.
+func NewResultCache(storage ResultCacheStorage, ttl time.Duration) *ResultCache {
+	return &ResultCache{
+		TTL:     ttl,
+		storage: storage,
+		now:     time.Now,
+	}
+}
+
+type resultCacheKey struct {
+	DatasourceUID  string `json:"datasourceUID"`
+	ConnectionArgs string `json:"connectionArgs,omitempty"`
+	RawSQL         string `json:"rawSql"`
+	From           int64  `json:"from"`
+	To             int64  `json:"to"`
+	// the frames are cached once converted, so they depend on these too
+	Format   sqlutil.FormatQueryOption `json:"format"`
+	FillMode *data.FillMissing         `json:"fillMode,omitempty"`
+	RowLimit int64                     `json:"rowLimit"`
+}
+
+// resultCacheKeyFor returns the cache key of the interpolated query q, whose
+// frames are filled with fillMode and hold up to rowLimit rows.
+func resultCacheKeyFor(datasourceUID string, q *AsyncQuery, fillMode *data.FillMissing, rowLimit int64) string {
+	key, _ := json.Marshal(resultCacheKey{
+		DatasourceUID:  datasourceUID,
+		ConnectionArgs: common.JSONKey(q.ConnectionArgs),
+		RawSQL:         q.RawSQL,
+		From:           q.TimeRange.From.UnixMilli(),
+		To:             q.TimeRange.To.UnixMilli(),
+		Format:         q.Format,
+		FillMode:       fillMode,
+		RowLimit:       rowLimit,
+	})
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:])
+}
+
+// get returns the cached frames for key, if any and not expired.
+func (c *ResultCache) get(key string) (data.Frames, bool) {
+	value, ok := c.storage.Get(key)
+	if !ok {
+		return nil, false
+	}
+	expires, frames, err := decodeCachedResult(value)
+	if err != nil || !c.now().Before(expires) {
+		c.storage.Delete(key)
+		return nil, false
+	}
+	return frames, true
+}
+
+// set stores frames under key until the TTL elapses.
+func (c *ResultCache) set(key string, frames data.Frames) error {
+	if c.TTL <= 0 {
+		return nil
+	}
+	value, err := encodeCachedResult(c.now().Add(c.TTL), frames)
+	if err != nil {
+		return err
+	}
+	return c.storage.Set(key, value)
+}
+
+// encodeCachedResult serializes the expiry time followed by each frame in
+// Arrow format, each prefixed with its length.
+func encodeCachedResult(expires time.Time, frames data.Frames) ([]byte, error) {
+	encoded, err := frames.MarshalArrow()
+	if err != nil {
+		return nil, err
+	}
+	value := binary.BigEndian.AppendUint64(nil, uint64(expires.UnixNano()))
+	value = binary.BigEndian.AppendUint32(value, uint32(len(encoded)))
+	for _, frame := range encoded {
+		value = binary.BigEndian.AppendUint32(value, uint32(len(frame)))
+		value = append(value, frame...)
+	}
+	return value, nil
+}
+
+var errCorruptCachedResult = errors.New("corrupt cached result")
+
+func decodeCachedResult(value []byte) (time.Time, data.Frames, error) {
+	if len(value) < 12 {
+		return time.Time{}, nil, errCorruptCachedResult
+	}
+	expires := time.Unix(0, int64(binary.BigEndian.Uint64(value)))
+	count := binary.BigEndian.Uint32(value[8:])
+	value = value[12:]
+	encoded := make([][]byte, 0, count)
+	for range count {
+		if len(value) < 4 {
+			return time.Time{}, nil, errCorruptCachedResult
+		}
+		size := binary.BigEndian.Uint32(value)
+		value = value[4:]
+		if uint32(len(value)) < size {
+			return time.Time{}, nil, errCorruptCachedResult
+		}
+		encoded = append(encoded, value[:size])
+		value = value[size:]
+	}
+	frames, err := data.UnmarshalArrowFrames(encoded)
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	return expires, frames, nil
+}
+
+// lruIndex tracks the size and recency of cache entries and picks the least
+// recently used ones to evict when the total size goes over maxBytes.
+type lruIndex struct {
+	maxBytes int64
+	size     int64
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+type lruEntry struct {
+	key  string
+	size int64
+}
+
+func newLRUIndex(maxBytes int64) *lruIndex {
+	return &lruIndex{maxBytes: maxBytes, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+func (l *lruIndex) touch(key string) bool {
+	e, ok := l.entries[key]
+	if ok {
+		l.order.MoveToFront(e)
+	}
+	return ok
+}
+
+// add records key with the given size and returns the keys to evict.
+func (l *lruIndex) add(key string, size int64) []string {
+	l.remove(key)
+	l.entries[key] = l.order.PushFront(&lruEntry{key: key, size: size})
+	l.size += size
+
+	var evicted []string
+	for l.size > l.maxBytes && l.order.Len() > 0 {
+		oldest := l.order.Back().Value.(*lruEntry)
+		l.remove(oldest.key)
+		evicted = append(evicted, oldest.key)
+	}
+	return evicted
+}
+
+func (l *lruIndex) remove(key string) {
+	if e, ok := l.entries[key]; ok {
+		l.size -= e.Value.(*lruEntry).size
+		l.order.Remove(e)
+		delete(l.entries, key)
+	}
+}
+
+// memoryResultCacheStorage keeps results in memory, evicting the least
+// recently used ones beyond maxBytes.
+type memoryResultCacheStorage struct {
+	mu     sync.Mutex
+	index  *lruIndex
+	values map[string][]byte
+}
+
+// NewMemoryResultCacheStorage returns a ResultCacheStorage that keeps up to
+// maxBytes of results in memory.
+func NewMemoryResultCacheStorage(maxBytes int64) ResultCacheStorage {
+	return &memoryResultCacheStorage{index: newLRUIndex(maxBytes), values: map[string][]byte{}}
+}
+
+func (s *memoryResultCacheStorage) Get(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.index.touch(key) {
+		return nil, false
+	}
+	return s.values[key], true
+}
+
+func (s *memoryResultCacheStorage) Set(key string, value []byte) error {
+	if int64(len(value)) > s.index.maxBytes {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = value
+	for _, evicted := range s.index.add(key, int64(len(value))) {
+		delete(s.values, evicted)
+	}
+	return nil
+}
+
+func (s *memoryResultCacheStorage) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.index.remove(key)
+	delete(s.values, key)
+}
+
+// diskResultCacheStorage keeps results as files in a directory, evicting the
+// least recently used ones beyond maxBytes.
+type diskResultCacheStorage struct {
+	dir   string
+	mu    sync.Mutex
+	index *lruIndex
+}
+
+// NewDiskResultCacheStorage returns a ResultCacheStorage that keeps up to
+// maxBytes of results as files in dir. Results already in dir are reused.
+func NewDiskResultCacheStorage(dir string, maxBytes int64) (ResultCacheStorage, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("could not create result cache directory: %w", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read result cache directory: %w", err)
+	}
+	var files []os.FileInfo
+	for _, entry := range entries {
+		if entry.Type().IsRegular() {
+			if info, err := entry.Info(); err == nil {
+				files = append(files, info)
+			}
+		}
+	}
+	// oldest first, so the most recently written files end up most recently used
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+
+	s := &diskResultCacheStorage{dir: dir, index: newLRUIndex(maxBytes)}
+	for _, file := range files {
+		for _, evicted := range s.index.add(file.Name(), file.Size()) {
+			_ = os.Remove(s.path(evicted))
+		}
+	}
+	return s, nil
+}
+
+func (s *diskResultCacheStorage) path(key string) string {
+	return filepath.Join(s.dir, key)
+}
+
+func (s *diskResultCacheStorage) Get(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.index.touch(key) {
+		return nil, false
+	}
+	value, err := os.ReadFile(s.path(key))
+	if err != nil {
+		s.index.remove(key)
+		return nil, false
+	}
+	return value, true
+}
+
+func (s *diskResultCacheStorage) Set(key string, value []byte) error {
+	if int64(len(value)) > s.index.maxBytes {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.WriteFile(s.path(key), value, 0o600); err != nil {
+		return err
+	}
+	for _, evicted := range s.index.add(key, int64(len(value))) {
+		_ = os.Remove(s.path(evicted))
+	}
+	return nil
+}
+
+func (s *diskResultCacheStorage) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.index.remove(key)
+	_ = os.Remove(s.path(key))
+}
+
+// cachedResult returns the cached frames of q filled with fillMode, marked as
+// a cache hit.
+func (ds *AsyncAWSDatasource) cachedResult(datasourceUID string, q *AsyncQuery, fillMode *data.FillMissing) (data.Frames, bool) {
+	if ds.ResultCache == nil {
+		return nil, false
+	}
+	frames, ok := ds.ResultCache.get(resultCacheKeyFor(datasourceUID, q, fillMode, ds.GetRowLimit()))
+	if !ok || len(frames) == 0 {
+		return nil, false
+	}
+	// the frames may have been cached for another panel running the same query
+	for _, frame := range frames {
+		frame.Name = q.RefID
+	}
+	if frames[0].Meta == nil {
+		frames[0].Meta = &data.FrameMeta{}
+	}
+	frames[0].Meta.Custom = queryMeta{Status: QueryFinished.String(), CacheHit: true}
+	return frames, true
+}
+
+// cacheResult stores the frames of the finished query q, filled with
+// fillMode.
+func (ds *AsyncAWSDatasource) cacheResult(datasourceUID string, q *AsyncQuery, fillMode *data.FillMissing, frames data.Frames) {
+	if ds.ResultCache == nil {
+		return
+	}
+	if err := ds.ResultCache.set(resultCacheKeyFor(datasourceUID, q, fillMode, ds.GetRowLimit()), frames); err != nil {
+		backend.Logger.Warn("Could not cache async query result", "queryID", q.QueryID, "error", err)
+	}
+}
@@ -0,0 +1,133 @@
+package awsds
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testFrames() data.Frames {
+	frame := data.NewFrame("A",
+		data.NewField("time", nil, []time.Time{time.Unix(1, 0).UTC(), time.Unix(2, 0).UTC()}),
+		data.NewField("value", nil, []float64{1.5, 2.5}),
+	)
+	frame.Meta = &data.FrameMeta{ExecutedQueryString: "SELECT 1"}
+	return data.Frames{frame}
+}
+
+func Test_resultCacheKeyFor(t *testing.T) {
+	timeRange := backend.TimeRange{From: time.Unix(0, 0), To: time.Unix(3600, 0)}
+	base := &AsyncQuery{Query: sqlutil.Query{RawSQL: "SELECT 1", TimeRange: timeRange}}
+	key := resultCacheKeyFor("uid1", base, nil, 0)
+
+	assert.Equal(t, key, resultCacheKeyFor("uid1", &AsyncQuery{Query: sqlutil.Query{RawSQL: "SELECT 1", TimeRange: timeRange}, QueryID: "qid"}, nil, 0))
+	assert.NotEqual(t, key, resultCacheKeyFor("uid2", base, nil, 0))
+	assert.NotEqual(t, key, resultCacheKeyFor("uid1", &AsyncQuery{Query: sqlutil.Query{RawSQL: "SELECT 2", TimeRange: timeRange}}, nil, 0))
+	assert.NotEqual(t, key, resultCacheKeyFor("uid1", &AsyncQuery{Query: sqlutil.Query{RawSQL: "SELECT 1", TimeRange: backend.TimeRange{From: time.Unix(0, 0), To: time.Unix(7200, 0)}}}, nil, 0))
+	assert.NotEqual(t, key, resultCacheKeyFor("uid1", &AsyncQuery{Query: sqlutil.Query{RawSQL: "SELECT 1", TimeRange: timeRange, ConnectionArgs: json.RawMessage(`{"db":"other"}`)}}, nil, 0))
+
+	withArgs := resultCacheKeyFor("uid1", &AsyncQuery{Query: sqlutil.Query{RawSQL: "SELECT 1", TimeRange: timeRange, ConnectionArgs: json.RawMessage(`{"db":"other","region":"eu-west-1"}`)}}, nil, 0)
+	assert.Equal(t, withArgs, resultCacheKeyFor("uid1", &AsyncQuery{Query: sqlutil.Query{RawSQL: "SELECT 1", TimeRange: timeRange, ConnectionArgs: json.RawMessage(`{ "region": "eu-west-1", "db": "other" }`)}}, nil, 0))
+
+	assert.NotEqual(t, key, resultCacheKeyFor("uid1", &AsyncQuery{Query: sqlutil.Query{RawSQL: "SELECT 1", TimeRange: timeRange, Format: sqlutil.FormatOptionTable}}, nil, 0), "table and time series panels get different frames")
+	assert.NotEqual(t, key, resultCacheKeyFor("uid1", base, &data.FillMissing{Mode: data.FillModeNull}, 0))
+	assert.NotEqual(t, key, resultCacheKeyFor("uid1", base, nil, 100))
+}
+
+func TestResultCache(t *testing.T) {
+	now := time.Unix(1000, 0)
+	cache := NewResultCache(NewMemoryResultCacheStorage(1<<20), time.Minute)
+	cache.now = func() time.Time { return now }
+
+	require.NoError(t, cache.set("key", testFrames()))
+	frames, ok := cache.get("key")
+	require.True(t, ok)
+	require.Len(t, frames, 1)
+	assert.Equal(t, 2, frames[0].Rows())
+	assert.Equal(t, "SELECT 1", frames[0].Meta.ExecutedQueryString)
+	assert.Equal(t, 2.5, frames[0].Fields[1].At(1))
+
+	now = now.Add(2 * time.Minute)
+	_, ok = cache.get("key")
+	assert.False(t, ok, "expired entries should not be returned")
+	_, stored := cache.storage.Get("key")
+	assert.False(t, stored, "expired entries should be removed")
+
+	_, ok = cache.get("missing")
+	assert.False(t, ok)
+}
+
+func testResultCacheStorage(t *testing.T, storage ResultCacheStorage) {
+	t.Helper()
+	require.NoError(t, storage.Set("a", make([]byte, 40)))
+	require.NoError(t, storage.Set("b", make([]byte, 40)))
+	_, ok := storage.Get("a") // a is now more recently used than b
+	require.True(t, ok)
+
+	require.NoError(t, storage.Set("c", make([]byte, 40)))
+	_, ok = storage.Get("b")
+	assert.False(t, ok, "least recently used entry should be evicted")
+	_, ok = storage.Get("a")
+	assert.True(t, ok)
+	value, ok := storage.Get("c")
+	assert.True(t, ok)
+	assert.Len(t, value, 40)
+
+	require.NoError(t, storage.Set("too-big", make([]byte, 101)))
+	_, ok = storage.Get("too-big")
+	assert.False(t, ok, "entries larger than the limit should not be stored")
+
+	storage.Delete("a")
+	_, ok = storage.Get("a")
+	assert.False(t, ok)
+}
+
+func TestMemoryResultCacheStorage(t *testing.T) {
+	testResultCacheStorage(t, NewMemoryResultCacheStorage(100))
+}
+
+func TestDiskResultCacheStorage(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := NewDiskResultCacheStorage(dir, 100)
+	require.NoError(t, err)
+	testResultCacheStorage(t, storage)
+
+	t.Run("reuses results already on disk", func(t *testing.T) {
+		reopened, err := NewDiskResultCacheStorage(dir, 100)
+		require.NoError(t, err)
+		value, ok := reopened.Get("c")
+		assert.True(t, ok)
+		assert.Len(t, value, 40)
+	})
+}
+
+func Test_handleAsyncQuery_resultCache(t *testing.T) {
+	settings := backend.DataSourceInstanceSettings{UID: "uid1"}
+	timeRange := backend.TimeRange{From: time.Unix(0, 0), To: time.Unix(3600, 0)}
+	query := backend.DataQuery{RefID: "A", TimeRange: timeRange, JSON: []byte(`{"rawSql":"SELECT 1","meta":{"queryFlow":"async"}}`)}
+
+	ds := NewAsyncAWSDatasource(fakeDriver{})
+	ds.ResultCache = NewResultCache(NewMemoryResultCacheStorage(1<<20), time.Minute)
+	// the mock has no expectations, so starting a query would fail the test
+	ds.storeDBConnection(defaultKey("uid1"), dbConnection{new(MockDB), settings})
+
+	q, err := GetQuery(query)
+	require.NoError(t, err)
+	cached := testFrames()
+	cached[0].Name = "B"
+	ds.cacheResult("uid1", q, nil, cached)
+
+	frames, err := ds.handleAsyncQuery(context.Background(), query, "uid1")
+	require.NoError(t, err)
+	require.Len(t, frames, 1)
+	assert.Equal(t, 2, frames[0].Rows())
+	assert.Equal(t, "A", frames[0].Name, "the frames are named after the query they are served to")
+	assert.Equal(t, queryMeta{Status: "finished", CacheHit: true}, frames[0].Meta.Custom)
+}
@@ -0,0 +1,323 @@
+package awsds
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/sqlds/v5"
+)
+
+// connectionUsage remembers when each cached connection was last used.
+type connectionUsage struct {
+	mu       sync.Mutex
+	lastUsed map[string]time.Time
+}
+
+func (u *connectionUsage) used(key string, now time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.lastUsed == nil {
+		u.lastUsed = map[string]time.Time{}
+	}
+	u.lastUsed[key] = now
+}
+
+func (u *connectionUsage) forget(key string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.lastUsed, key)
+}
+
+func (u *connectionUsage) get(key string) time.Time {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.lastUsed[key]
+}
+
+// idle returns the connections not used since before deadline.
+func (u *connectionUsage) idle(deadline time.Time) []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var idle []string
+	for key, lastUsed := range u.lastUsed {
+		if lastUsed.Before(deadline) {
+			idle = append(idle, key)
+		}
+	}
+	return idle
+}
+
+// connectionLeases counts the requests using each cached connection, so a
+// connection removed from the cache is only closed once nobody uses it.
+type connectionLeases struct {
+	mu     sync.Mutex
+	leases map[string]*connectionLease
+}
+
+// connectionLease holds the users of the connection cached at a key. A new
+// lease is made once that connection leaves the cache.
+type connectionLease struct {
+	users int
+	// evicted is the connection to close when its last user is done
+	evicted AsyncDB
+}
+
+// acquire adds a user to the connection cached at key and returns the
+// function to call once done with it. l.mu must be held.
+func (l *connectionLeases) acquire(key string) func() {
+	if l.leases == nil {
+		l.leases = map[string]*connectionLease{}
+	}
+	lease, ok := l.leases[key]
+	if !ok {
+		lease = &connectionLease{}
+		l.leases[key] = lease
+	}
+	lease.users++
+	var once sync.Once
+	return func() {
+		once.Do(func() { l.release(key, lease) })
+	}
+}
+
+func (l *connectionLeases) release(key string, lease *connectionLease) {
+	l.mu.Lock()
+	lease.users--
+	var evicted AsyncDB
+	if lease.users == 0 {
+		if l.leases[key] == lease {
+			delete(l.leases, key)
+		}
+		evicted = lease.evicted
+	}
+	l.mu.Unlock()
+	closeAsyncDB(key, evicted)
+}
+
+// closeWhenUnused closes db, which was removed from the cache at key, right
+// away or once its last user is done.
+func (l *connectionLeases) closeWhenUnused(key string, db AsyncDB) {
+	l.mu.Lock()
+	lease, inUse := l.leases[key]
+	if inUse {
+		lease.evicted = db
+		delete(l.leases, key)
+	}
+	l.mu.Unlock()
+	if !inUse {
+		closeAsyncDB(key, db)
+	}
+}
+
+// useDBConnection returns the connection cached at key, which stays open until
+// the returned function is called even if it is removed from the cache.
+func (ds *AsyncAWSDatasource) useDBConnection(key string) (dbConnection, func(), bool) {
+	ds.connectionLeases.mu.Lock()
+	dbConn, ok := ds.getDBConnection(key)
+	var release func()
+	if ok {
+		release = ds.connectionLeases.acquire(key)
+	}
+	ds.connectionLeases.mu.Unlock()
+	if ok {
+		ds.connectionUsed(key)
+	}
+	return dbConn, release, ok
+}
+
+// openDBConnection opens the connection of datasourceUID with connectionArgs
+// and caches it at key, closing the least recently used connections beyond
+// MaxConnectionsPerDatasource.
+func (ds *AsyncAWSDatasource) openDBConnection(ctx context.Context, datasourceUID string, key string, connectionArgs json.RawMessage) error {
+	dbConn, err := ds.defaultDBConnection(ctx, datasourceUID)
+	if err != nil || key == defaultKey(datasourceUID) {
+		return err
+	}
+	db, err := ds.driver.GetAsyncDB(ctx, dbConn.settings, connectionArgs)
+	if err != nil {
+		return err
+	}
+	ds.storeNewDBConnection(key, dbConnection{db, dbConn.settings})
+	ds.closeExcessDBConnections(datasourceUID, key)
+	return nil
+}
+
+// connectionUsed records that the connection stored at key was just used, so
+// it is only closed once it is not used for ConnectionIdleTimeout.
+func (ds *AsyncAWSDatasource) connectionUsed(key string) {
+	ds.connectionUsage.used(key, time.Now())
+	if ds.ConnectionIdleTimeout <= 0 {
+		return
+	}
+	ds.connectionJanitor.ensureRunning(max(ds.ConnectionIdleTimeout/2, minReapInterval), func() {
+		ds.closeIdleDBConnections(time.Now())
+	})
+}
+
+// defaultDBConnection returns the connection of datasourceUID without
+// connection args, opening it again if it was closed since NewDatasource.
+func (ds *AsyncAWSDatasource) defaultDBConnection(ctx context.Context, datasourceUID string) (dbConnection, error) {
+	key := defaultKey(datasourceUID)
+	if dbConn, ok := ds.getDBConnection(key); ok {
+		return dbConn, nil
+	}
+	settings, ok := ds.datasourceSettings.Load(datasourceUID)
+	if !ok {
+		return dbConnection{}, sqlds.ErrorMissingDBConnection
+	}
+	db, err := ds.driver.GetAsyncDB(ctx, settings.(backend.DataSourceInstanceSettings), nil)
+	if err != nil {
+		return dbConnection{}, err
+	}
+	return ds.storeNewDBConnection(key, dbConnection{db, settings.(backend.DataSourceInstanceSettings)}), nil
+}
+
+// storeNewDBConnection caches dbConn at key unless another connection was
+// cached there in the meantime, in which case dbConn is closed and the other
+// one is returned.
+func (ds *AsyncAWSDatasource) storeNewDBConnection(key string, dbConn dbConnection) dbConnection {
+	if actual, loaded := ds.dbConnections.LoadOrStore(key, dbConn); loaded {
+		closeAsyncDB(key, dbConn.db)
+		return actual.(dbConnection)
+	}
+	connectionCacheSizeMetric.Inc()
+	ds.connectionUsed(key)
+	return dbConn
+}
+
+// replaceDBConnections makes dbConn the default connection of its datasource
+// and closes the connections opened with its previous settings once the
+// requests using them are done.
+func (ds *AsyncAWSDatasource) replaceDBConnections(dbConn dbConnection) {
+	datasourceUID := getDatasourceUID(dbConn.settings)
+	ds.datasourceSettings.Store(datasourceUID, dbConn.settings)
+	for _, key := range ds.datasourceConnectionKeys(datasourceUID) {
+		ds.closeDBConnection(key)
+	}
+	key := defaultKey(datasourceUID)
+	if previous, loaded := ds.dbConnections.Swap(key, dbConn); loaded {
+		ds.connectionLeases.closeWhenUnused(key, previous.(dbConnection).db)
+	} else {
+		connectionCacheSizeMetric.Inc()
+	}
+	ds.connectionUsed(key)
+}
+
+// datasourceConnectionKeys returns the keys of the connections of
+// datasourceUID opened with connection args.
+func (ds *AsyncAWSDatasource) datasourceConnectionKeys(datasourceUID string) []string {
+	var keys []string
+	ds.dbConnections.Range(func(key, value any) bool {
+		if key != defaultKey(datasourceUID) && getDatasourceUID(value.(dbConnection).settings) == datasourceUID {
+			keys = append(keys, key.(string))
+		}
+		return true
+	})
+	return keys
+}
+
+// closeExcessDBConnections closes the least recently used connections of
+// datasourceUID until it has no more than MaxConnectionsPerDatasource cached,
+// counting its default connection. The connection stored at keep stays open.
+// Connections still in use are closed once their requests are done.
+func (ds *AsyncAWSDatasource) closeExcessDBConnections(datasourceUID string, keep string) {
+	if ds.MaxConnectionsPerDatasource <= 0 {
+		return
+	}
+	var candidates []string
+	for _, key := range ds.datasourceConnectionKeys(datasourceUID) {
+		if key != keep {
+			candidates = append(candidates, key)
+		}
+	}
+	// the default connection and the one to keep always stay open
+	excess := len(candidates) + 2 - ds.MaxConnectionsPerDatasource
+	if excess <= 0 {
+		return
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return ds.connectionUsage.get(candidates[i]).Before(ds.connectionUsage.get(candidates[j]))
+	})
+	for _, key := range candidates[:min(excess, len(candidates))] {
+		ds.closeDBConnection(key)
+	}
+}
+
+// closeIdleDBConnections closes the connections not used for
+// ConnectionIdleTimeout as of now. Default connections are opened again when
+// their datasource is queried.
+func (ds *AsyncAWSDatasource) closeIdleDBConnections(now time.Time) {
+	for _, key := range ds.connectionUsage.idle(now.Add(-ds.ConnectionIdleTimeout)) {
+		backend.Logger.Debug("Closing idle database connection", "key", key, "idleTimeout", ds.ConnectionIdleTimeout)
+		ds.closeDBConnection(key)
+	}
+}
+
+// closeDBConnection removes the connection stored at key from the cache and
+// closes it once it is not used anymore.
+func (ds *AsyncAWSDatasource) closeDBConnection(key string) {
+	ds.connectionUsage.forget(key)
+	if dbConn, loaded := ds.dbConnections.LoadAndDelete(key); loaded {
+		connectionCacheSizeMetric.Dec()
+		ds.connectionLeases.closeWhenUnused(key, dbConn.(dbConnection).db)
+	}
+}
+
+func closeAsyncDB(key string, db AsyncDB) {
+	if db == nil {
+		return
+	}
+	if err := db.Close(); err != nil {
+		backend.Logger.Warn("Could not close database connection", "key", key, "error", err)
+	}
+}
+
+// datasourceInstance is the instance of one datasource returned by
+// NewDatasource. Every instance is served by the same AsyncAWSDatasource.
+type datasourceInstance struct {
+	*AsyncAWSDatasource
+	settings backend.DataSourceInstanceSettings
+	// sqlDatasource holds the sqlds connector created for the instance
+	sqlDatasource *sqlds.SQLDatasource
+}
+
+// Dispose disposes the sqlds connector of the instance and closes the
+// connections of the datasource when it is not served anymore. The instance
+// manager also disposes instances replaced by newer settings: their
+// connections were replaced by NewDatasource already, so the connections
+// opened with the new settings are left alone.
+func (i *datasourceInstance) Dispose() {
+	if i.sqlDatasource != nil {
+		i.sqlDatasource.Dispose()
+	}
+	datasourceUID := getDatasourceUID(i.settings)
+	current, ok := i.datasourceSettings.Load(datasourceUID)
+	if !ok || !current.(backend.DataSourceInstanceSettings).Updated.Equal(i.settings.Updated) {
+		return
+	}
+	i.datasourceSettings.Delete(datasourceUID)
+	for _, key := range append(i.datasourceConnectionKeys(datasourceUID), defaultKey(datasourceUID)) {
+		i.closeDBConnection(key)
+	}
+}
+
+// Dispose stops cancelling idle queries, closes all the cached connections and
+// disposes the wrapped SQLDatasource, e.g. when the plugin stops. The
+// datasources served so far can still be queried: their connections are opened
+// again when needed. Instances returned by NewDatasource only dispose their own
+// datasource and connector.
+func (ds *AsyncAWSDatasource) Dispose() {
+	ds.idleQueries.shutdown()
+	ds.connectionJanitor.shutdown()
+	ds.dbConnections.Range(func(key, _ any) bool {
+		ds.closeDBConnection(key.(string))
+		return true
+	})
+	if ds.SQLDatasource != nil {
+		ds.SQLDatasource.Dispose()
+	}
+}
@@ -0,0 +1,250 @@
+package awsds
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+	"github.com/grafana/sqlds/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// closableDB records whether it was closed.
+type closableDB struct {
+	fakeAsyncDB
+	closed atomic.Bool
+}
+
+func (db *closableDB) Close() error {
+	db.closed.Store(true)
+	return nil
+}
+
+func newConnectionsDatasource(opened *[]*closableDB) *AsyncAWSDatasource {
+	ds := NewAsyncAWSDatasource(fakeDriver{openDBfn: func() (AsyncDB, error) {
+		db := &closableDB{}
+		*opened = append(*opened, db)
+		return db, nil
+	}})
+	ds.EnableMultipleConnections = true
+	return ds
+}
+
+func queryWithArgs(args string) *AsyncQuery {
+	return &AsyncQuery{Query: sqlutil.Query{ConnectionArgs: json.RawMessage(args)}}
+}
+
+func Test_replaceDBConnections(t *testing.T) {
+	var opened []*closableDB
+	ds := newConnectionsDatasource(&opened)
+	settings := backend.DataSourceInstanceSettings{UID: "uid1"}
+	first, other := &closableDB{}, &closableDB{}
+	ds.replaceDBConnections(dbConnection{first, settings})
+	ds.replaceDBConnections(dbConnection{other, backend.DataSourceInstanceSettings{UID: "uid2"}})
+	withArgs, release, err := ds.getAsyncDBFromQuery(context.Background(), queryWithArgs(`{"region":"us-east-1"}`), "uid1")
+	require.NoError(t, err)
+	release()
+
+	second := &closableDB{}
+	ds.replaceDBConnections(dbConnection{second, settings})
+
+	assert.True(t, first.closed.Load(), "the previous default connection should be closed")
+	assert.True(t, withArgs.(*closableDB).closed.Load(), "connections opened with the previous settings should be closed")
+	assert.False(t, other.closed.Load(), "connections of other datasources should stay open")
+	db, release, err := ds.getAsyncDBFromQuery(context.Background(), &AsyncQuery{}, "uid1")
+	require.NoError(t, err)
+	release()
+	assert.Same(t, second, db)
+}
+
+func Test_closeExcessDBConnections(t *testing.T) {
+	var opened []*closableDB
+	ds := newConnectionsDatasource(&opened)
+	ds.MaxConnectionsPerDatasource = 3
+	defaultDB := &closableDB{}
+	ds.replaceDBConnections(dbConnection{defaultDB, backend.DataSourceInstanceSettings{UID: "uid1"}})
+
+	get := func(args string) AsyncDB {
+		db, release, err := ds.getAsyncDBFromQuery(context.Background(), queryWithArgs(args), "uid1")
+		require.NoError(t, err)
+		release()
+		return db
+	}
+	a := get(`{"a":1}`)
+	b := get(`{"b":1}`)
+	time.Sleep(time.Millisecond)
+	assert.Same(t, a, get(`{"a":1}`), "a is used again and becomes the most recent")
+	c := get(`{"c":1}`)
+
+	assert.True(t, b.(*closableDB).closed.Load(), "the least recently used connection should be closed")
+	assert.False(t, a.(*closableDB).closed.Load())
+	assert.False(t, c.(*closableDB).closed.Load())
+	assert.False(t, defaultDB.closed.Load(), "the default connection should stay open")
+	_, cached := ds.getDBConnection(keyWithConnectionArgs("uid1", json.RawMessage(`{"b":1}`)))
+	assert.False(t, cached)
+}
+
+func Test_closeDBConnection_waitsForUsers(t *testing.T) {
+	var opened []*closableDB
+	ds := newConnectionsDatasource(&opened)
+	ds.MaxConnectionsPerDatasource = 2
+	defaultDB := &closableDB{}
+	ds.replaceDBConnections(dbConnection{defaultDB, backend.DataSourceInstanceSettings{UID: "uid1"}})
+
+	a, releaseA, err := ds.getAsyncDBFromQuery(context.Background(), queryWithArgs(`{"a":1}`), "uid1")
+	require.NoError(t, err)
+	inUse, releaseDefault, err := ds.getAsyncDBFromQuery(context.Background(), &AsyncQuery{}, "uid1")
+	require.NoError(t, err)
+	_, releaseB, err := ds.getAsyncDBFromQuery(context.Background(), queryWithArgs(`{"b":1}`), "uid1")
+	require.NoError(t, err)
+	defer releaseB()
+	_, cached := ds.getDBConnection(keyWithConnectionArgs("uid1", json.RawMessage(`{"a":1}`)))
+	assert.False(t, cached, "the excess connection leaves the cache")
+	assert.False(t, a.(*closableDB).closed.Load(), "connections in use are not closed")
+
+	releaseA()
+	assert.True(t, a.(*closableDB).closed.Load(), "the connection is closed once its request is done")
+	releaseA()
+
+	second := &closableDB{}
+	ds.replaceDBConnections(dbConnection{second, backend.DataSourceInstanceSettings{UID: "uid1"}})
+	db, release, err := ds.getAsyncDBFromQuery(context.Background(), &AsyncQuery{}, "uid1")
+	require.NoError(t, err)
+	assert.Same(t, second, db)
+	assert.False(t, inUse.(*closableDB).closed.Load(), "replaced connections in use are not closed")
+	releaseDefault()
+	assert.True(t, inUse.(*closableDB).closed.Load())
+	release()
+	assert.False(t, second.closed.Load(), "only the replaced connection is closed")
+}
+
+func Test_closeIdleDBConnections(t *testing.T) {
+	var opened []*closableDB
+	ds := newConnectionsDatasource(&opened)
+	ds.ConnectionIdleTimeout = time.Minute
+	t.Cleanup(ds.connectionJanitor.shutdown)
+	defaultDB := &closableDB{}
+	ds.replaceDBConnections(dbConnection{defaultDB, backend.DataSourceInstanceSettings{UID: "uid1"}})
+	withArgs, release, err := ds.getAsyncDBFromQuery(context.Background(), queryWithArgs(`{"a":1}`), "uid1")
+	require.NoError(t, err)
+	release()
+
+	ds.closeIdleDBConnections(time.Now())
+	assert.False(t, defaultDB.closed.Load(), "connections used recently should stay open")
+
+	ds.closeIdleDBConnections(time.Now().Add(2 * time.Minute))
+	assert.True(t, defaultDB.closed.Load())
+	assert.True(t, withArgs.(*closableDB).closed.Load())
+
+	db, release, err := ds.getAsyncDBFromQuery(context.Background(), &AsyncQuery{}, "uid1")
+	require.NoError(t, err)
+	release()
+	assert.NotSame(t, defaultDB, db, "the default connection should be opened again")
+	require.Len(t, opened, 2)
+	assert.Same(t, opened[1], db)
+}
+
+func TestAsyncAWSDatasource_Dispose_closesConnections(t *testing.T) {
+	reopened := &closableDB{}
+	ds := &AsyncAWSDatasource{driver: fakeDriver{openDBfn: func() (AsyncDB, error) { return reopened, nil }}}
+	settings := backend.DataSourceInstanceSettings{UID: "uid1"}
+	defaultDB, withArgs := &closableDB{}, &closableDB{}
+	ds.replaceDBConnections(dbConnection{defaultDB, settings})
+	ds.storeNewDBConnection(keyWithConnectionArgs("uid1", json.RawMessage(`{"a":1}`)), dbConnection{withArgs, settings})
+
+	ds.Dispose()
+
+	assert.True(t, defaultDB.closed.Load())
+	assert.True(t, withArgs.closed.Load())
+	dbConn, err := ds.defaultDBConnection(context.Background(), "uid1")
+	require.NoError(t, err, "a disposed datasource can still be queried")
+	assert.Same(t, reopened, dbConn.db)
+
+	_, err = ds.defaultDBConnection(context.Background(), "unknown")
+	assert.ErrorIs(t, err, sqlds.ErrorMissingDBConnection)
+}
+
+func Test_datasourceInstance_Dispose(t *testing.T) {
+	var opened []*closableDB
+	ds := newConnectionsDatasource(&opened)
+	old := backend.DataSourceInstanceSettings{UID: "uid1", Updated: time.Unix(1, 0)}
+	updated := backend.DataSourceInstanceSettings{UID: "uid1", Updated: time.Unix(2, 0)}
+	other := backend.DataSourceInstanceSettings{UID: "uid2"}
+
+	// as done by NewDatasource
+	newInstance := func(settings backend.DataSourceInstanceSettings) (*datasourceInstance, *closableDB) {
+		db := &closableDB{}
+		ds.replaceDBConnections(dbConnection{db, settings})
+		return &datasourceInstance{AsyncAWSDatasource: ds, settings: settings}, db
+	}
+	oldInstance, oldDB := newInstance(old)
+	otherInstance, otherDB := newInstance(other)
+	_, updatedDB := newInstance(updated)
+
+	oldInstance.Dispose()
+	assert.True(t, oldDB.closed.Load())
+	assert.False(t, updatedDB.closed.Load(), "the connection opened with the new settings stays open")
+	dbConn, err := ds.defaultDBConnection(context.Background(), "uid1")
+	require.NoError(t, err)
+	assert.Same(t, updatedDB, dbConn.db)
+
+	otherInstance.Dispose()
+	assert.True(t, otherDB.closed.Load(), "the connection of a removed datasource is closed")
+	assert.False(t, updatedDB.closed.Load(), "the connections of other datasources stay open")
+	_, err = ds.defaultDBConnection(context.Background(), "uid2")
+	assert.ErrorIs(t, err, sqlds.ErrorMissingDBConnection)
+}
+
+// sqlConnectDriver also opens the sql.DB connections of sqlds.
+type sqlConnectDriver struct {
+	fakeDriver
+	connected *[]*sql.DB
+}
+
+func (sqlConnectDriver) Settings(context.Context, backend.DataSourceInstanceSettings) sqlds.DriverSettings {
+	return sqlds.DriverSettings{}
+}
+
+func (d sqlConnectDriver) Connect(context.Context, backend.DataSourceInstanceSettings, json.RawMessage) (*sql.DB, error) {
+	db := sql.OpenDB(&flakyConnector{})
+	*d.connected = append(*d.connected, db)
+	return db, nil
+}
+
+func Test_datasourceInstance_Dispose_sqldsConnector(t *testing.T) {
+	var connected []*sql.DB
+	ds := NewAsyncAWSDatasource(sqlConnectDriver{fakeDriver{openDBfn: func() (AsyncDB, error) { return &closableDB{}, nil }}, &connected})
+	oldInstance, err := ds.NewDatasource(context.Background(), backend.DataSourceInstanceSettings{UID: "uid1", Updated: time.Unix(1, 0)})
+	require.NoError(t, err)
+	updatedInstance, err := ds.NewDatasource(context.Background(), backend.DataSourceInstanceSettings{UID: "uid1", Updated: time.Unix(2, 0)})
+	require.NoError(t, err)
+	require.Len(t, connected, 2)
+
+	oldInstance.(*datasourceInstance).Dispose()
+	assert.Error(t, connected[0].Ping(), "the connection of the replaced connector is closed")
+	assert.NoError(t, connected[1].Ping(), "the connection of the current connector stays open")
+
+	updatedInstance.(*datasourceInstance).Dispose()
+	assert.Error(t, connected[1].Ping())
+}
+
+func Test_getAsyncDBFromQuery_reusesEquivalentConnectionArgs(t *testing.T) {
+	var opened []*closableDB
+	ds := newConnectionsDatasource(&opened)
+	ds.replaceDBConnections(dbConnection{&closableDB{}, backend.DataSourceInstanceSettings{UID: "uid1"}})
+
+	db, _, err := ds.getAsyncDBFromQuery(context.Background(), queryWithArgs(`{"region":"us-east-1","catalog":"c"}`), "uid1")
+	require.NoError(t, err)
+	same, _, err := ds.getAsyncDBFromQuery(context.Background(), queryWithArgs(`{ "catalog": "c",
+		"region": "us-east-1" }`), "uid1")
+	require.NoError(t, err)
+
+	assert.Same(t, db, same)
+	assert.Len(t, opened, 1)
+}
@@ -7,12 +7,15 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"time"
 
+	"github.com/grafana/grafana-aws-sdk/pkg/common"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/instancemgmt"
 	"github.com/grafana/grafana-plugin-sdk-go/data"
 	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
 	"github.com/grafana/sqlds/v5"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const defaultKeySuffix = "default"
@@ -24,7 +27,7 @@ func defaultKey(datasourceUID string) string {
 }
 
 func keyWithConnectionArgs(datasourceUID string, connArgs json.RawMessage) string {
-	return fmt.Sprintf("%s-%s", datasourceUID, string(connArgs))
+	return fmt.Sprintf("%s-%s", datasourceUID, common.JSONKey(connArgs))
 }
 
 type dbConnection struct {
@@ -35,9 +38,75 @@ type dbConnection struct {
 type AsyncAWSDatasource struct {
 	*sqlds.SQLDatasource
 
+	// MaxExecutionDuration is how long an async query may run before it is
+	// cancelled, unless the datasource settings or the query set their own
+	// limit. Zero means no limit.
+	MaxExecutionDuration time.Duration
+
+	// ResultCache, when set, serves the results of finished async queries
+	// again instead of re-running the same query for the same time range.
+	ResultCache *ResultCache
+
+	// QueryIdleTimeout, when set, is how long a running async query may go
+	// without being polled before it is cancelled, as happens when the
+	// dashboard that started it is closed.
+	QueryIdleTimeout time.Duration
+
+	// MaxConcurrentQueries, when set, is how many queries of a datasource run
+	// at the same time unless the datasource settings set their own limit.
+	// Other queries wait for a free slot. With QueryIdleTimeout set, an async
+	// query holds its slot from its start until it ends, is cancelled or is
+	// reaped, so starts wait for the queries running in the database rather
+	// than for the requests polling them. Otherwise it only holds the slot
+	// while it starts, as queries that are not polled anymore would keep
+	// their slot for good.
+	MaxConcurrentQueries int
+
+	// PageSize, when set and the AsyncDB implements RowsPager, is how many
+	// rows of a finished query are returned at a time unless the query sets
+	// its own page size. The frame meta holds the token of the next page.
+	PageSize int
+
+	// AlertQueryTimeout, when set, runs the queries of alerting and expression
+	// requests through the async flow, polling them on the server for up to
+	// AlertQueryTimeout, instead of through the synchronous flow. Queries
+	// that do not finish in time are cancelled and fail with
+	// ErrQueryStillRunning.
+	AlertQueryTimeout time.Duration
+
+	// AlertMaxPollInterval is the longest wait between two polls of a query
+	// run for an alert. Defaults to five seconds.
+	AlertMaxPollInterval time.Duration
+
+	// Retry is how calls to the AsyncDB that fail with a transient error,
+	// e.g. because of throttling, are retried. The zero value does not retry.
+	Retry RetryPolicy
+
+	// ConnectionIdleTimeout, when set, is how long a cached database
+	// connection may go unused before it is closed.
+	ConnectionIdleTimeout time.Duration
+
+	// MaxConnectionsPerDatasource, when set, is how many database
+	// connections of a datasource are cached at most, counting the one
+	// without connection args. The least recently used ones are closed first.
+	MaxConnectionsPerDatasource int
+
+	// AuditSink, when set, receives an event each time an async query is
+	// started, changes status or fails, e.g. to keep a query history.
+	AuditSink AuditSink
+
 	dbConnections         sync.Map
+	datasourceSettings    sync.Map
+	connectionUsage       connectionUsage
+	connectionLeases      connectionLeases
+	connectionJanitor     backgroundLoop
+	auditedQueries        auditedQueries
 	driver                AsyncDriver
 	sqldsQueryDataHandler backend.QueryDataHandlerFunc
+	queryStartTimes       queryStartTimes
+	sharedQueries         sharedQueries
+	idleQueries           idleQueryReaper
+	queryLimiters         queryLimiters
 }
 
 func (ds *AsyncAWSDatasource) getDBConnection(key string) (dbConnection, bool) {
@@ -49,7 +118,9 @@ func (ds *AsyncAWSDatasource) getDBConnection(key string) (dbConnection, bool) {
 }
 
 func (ds *AsyncAWSDatasource) storeDBConnection(key string, dbConn dbConnection) {
-	ds.dbConnections.Store(key, dbConn)
+	if _, replaced := ds.dbConnections.Swap(key, dbConn); !replaced {
+		connectionCacheSizeMetric.Inc()
+	}
 }
 
 func getDatasourceUID(settings backend.DataSourceInstanceSettings) string {
@@ -86,62 +157,79 @@ func (ds *AsyncAWSDatasource) NewDatasource(ctx context.Context, settings backen
 	if err != nil {
 		return nil, err
 	}
-	key := defaultKey(getDatasourceUID(settings))
-	ds.storeDBConnection(key, dbConnection{db, settings})
+	ds.replaceDBConnections(dbConnection{db, settings})
 
-	// initialize the wrapped ds.SQLDatasource
-	_, err = ds.SQLDatasource.NewDatasource(ctx, settings)
-	return ds, err
+	// initialize the wrapped ds.SQLDatasource, which replaces its connector,
+	// and keep a copy holding the new connector for the instance to dispose
+	if _, err = ds.SQLDatasource.NewDatasource(ctx, settings); err != nil {
+		return &datasourceInstance{AsyncAWSDatasource: ds, settings: settings}, err
+	}
+	sqlDatasource := *ds.SQLDatasource
+	return &datasourceInstance{AsyncAWSDatasource: ds, settings: settings, sqlDatasource: &sqlDatasource}, nil
 }
 
 func (ds *AsyncAWSDatasource) QueryData(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
-	syncExectionEnabled := false
-	for _, query := range req.Queries {
-		if !isAsyncFlow(query) {
-			syncExectionEnabled = true
-			break
-		}
+	if ds.AuditSink != nil {
+		ctx = withAuditRequest(ctx, req)
 	}
+	limiter := ds.queryLimiter(ctx, req.PluginContext.DataSourceInstanceSettings)
 
 	_, isFromAlert := req.Headers[fromAlertHeader]
 	_, isFromExpression := req.Headers[fromExpressionHeader]
-	if syncExectionEnabled || isFromAlert || isFromExpression {
-		return ds.sqldsQueryDataHandler.QueryData(ctx, req)
+	if isFromAlert || isFromExpression {
+		if ds.AlertQueryTimeout > 0 && req.PluginContext.DataSourceInstanceSettings != nil {
+			return ds.alertQueryData(ctx, req), nil
+		}
+		return ds.syncQueryData(ctx, req, limiter)
+	}
+
+	// Queries that opted into the async flow are run through it, the others
+	// through the synchronous flow, and their responses are merged.
+	var asyncQueries, syncQueries []backend.DataQuery
+	for _, query := range req.Queries {
+		if isAsyncFlow(query) {
+			asyncQueries = append(asyncQueries, query)
+		} else {
+			syncQueries = append(syncQueries, query)
+		}
+	}
+	if len(asyncQueries) == 0 {
+		return ds.syncQueryData(ctx, req, limiter)
 	}
 
-	// async flow
 	var (
 		response = sqlds.NewResponse(backend.NewQueryDataResponse())
 		wg       = sync.WaitGroup{}
 	)
 
-	// Execute each query and store the results by query RefID
-	for _, q := range req.Queries {
+	if len(syncQueries) > 0 {
 		wg.Add(1)
-		go func(query backend.DataQuery) {
-			var frames data.Frames
-			var err error
-			frames, err = ds.handleAsyncQuery(ctx, query, req.PluginContext.DataSourceInstanceSettings.UID)
+		go func() {
+			defer wg.Done()
+			syncReq := *req
+			syncReq.Queries = syncQueries
+			res, err := ds.syncQueryData(ctx, &syncReq, limiter)
 			if err != nil {
-				errorResponse := backend.ErrorResponseWithErrorSource(err)
-				var qeError *QueryExecutionError
-				// checking if we know the cause of downstream error
-				if errors.As(err, &qeError) {
-					errorResponse.Status = backend.StatusInternal
-					switch qeError.Cause {
-					// make sure error.status matches the downstream cause, if provided
-					case QueryFailedInternal:
-						errorResponse.Status = backend.StatusInternal
-					case QueryFailedUser:
-						errorResponse.Status = backend.StatusBadRequest
-					}
+				for _, query := range syncQueries {
+					response.Set(query.RefID, errorResponse(err))
 				}
-				response.Set(query.RefID, errorResponse)
-			} else {
-				response.Set(query.RefID, backend.DataResponse{Frames: frames})
+				return
+			}
+			if res == nil {
+				return
 			}
+			for refID, r := range res.Responses {
+				response.Set(refID, r)
+			}
+		}()
+	}
 
-			wg.Done()
+	// Execute each query and store the results by query RefID
+	for _, q := range asyncQueries {
+		wg.Add(1)
+		go func(query backend.DataQuery) {
+			defer wg.Done()
+			response.Set(query.RefID, ds.asyncQueryData(ctx, query, req.PluginContext.DataSourceInstanceSettings.UID))
 		}(q)
 	}
 
@@ -149,17 +237,41 @@ func (ds *AsyncAWSDatasource) QueryData(ctx context.Context, req *backend.QueryD
 	return response.Response(), nil
 }
 
+// syncQueryData runs the queries of req through the synchronous sqlds flow.
+func (ds *AsyncAWSDatasource) syncQueryData(ctx context.Context, req *backend.QueryDataRequest, limiter *queryLimiter) (*backend.QueryDataResponse, error) {
+	if limiter != nil {
+		return ds.limitedSyncQueryData(ctx, req, limiter)
+	}
+	return ds.sqldsQueryDataHandler.QueryData(ctx, req)
+}
+
+// asyncQueryData runs query through the async flow and returns its response.
+// The concurrency limit of the datasource is applied when the query starts.
+func (ds *AsyncAWSDatasource) asyncQueryData(ctx context.Context, query backend.DataQuery, datasourceUID string) backend.DataResponse {
+	frames, err := ds.handleAsyncQuery(ctx, query, datasourceUID)
+	ds.auditQuery(ctx, query, datasourceUID, frames, err)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return backend.DataResponse{Frames: frames}
+}
+
 func (ds *AsyncAWSDatasource) CheckHealth(ctx context.Context, req *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
 	datasourceUID := req.PluginContext.DataSourceInstanceSettings.UID
-	key := defaultKey(datasourceUID)
-	dbConn, ok := ds.getDBConnection(key)
-	if !ok {
+	dbConn, err := ds.defaultDBConnection(ctx, datasourceUID)
+	if errors.Is(err, sqlds.ErrorMissingDBConnection) {
 		return &backend.CheckHealthResult{
 			Status:  backend.HealthStatusError,
 			Message: "No database connection found for datasource uid: " + datasourceUID,
 		}, nil
 	}
-	err := dbConn.db.Ping(ctx)
+	if err != nil {
+		return &backend.CheckHealthResult{
+			Status:  backend.HealthStatusError,
+			Message: err.Error(),
+		}, nil
+	}
+	err = dbConn.db.Ping(ctx)
 	if err != nil {
 		return &backend.CheckHealthResult{
 			Status:  backend.HealthStatusError,
@@ -172,50 +284,54 @@ func (ds *AsyncAWSDatasource) CheckHealth(ctx context.Context, req *backend.Chec
 	}, nil
 }
 
-func (ds *AsyncAWSDatasource) getAsyncDBFromQuery(ctx context.Context, q *AsyncQuery, datasourceUID string) (AsyncDB, error) {
+// getAsyncDBFromQuery returns the connection to run q with and the function to
+// call once done with it, opening the connection if needed.
+func (ds *AsyncAWSDatasource) getAsyncDBFromQuery(ctx context.Context, q *AsyncQuery, datasourceUID string) (AsyncDB, func(), error) {
 	if !ds.EnableMultipleConnections && len(q.ConnectionArgs) > 0 {
-		return nil, sqlds.ErrorMissingMultipleConnectionsConfig
+		return nil, nil, sqlds.ErrorMissingMultipleConnectionsConfig
 	}
 	// The database connection may vary depending on query arguments
 	// The raw arguments are used as key to store the db connection in memory so they can be reused
 	key := defaultKey(datasourceUID)
-	dbConn, ok := ds.getDBConnection(key)
-	if !ok {
-		return nil, sqlds.ErrorMissingDBConnection
-	}
-	if !ds.EnableMultipleConnections || len(q.ConnectionArgs) == 0 {
-		return dbConn.db, nil
-	}
-
-	key = keyWithConnectionArgs(datasourceUID, q.ConnectionArgs)
-	if cachedConn, ok := ds.getDBConnection(key); ok {
-		return cachedConn.db, nil
+	if len(q.ConnectionArgs) > 0 {
+		key = keyWithConnectionArgs(datasourceUID, q.ConnectionArgs)
 	}
-
-	var err error
-	db, err := ds.driver.GetAsyncDB(ctx, dbConn.settings, q.ConnectionArgs)
-	if err != nil {
-		return nil, err
+	for {
+		if dbConn, release, ok := ds.useDBConnection(key); ok {
+			return dbConn.db, release, nil
+		}
+		// the connection may be closed again before it is used, then it is
+		// opened once more
+		if err := ds.openDBConnection(ctx, datasourceUID, key, q.ConnectionArgs); err != nil {
+			return nil, nil, err
+		}
 	}
-	// Assign this connection in the cache
-	dbConn = dbConnection{db, dbConn.settings}
-	ds.storeDBConnection(key, dbConn)
-
-	return dbConn.db, nil
 }
 
 type queryMeta struct {
-	QueryID string `json:"queryID"`
-	Status  string `json:"status"`
+	QueryID       string      `json:"queryID"`
+	Status        string      `json:"status"`
+	CacheHit      bool        `json:"cacheHit,omitempty"`
+	Stats         *QueryStats `json:"stats,omitempty"`
+	NextPageToken string      `json:"nextPageToken,omitempty"`
 }
 
 // handleQuery will call query, and attempt to reconnect if the query failed
-func (ds *AsyncAWSDatasource) handleAsyncQuery(ctx context.Context, req backend.DataQuery, datasourceUID string) (data.Frames, error) {
+func (ds *AsyncAWSDatasource) handleAsyncQuery(ctx context.Context, req backend.DataQuery, datasourceUID string) (frames data.Frames, err error) {
+	ctx, span := common.StartSpan(ctx, "awsds.handleAsyncQuery",
+		common.AttributeDatasourceUID.String(datasourceUID),
+		attribute.String("grafana.query.ref_id", req.RefID),
+	)
+	defer func() { common.EndSpan(span, err) }()
+
 	// Convert the backend.DataQuery into a Query object
 	q, err := GetQuery(req)
 	if err != nil {
 		return getErrorFrameFromQuery(q), err
 	}
+	if q.QueryID != "" {
+		span.SetAttributes(common.AttributeQueryID.String(q.QueryID))
+	}
 
 	// Apply supported macros to the query
 	q.RawSQL, err = sqlutil.Interpolate(&q.Query, ds.driver.Macros())
@@ -230,16 +346,43 @@ func (ds *AsyncAWSDatasource) handleAsyncQuery(ctx context.Context, req backend.
 		fillMode = q.FillMissing
 	}
 
-	asyncDB, err := ds.getAsyncDBFromQuery(ctx, q, datasourceUID)
+	asyncDB, release, err := ds.getAsyncDBFromQuery(ctx, q, datasourceUID)
+	if err != nil {
+		return getErrorFrameFromQuery(q), err
+	}
+	defer release()
+
+	dbConn, _ := ds.defaultDBConnection(ctx, datasourceUID)
+	maxDuration, err := ds.maxExecutionDuration(q, dbConn.settings)
 	if err != nil {
 		return getErrorFrameFromQuery(q), err
 	}
 
 	if q.QueryID == "" {
-		queryID, err := startQuery(ctx, asyncDB, q)
+		if frames, ok := ds.cachedResult(datasourceUID, q, fillMode); ok {
+			return frames, nil
+		}
+		limiter := ds.queryLimiter(ctx, &dbConn.settings)
+		// without idle timeout nothing frees the slot of a query whose
+		// dashboard was closed, so the slot is only held until the start
+		holdSlot := ds.QueryIdleTimeout > 0
+		queryID, err := ds.sharedQueries.start(ctx, sharedQueryKey(datasourceUID, q), asyncDB, limiter, holdSlot, func(ctx context.Context) (string, error) {
+			queryID, err := startQuery(ctx, asyncDB, q, ds.Retry)
+			if err != nil {
+				asyncQueriesMetric.WithLabelValues(auditStatusError).Inc()
+			} else {
+				asyncQueriesMetric.WithLabelValues(asyncQueryStatusStarted).Inc()
+			}
+			return queryID, err
+		})
 		if err != nil {
 			return getErrorFrameFromQuery(q), err
 		}
+		span.SetAttributes(common.AttributeQueryID.String(queryID))
+		if maxDuration > 0 {
+			ds.queryStartTimes.startTime(queryID, maxDuration, time.Now())
+		}
+		ds.trackPoll(queryID, asyncDB)
 		return data.Frames{
 			{Meta: &data.FrameMeta{
 				ExecutedQueryString: q.RawSQL,
@@ -248,38 +391,78 @@ func (ds *AsyncAWSDatasource) handleAsyncQuery(ctx context.Context, req backend.
 		}, nil
 	}
 
-	status, err := queryStatus(ctx, asyncDB, q)
+	if maxDuration > 0 && ds.queryStartTimes.timedOut(q.QueryID) {
+		return ds.cancelTimedOutQuery(ctx, asyncDB, q, maxDuration)
+	}
+	status, err := queryStatus(ctx, asyncDB, q, ds.Retry)
 	if err != nil {
 		return getErrorFrameFromQuery(q), err
 	}
-	customMeta := queryMeta{QueryID: q.QueryID, Status: status.String()}
+	switch {
+	case status.Finished():
+		ds.forgetQuery(q.QueryID)
+		if ds.sharedQueries.finish(q.QueryID) {
+			asyncQueriesMetric.WithLabelValues(status.String()).Inc()
+		}
+	case maxDuration > 0 && time.Since(ds.queryStartTimes.startTime(q.QueryID, maxDuration, time.Now())) > maxDuration:
+		return ds.cancelTimedOutQuery(ctx, asyncDB, q, maxDuration)
+	default:
+		ds.trackPoll(q.QueryID, asyncDB)
+	}
+	stats := queryStats(ctx, asyncDB, q.QueryID)
+	customMeta := queryMeta{QueryID: q.QueryID, Status: status.String(), Stats: stats}
 	if status != QueryFinished {
 		return data.Frames{
 			{Meta: &data.FrameMeta{
 				ExecutedQueryString: q.RawSQL,
-				Custom:              customMeta},
+				Custom:              customMeta,
+				Stats:               stats.frameStats()},
 			},
 		}, nil
 	}
 
-	dbConn, _ := ds.getDBConnection(defaultKey(datasourceUID))
+	if pager, ok := asyncDB.(RowsPager); ok {
+		if q.StreamResults {
+			if frames, ok := streamingFrames(datasourceUID, q, customMeta); ok {
+				return frames, nil
+			}
+		}
+		if pageSize := ds.pageSize(q); pageSize > 0 {
+			return ds.resultsPage(ctx, pager, q, pageSize, dbConn.settings, fillMode, customMeta)
+		}
+	}
+
 	db, err := ds.GetDBFromQuery(ctx, &q.Query)
 	if err != nil {
 		return getErrorFrameFromQuery(q), err
 	}
-	res, err := queryAsync(ctx, db, dbConn.settings, ds.driver.Converters(), fillMode, q, ds.GetRowLimit())
+	getRowsCtx, getRowsSpan := common.StartSpan(ctx, "awsds.GetRows", common.AttributeQueryID.String(q.QueryID))
+	res, err := queryAsync(getRowsCtx, db, asyncDB, ds.Retry, dbConn.settings, ds.driver.Converters(), fillMode, q, ds.GetRowLimit())
+	common.EndSpan(getRowsSpan, err)
 	if err == nil || errors.Is(err, sqlds.ErrorNoResults) {
 		if len(res) == 0 {
 			res = append(res, &data.Frame{})
 		}
+		if res[0].Meta == nil {
+			res[0].Meta = &data.FrameMeta{ExecutedQueryString: q.RawSQL}
+		}
 		res[0].Meta.Custom = customMeta
+		res[0].Meta.Stats = append(res[0].Meta.Stats, stats.frameStats()...)
+		if err == nil {
+			ds.cacheResult(datasourceUID, q, fillMode, res)
+		}
 		return res, nil
 	}
 
 	return getErrorFrameFromQuery(q), err
 }
 
-func queryAsync(ctx context.Context, conn *sql.DB, settings backend.DataSourceInstanceSettings, converters []sqlutil.Converter, fillMode *data.FillMissing, q *AsyncQuery, rowLimit int64) (data.Frames, error) {
+// queryAsync gets the complete results of q through conn, retrying the
+// transient errors of asyncDB, the connection q ran on, like the calls to
+// GetRowsPage are.
+func queryAsync(ctx context.Context, conn *sql.DB, asyncDB AsyncDB, retry RetryPolicy, settings backend.DataSourceInstanceSettings, converters []sqlutil.Converter, fillMode *data.FillMissing, q *AsyncQuery, rowLimit int64) (data.Frames, error) {
 	query := sqlds.NewQuery(conn, settings, converters, fillMode, rowLimit)
-	return query.Run(ctx, &q.Query, nil, sql.NamedArg{Name: "queryID", Value: q.QueryID})
+	return WithRetry(ctx, retry, asyncDB, func(ctx context.Context) (data.Frames, error) {
+		return query.Run(ctx, &q.Query, nil, sql.NamedArg{Name: "queryID", Value: q.QueryID})
+	})
 }
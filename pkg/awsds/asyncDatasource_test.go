@@ -8,12 +8,19 @@ import (
 	"sync"
 	"testing"
 
+	"github.com/grafana/grafana-plugin-sdk-go/data"
 	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
 
+	"github.com/grafana/grafana-aws-sdk/pkg/common"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
 	"github.com/grafana/sqlds/v5"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 type fakeAsyncDB struct{}
@@ -42,6 +49,14 @@ type fakeDriver struct {
 	AsyncDriver
 }
 
+func (d fakeDriver) Macros() sqlds.Macros {
+	return sqlds.Macros{}
+}
+
+func (d fakeDriver) Converters() []sqlutil.Converter {
+	return nil
+}
+
 func (d fakeDriver) GetAsyncDB(context.Context, backend.DataSourceInstanceSettings, json.RawMessage) (db AsyncDB, err error) {
 	return d.openDBfn()
 }
@@ -96,7 +111,7 @@ func Test_getDBConnectionFromQuery(t *testing.T) {
 				ds.storeDBConnection(key, dbConnection{tt.existingDB, settings})
 			}
 
-			dbConn, err := ds.getAsyncDBFromQuery(context.Background(), &AsyncQuery{Query: sqlutil.Query{ConnectionArgs: json.RawMessage(tt.args)}}, tt.dsUID)
+			dbConn, _, err := ds.getAsyncDBFromQuery(context.Background(), &AsyncQuery{Query: sqlutil.Query{ConnectionArgs: json.RawMessage(tt.args)}}, tt.dsUID)
 			if err != nil {
 				t.Fatalf("unexpected error %v", err)
 			}
@@ -313,3 +328,91 @@ func Test_QueryData_MalformedJSON_FallsBackToSync(t *testing.T) {
 	assert.NoError(t, err, "QueryData should not error when handling malformed JSON")
 	assert.True(t, syncCalled, "QueryData should fall back to sync flow when isAsyncFlow returns false due to malformed JSON")
 }
+
+func Test_QueryData_MixedBatch_RoutesEachQuery(t *testing.T) {
+	settings := &backend.DataSourceInstanceSettings{UID: "uid1"}
+	req := &backend.QueryDataRequest{
+		PluginContext: backend.PluginContext{DataSourceInstanceSettings: settings},
+		Queries: []backend.DataQuery{
+			{RefID: "A", JSON: []byte(`{"rawSql":"SELECT 1","meta":{"queryFlow":"async"}}`)},
+			{RefID: "B", JSON: []byte(`{"rawSql":"SELECT 2"}`)},
+			{RefID: "C", JSON: []byte(`{"rawSql":"SELECT 3","meta":{"queryFlow":"async"}}`)},
+		},
+	}
+
+	t.Run("sync and async responses are merged", func(t *testing.T) {
+		var syncRefIDs []string
+		ds := NewAsyncAWSDatasource(fakeDriver{})
+		ds.storeDBConnection(defaultKey("uid1"), dbConnection{slowAsyncDB{tracker: &concurrencyTracker{}}, *settings})
+		ds.sqldsQueryDataHandler = func(_ context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+			res := backend.NewQueryDataResponse()
+			for _, q := range req.Queries {
+				syncRefIDs = append(syncRefIDs, q.RefID)
+				res.Responses[q.RefID] = backend.DataResponse{Frames: data.Frames{data.NewFrame("sync")}}
+			}
+			return res, nil
+		}
+
+		res, err := ds.QueryData(context.Background(), req)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"B"}, syncRefIDs)
+		assert.Len(t, res.Responses, 3)
+		assert.Equal(t, "sync", res.Responses["B"].Frames[0].Name)
+		assert.Equal(t, queryMeta{QueryID: "id-SELECT 1", Status: "started"}, res.Responses["A"].Frames[0].Meta.Custom)
+		assert.Equal(t, queryMeta{QueryID: "id-SELECT 3", Status: "started"}, res.Responses["C"].Frames[0].Meta.Custom)
+	})
+
+	t.Run("a failing sync flow only fails the sync queries", func(t *testing.T) {
+		ds := NewAsyncAWSDatasource(fakeDriver{})
+		ds.storeDBConnection(defaultKey("uid1"), dbConnection{slowAsyncDB{tracker: &concurrencyTracker{}}, *settings})
+		ds.sqldsQueryDataHandler = func(context.Context, *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+			return nil, fmt.Errorf("sync flow failed")
+		}
+
+		res, err := ds.QueryData(context.Background(), req)
+		assert.NoError(t, err)
+		assert.ErrorContains(t, res.Responses["B"].Error, "sync flow failed")
+		assert.NoError(t, res.Responses["A"].Error)
+		assert.NoError(t, res.Responses["C"].Error)
+	})
+}
+
+func Test_handleAsyncQuery_spans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracing.InitDefaultTracer(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test"))
+	t.Cleanup(func() { tracing.InitDefaultTracer(otel.Tracer("test")) })
+
+	settings := backend.DataSourceInstanceSettings{UID: "uid1"}
+	db := new(MockDB)
+	db.On("GetQueryID", mock.Anything, "SELECT 1", mock.Anything).Return(false, "", nil)
+	db.On("StartQuery", mock.Anything, "SELECT 1", mock.Anything).Return("qid", nil)
+	db.On("QueryStatus", mock.Anything, "qid").Return(QueryRunning, nil)
+	ds := NewAsyncAWSDatasource(fakeDriver{})
+	ds.Retry = RetryPolicy{MaxAttempts: 1}
+	ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, settings})
+
+	for _, queryJSON := range []string{
+		`{"rawSql":"SELECT 1","meta":{"queryFlow":"async"}}`,
+		`{"rawSql":"SELECT 1","queryID":"qid","meta":{"queryFlow":"async"}}`,
+	} {
+		_, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			PluginContext: backend.PluginContext{DataSourceInstanceSettings: &settings},
+			Queries:       []backend.DataQuery{{RefID: "A", JSON: []byte(queryJSON)}},
+		})
+		require.NoError(t, err)
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	require.Contains(t, spans, "awsds.handleAsyncQuery")
+	require.Contains(t, spans, "awsds.StartQuery")
+	require.Contains(t, spans, "awsds.QueryStatus")
+	handle := spans["awsds.handleAsyncQuery"]
+	assert.Contains(t, handle.Attributes(), common.AttributeDatasourceUID.String("uid1"))
+	assert.Contains(t, handle.Attributes(), common.AttributeQueryID.String("qid"))
+	assert.Contains(t, spans["awsds.StartQuery"].Attributes(), common.AttributeQueryID.String("qid"))
+	assert.Contains(t, spans["awsds.QueryStatus"].Attributes(), common.AttributeQueryStatus.String(QueryRunning.String()))
+	assert.Equal(t, handle.SpanContext().SpanID(), spans["awsds.QueryStatus"].Parent().SpanID(), "status span is a child of the query span")
+}
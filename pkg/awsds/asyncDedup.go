@@ -0,0 +1,258 @@
+package awsds
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-aws-sdk/pkg/common"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+const (
+	// startSharedQueryTimeout bounds the start of a shared query, retries
+	// included. The start does not depend on the request that triggered it,
+	// which may be cancelled while other requests wait for the query.
+	startSharedQueryTimeout = 2 * time.Minute
+
+	// maxSharedQueryAge is how long a started query is remembered at most
+	// when it is neither polled to completion nor cancelled, as happens when
+	// the dashboards that started it are closed. The start times and audited
+	// statuses of queries are bounded by it too.
+	maxSharedQueryAge = 24 * time.Hour
+)
+
+// sharedQuery is an async query started on behalf of every request that asked
+// for the same SQL while it was being started. refs counts those requests.
+type sharedQuery struct {
+	key     string
+	db      AsyncDB
+	done    chan struct{}
+	queryID string
+	err     error
+	started time.Time
+	refs    int
+	// stopWaiting gives up waiting for a slot of the concurrency limiter
+	stopWaiting context.CancelFunc
+	// releaseSlot frees the slot of the concurrency limiter the query holds
+	// until it ends
+	releaseSlot func()
+}
+
+// sharedQueries deduplicates identical async queries across requests, so ten
+// panels running the same SQL at the same time share one query and its
+// results. A query is only shared while it is being started: requests arriving
+// once it has started run a new query, so they never get stale results.
+type sharedQueries struct {
+	mu sync.Mutex
+	// byKey holds the queries being started
+	byKey map[string]*sharedQuery
+	// byID holds the started queries until they end, are cancelled or are
+	// older than maxSharedQueryAge
+	byID map[string]*sharedQuery
+}
+
+// sharedQueryKey identifies identical queries: same datasource, connection
+// args, interpolated SQL and max execution duration.
+func sharedQueryKey(datasourceUID string, q *AsyncQuery) string {
+	key, _ := json.Marshal(struct {
+		DatasourceUID        string `json:"datasourceUID"`
+		ConnectionArgs       string `json:"connectionArgs,omitempty"`
+		RawSQL               string `json:"rawSql"`
+		MaxExecutionDuration string `json:"maxExecutionDuration,omitempty"`
+	}{datasourceUID, common.JSONKey(q.ConnectionArgs), q.RawSQL, q.MaxExecutionDuration})
+	return string(key)
+}
+
+// start returns the ID of the query for key, calling startFn only if no
+// identical query is being started. Callers arriving while startFn runs wait
+// for its result. startFn runs apart from ctx, so a caller that goes away does
+// not fail the others; a query every caller went away from is cancelled once
+// started.
+//
+// startFn is only called once limiter has a free slot. With holdSlot the
+// query holds the slot until it is finished, released by its last request or
+// forgotten; otherwise the slot is freed as soon as the query has started.
+func (s *sharedQueries) start(ctx context.Context, key string, db AsyncDB, limiter *queryLimiter, holdSlot bool, startFn func(context.Context) (string, error)) (string, error) {
+	s.mu.Lock()
+	if s.byKey == nil {
+		s.byKey = map[string]*sharedQuery{}
+		s.byID = map[string]*sharedQuery{}
+	}
+	q, ok := s.byKey[key]
+	if ok {
+		q.refs++
+	} else {
+		var waitCtx context.Context
+		q = &sharedQuery{key: key, db: db, done: make(chan struct{}), refs: 1}
+		waitCtx, q.stopWaiting = context.WithCancel(context.WithoutCancel(ctx))
+		s.byKey[key] = q
+		go s.run(ctx, waitCtx, q, limiter, holdSlot, startFn)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-q.done:
+		return q.queryID, q.err
+	case <-ctx.Done():
+		s.leave(ctx, q)
+		return "", ctx.Err()
+	}
+}
+
+// run starts q with startFn once limiter has a free slot and wakes up the
+// callers waiting for it. Waiting for the slot stops with waitCtx.
+func (s *sharedQueries) run(ctx, waitCtx context.Context, q *sharedQuery, limiter *queryLimiter, holdSlot bool, startFn func(context.Context) (string, error)) {
+	var (
+		queryID     string
+		err         error
+		releaseSlot func()
+	)
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic caught while starting query: %v", r)
+		}
+		q.stopWaiting()
+		s.mu.Lock()
+		q.queryID, q.err = queryID, err
+		if s.byKey[q.key] == q {
+			delete(s.byKey, q.key)
+		}
+		orphaned, held := false, false
+		if err == nil {
+			q.started = time.Now()
+			s.expire(q.started.Add(-maxSharedQueryAge))
+			if orphaned = q.refs == 0; !orphaned {
+				if held = holdSlot; held {
+					q.releaseSlot = releaseSlot
+				}
+				s.byID[queryID] = q
+			}
+		}
+		s.mu.Unlock()
+		close(q.done)
+		if orphaned {
+			cancelOrphanedQuery(ctx, q)
+		}
+		if releaseSlot != nil && !held {
+			releaseSlot()
+		}
+	}()
+
+	releaseSlot, err = limiter.acquire(waitCtx)
+	if err != nil {
+		return
+	}
+	startCtx, cancel := common.DetachedContext(ctx, startSharedQueryTimeout)
+	defer cancel()
+	queryID, err = startFn(startCtx)
+}
+
+// leave drops the reference of a caller that stopped waiting for q. A query
+// nobody waits for anymore is cancelled if it has started, and not started
+// otherwise.
+func (s *sharedQueries) leave(ctx context.Context, q *sharedQuery) {
+	s.mu.Lock()
+	q.refs--
+	abandoned := q.refs == 0
+	orphaned := abandoned && !q.started.IsZero()
+	if abandoned {
+		s.remove(q)
+	}
+	s.mu.Unlock()
+	if orphaned {
+		cancelOrphanedQuery(ctx, q)
+	} else if abandoned {
+		q.stopWaiting()
+	}
+}
+
+// cancelOrphanedQuery cancels q, which was started for requests that have all
+// gone away since.
+func cancelOrphanedQuery(ctx context.Context, q *sharedQuery) {
+	ctx, cancel := common.DetachedContext(ctx, cancelIdleQueryTimeout)
+	defer cancel()
+	backend.Logger.FromContext(ctx).Info("Cancelling async query that no request waits for anymore", "queryID", q.queryID)
+	if err := q.db.CancelQuery(ctx, q.queryID); err != nil {
+		backend.Logger.FromContext(ctx).Warn("Could not cancel async query that no request waits for anymore", "queryID", q.queryID, "error", err)
+		return
+	}
+	asyncQueriesMetric.WithLabelValues(QueryCanceled.String()).Inc()
+}
+
+// expire forgets the queries started before deadline. s.mu must be held.
+func (s *sharedQueries) expire(deadline time.Time) {
+	for _, q := range s.byID {
+		if q.started.Before(deadline) {
+			s.remove(q)
+		}
+	}
+}
+
+// finish stops tracking queryID once it has completed or was cancelled.
+// Requests already polling it are unaffected. It returns false if queryID was
+// not tracked, e.g. because it was finished already.
+func (s *sharedQueries) finish(queryID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q, ok := s.byID[queryID]
+	if ok {
+		s.remove(q)
+	}
+	return ok
+}
+
+// release drops one reference to queryID and reports whether it was the last
+// one, i.e. whether the query can be cancelled. Queries that are not shared
+// have a single reference. The query's connection is returned when known.
+func (s *sharedQueries) release(queryID string) (bool, AsyncDB) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q, ok := s.byID[queryID]
+	if !ok {
+		return true, nil
+	}
+	q.refs--
+	if q.refs > 0 {
+		return false, q.db
+	}
+	s.remove(q)
+	return true, q.db
+}
+
+// remove forgets q and frees its slot of the concurrency limiter. s.mu must
+// be held.
+func (s *sharedQueries) remove(q *sharedQuery) {
+	if s.byKey[q.key] == q {
+		delete(s.byKey, q.key)
+	}
+	if s.byID[q.queryID] == q {
+		delete(s.byID, q.queryID)
+	}
+	if q.releaseSlot != nil {
+		q.releaseSlot()
+	}
+}
+
+// CancelAsyncQuery cancels queryID on behalf of one of the requests sharing
+// it. The query keeps running until every request sharing it has cancelled,
+// so plugins should route user cancellations through this method.
+func (ds *AsyncAWSDatasource) CancelAsyncQuery(ctx context.Context, datasourceUID string, queryID string) error {
+	last, db := ds.sharedQueries.release(queryID)
+	if !last {
+		return nil
+	}
+	ds.forgetQuery(queryID)
+	asyncQueriesMetric.WithLabelValues(QueryCanceled.String()).Inc()
+	ds.auditedQueries.forget(queryID)
+	if db == nil {
+		dbConn, err := ds.defaultDBConnection(ctx, datasourceUID)
+		if err != nil {
+			return err
+		}
+		db = dbConn.db
+	}
+	return db.CancelQuery(ctx, queryID)
+}
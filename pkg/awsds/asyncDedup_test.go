@@ -0,0 +1,327 @@
+package awsds
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_sharedQueryKey(t *testing.T) {
+	key := sharedQueryKey("uid1", &AsyncQuery{Query: sqlutil.Query{RawSQL: "SELECT 1"}})
+	assert.Equal(t, key, sharedQueryKey("uid1", &AsyncQuery{Query: sqlutil.Query{RawSQL: "SELECT 1", RefID: "B"}}))
+	assert.NotEqual(t, key, sharedQueryKey("uid2", &AsyncQuery{Query: sqlutil.Query{RawSQL: "SELECT 1"}}))
+	assert.NotEqual(t, key, sharedQueryKey("uid1", &AsyncQuery{Query: sqlutil.Query{RawSQL: "SELECT 2"}}))
+	assert.NotEqual(t, key, sharedQueryKey("uid1", &AsyncQuery{Query: sqlutil.Query{RawSQL: "SELECT 1", ConnectionArgs: json.RawMessage(`{"db":"other"}`)}}))
+	assert.NotEqual(t, key, sharedQueryKey("uid1", &AsyncQuery{Query: sqlutil.Query{RawSQL: "SELECT 1"}, MaxExecutionDuration: "5m"}))
+
+	withArgs := sharedQueryKey("uid1", &AsyncQuery{Query: sqlutil.Query{RawSQL: "SELECT 1", ConnectionArgs: json.RawMessage(`{"db":"other","region":"eu-west-1"}`)}})
+	assert.Equal(t, withArgs, sharedQueryKey("uid1", &AsyncQuery{Query: sqlutil.Query{RawSQL: "SELECT 1", ConnectionArgs: json.RawMessage(`{ "region": "eu-west-1", "db": "other" }`)}}))
+}
+
+func Test_sharedQueries(t *testing.T) {
+	t.Run("concurrent identical queries share one start", func(t *testing.T) {
+		var s sharedQueries
+		var starts atomic.Int32
+		release := make(chan struct{})
+		startFn := func(context.Context) (string, error) {
+			starts.Add(1)
+			<-release
+			return "qid", nil
+		}
+
+		var wg sync.WaitGroup
+		ids := make([]string, 10)
+		for i := range ids {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ids[i], _ = s.start(context.Background(), "key", nil, nil, true, startFn)
+			}()
+		}
+		require.Eventually(t, func() bool {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			q, ok := s.byKey["key"]
+			return ok && q.refs == 10
+		}, time.Second, time.Millisecond)
+		close(release)
+		wg.Wait()
+
+		assert.Equal(t, int32(1), starts.Load())
+		for _, id := range ids {
+			assert.Equal(t, "qid", id)
+		}
+
+		for range 9 {
+			last, _ := s.release("qid")
+			assert.False(t, last)
+		}
+		last, _ := s.release("qid")
+		assert.True(t, last)
+	})
+
+	t.Run("a finished query is not shared anymore", func(t *testing.T) {
+		var s sharedQueries
+		next := 0
+		startFn := func(context.Context) (string, error) {
+			next++
+			return []string{"first", "second"}[next-1], nil
+		}
+		id, err := s.start(context.Background(), "key", nil, nil, true, startFn)
+		require.NoError(t, err)
+		assert.Equal(t, "first", id)
+
+		s.finish("first")
+		id, err = s.start(context.Background(), "key", nil, nil, true, startFn)
+		require.NoError(t, err)
+		assert.Equal(t, "second", id)
+	})
+
+	t.Run("a failed start is not shared", func(t *testing.T) {
+		var s sharedQueries
+		_, err := s.start(context.Background(), "key", nil, nil, true, func(context.Context) (string, error) {
+			return "", assert.AnError
+		})
+		assert.ErrorIs(t, err, assert.AnError)
+		id, err := s.start(context.Background(), "key", nil, nil, true, func(context.Context) (string, error) {
+			return "qid", nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, "qid", id)
+	})
+
+	t.Run("identical queries sent one after another are not shared", func(t *testing.T) {
+		var s sharedQueries
+		var starts atomic.Int32
+		startFn := func(context.Context) (string, error) {
+			return fmt.Sprintf("qid-%d", starts.Add(1)), nil
+		}
+		first, err := s.start(context.Background(), "key", nil, nil, true, startFn)
+		require.NoError(t, err)
+		second, err := s.start(context.Background(), "key", nil, nil, true, startFn)
+		require.NoError(t, err)
+
+		assert.Equal(t, "qid-1", first)
+		assert.Equal(t, "qid-2", second)
+	})
+
+	t.Run("a caller going away does not fail the others", func(t *testing.T) {
+		var s sharedQueries
+		release := make(chan struct{})
+		startFn := func(ctx context.Context) (string, error) {
+			<-release
+			return "qid", ctx.Err()
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		firstErr := make(chan error)
+		go func() {
+			_, err := s.start(ctx, "key", nil, nil, true, startFn)
+			firstErr <- err
+		}()
+		require.Eventually(t, func() bool {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return s.byKey["key"] != nil
+		}, time.Second, time.Millisecond)
+		second := make(chan string)
+		go func() {
+			id, _ := s.start(context.Background(), "key", nil, nil, true, startFn)
+			second <- id
+		}()
+		require.Eventually(t, func() bool {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return s.byKey["key"].refs == 2
+		}, time.Second, time.Millisecond)
+
+		cancel()
+		assert.ErrorIs(t, <-firstErr, context.Canceled)
+		close(release)
+		assert.Equal(t, "qid", <-second)
+
+		last, _ := s.release("qid")
+		assert.True(t, last, "the caller that went away does not hold a reference")
+	})
+
+	t.Run("a query every caller went away from is cancelled once started", func(t *testing.T) {
+		var s sharedQueries
+		db := new(MockDB)
+		cancelled := make(chan struct{})
+		db.On("CancelQuery", mock.Anything, "qid").Run(func(mock.Arguments) { close(cancelled) }).Return(nil).Once()
+		release := make(chan struct{})
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := s.start(ctx, "key", db, nil, true, func(context.Context) (string, error) {
+			<-release
+			return "qid", nil
+		})
+		assert.ErrorIs(t, err, context.Canceled)
+
+		close(release)
+		<-cancelled
+		db.AssertExpectations(t)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		assert.Empty(t, s.byID)
+	})
+
+	t.Run("queries are forgotten after a while", func(t *testing.T) {
+		var s sharedQueries
+		_, err := s.start(context.Background(), "old", nil, nil, true, func(context.Context) (string, error) { return "old", nil })
+		require.NoError(t, err)
+		s.mu.Lock()
+		s.byID["old"].started = time.Now().Add(-maxSharedQueryAge - time.Minute)
+		s.mu.Unlock()
+
+		_, err = s.start(context.Background(), "new", nil, nil, true, func(context.Context) (string, error) { return "new", nil })
+		require.NoError(t, err)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		assert.NotContains(t, s.byID, "old")
+		assert.Contains(t, s.byID, "new")
+	})
+
+	t.Run("a query waits for a free slot until every caller went away", func(t *testing.T) {
+		var s sharedQueries
+		limiter := newQueryLimiter("dedup-test", 1)
+		releaseFirst, err := limiter.acquire(context.Background())
+		require.NoError(t, err)
+		defer releaseFirst()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err = s.start(ctx, "key", nil, limiter, true, func(context.Context) (string, error) {
+			t.Error("the query should not start without a free slot")
+			return "qid", nil
+		})
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Eventually(t, func() bool {
+			return testutil.ToFloat64(queuedQueriesMetric.WithLabelValues("dedup-test")) == 0
+		}, time.Second, time.Millisecond, "the query does not wait for a slot anymore")
+	})
+
+	t.Run("a started query holds its slot until it is finished", func(t *testing.T) {
+		var s sharedQueries
+		limiter := newQueryLimiter("dedup-test", 1)
+		_, err := s.start(context.Background(), "key", nil, limiter, true, func(context.Context) (string, error) { return "qid", nil })
+		require.NoError(t, err)
+		assert.Len(t, limiter.slots, 1)
+		assert.True(t, s.finish("qid"))
+		assert.Empty(t, limiter.slots)
+		assert.False(t, s.finish("qid"))
+	})
+
+	t.Run("a started query frees its slot right away unless it holds it", func(t *testing.T) {
+		var s sharedQueries
+		limiter := newQueryLimiter("dedup-test", 1)
+		_, err := s.start(context.Background(), "key", nil, limiter, false, func(context.Context) (string, error) { return "qid", nil })
+		require.NoError(t, err)
+		assert.Empty(t, limiter.slots)
+		assert.True(t, s.finish("qid"), "the query is still tracked")
+	})
+
+	t.Run("unknown queries can always be cancelled", func(t *testing.T) {
+		var s sharedQueries
+		last, db := s.release("unknown")
+		assert.True(t, last)
+		assert.Nil(t, db)
+	})
+}
+
+func Test_handleAsyncQuery_sharesIdenticalQueries(t *testing.T) {
+	settings := backend.DataSourceInstanceSettings{UID: "uid1", JSONData: []byte(`{"asyncQueryMaxExecutionDuration":"10m"}`)}
+	start := backend.DataQuery{RefID: "A", JSON: []byte(`{"rawSql":"SELECT 1","meta":{"queryFlow":"async"}}`)}
+	poll := backend.DataQuery{RefID: "A", JSON: []byte(`{"rawSql":"SELECT 1","queryID":"qid","meta":{"queryFlow":"async"}}`)}
+
+	release := make(chan struct{})
+	db := new(MockDB)
+	db.On("GetQueryID", mock.Anything, "SELECT 1", mock.Anything).Return(false, "", nil).Once()
+	db.On("StartQuery", mock.Anything, "SELECT 1", mock.Anything).Run(func(mock.Arguments) { <-release }).Return("qid", nil).Once()
+	db.On("QueryStatus", mock.Anything, "qid").Return(QueryRunning, nil)
+	db.On("CancelQuery", mock.Anything, "qid").Return(nil).Once()
+	ds := NewAsyncAWSDatasource(fakeDriver{})
+	ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, settings})
+
+	var wg sync.WaitGroup
+	for _, refID := range []string{"A", "B"} {
+		wg.Add(1)
+		go func(query backend.DataQuery) {
+			defer wg.Done()
+			query.RefID = refID
+			frames, err := ds.handleAsyncQuery(context.Background(), query, "uid1")
+			assert.NoError(t, err)
+			assert.Equal(t, queryMeta{QueryID: "qid", Status: "started"}, frames[0].Meta.Custom)
+		}(start)
+	}
+	require.Eventually(t, func() bool {
+		ds.sharedQueries.mu.Lock()
+		defer ds.sharedQueries.mu.Unlock()
+		q, ok := ds.sharedQueries.byKey[sharedQueryKey("uid1", &AsyncQuery{Query: sqlutil.Query{RawSQL: "SELECT 1"}})]
+		return ok && q.refs == 2
+	}, time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+	db.AssertNumberOfCalls(t, "StartQuery", 1)
+
+	// both requests share the deadline of the query: the first poll past it
+	// cancels the query for both, however often each of them polls
+	ds.queryStartTimes.queries["qid"] = queryStart{started: time.Now().Add(-time.Hour), maxDuration: 10 * time.Minute}
+	for range 3 {
+		frames, err := ds.handleAsyncQuery(context.Background(), poll, "uid1")
+		require.NoError(t, err)
+		assert.Equal(t, queryMeta{QueryID: "qid", Status: "timeout"}, frames[0].Meta.Custom)
+		assert.Contains(t, frames[0].Meta.Notices[0].Text, "Query was cancelled")
+	}
+	db.AssertNumberOfCalls(t, "CancelQuery", 1)
+	assert.False(t, ds.sharedQueries.finish("qid"), "the timed out query is not shared anymore")
+}
+
+func TestAsyncAWSDatasource_CancelAsyncQuery(t *testing.T) {
+	db := new(MockDB)
+	db.On("CancelQuery", mock.Anything, "qid").Return(nil)
+	ds := NewAsyncAWSDatasource(fakeDriver{})
+	ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, backend.DataSourceInstanceSettings{UID: "uid1"}})
+
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := ds.sharedQueries.start(context.Background(), "key", db, nil, true, func(context.Context) (string, error) {
+				<-release
+				return "qid", nil
+			})
+			assert.NoError(t, err)
+		}()
+	}
+	require.Eventually(t, func() bool {
+		ds.sharedQueries.mu.Lock()
+		defer ds.sharedQueries.mu.Unlock()
+		q, ok := ds.sharedQueries.byKey["key"]
+		return ok && q.refs == 2
+	}, time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	require.NoError(t, ds.CancelAsyncQuery(context.Background(), "uid1", "qid"))
+	db.AssertNotCalled(t, "CancelQuery", mock.Anything, mock.Anything)
+	require.NoError(t, ds.CancelAsyncQuery(context.Background(), "uid1", "qid"))
+	db.AssertNumberOfCalls(t, "CancelQuery", 1)
+
+	t.Run("untracked queries are cancelled on the default connection", func(t *testing.T) {
+		require.NoError(t, ds.CancelAsyncQuery(context.Background(), "uid1", "qid"))
+		db.AssertNumberOfCalls(t, "CancelQuery", 2)
+	})
+}
@@ -0,0 +1,138 @@
+package awsds
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/sqlds/v5"
+)
+
+// MaxConcurrentQueriesSettingKey is the datasource JSON data key holding the
+// maximum number of queries of a datasource that run at the same time
+const MaxConcurrentQueriesSettingKey = "maxConcurrentQueries"
+
+// queryLimiter bounds how many queries of one datasource run at the same time.
+// Queries over the limit wait, in no particular order, until a slot is free
+// or their request is cancelled.
+type queryLimiter struct {
+	datasourceUID string
+	limit         int
+	slots         chan struct{}
+}
+
+func newQueryLimiter(datasourceUID string, limit int) *queryLimiter {
+	return &queryLimiter{datasourceUID: datasourceUID, limit: limit, slots: make(chan struct{}, limit)}
+}
+
+// acquire waits for a free slot and returns the function releasing it. A nil
+// limiter does not limit anything.
+func (l *queryLimiter) acquire(ctx context.Context) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	queued := queuedQueriesMetric.WithLabelValues(l.datasourceUID)
+	running := runningQueriesMetric.WithLabelValues(l.datasourceUID)
+
+	queued.Inc()
+	select {
+	case l.slots <- struct{}{}:
+		queued.Dec()
+	case <-ctx.Done():
+		queued.Dec()
+		return nil, ctx.Err()
+	}
+	running.Inc()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-l.slots
+			running.Dec()
+		})
+	}, nil
+}
+
+// queryLimiters holds the limiter of each datasource.
+type queryLimiters struct {
+	mu    sync.Mutex
+	byUID map[string]*queryLimiter
+}
+
+// get returns the limiter of datasourceUID for limit, replacing it when the
+// limit changed. It returns nil when limit is not positive.
+func (l *queryLimiters) get(datasourceUID string, limit int) *queryLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.byUID == nil {
+		l.byUID = map[string]*queryLimiter{}
+	}
+	limiter, ok := l.byUID[datasourceUID]
+	if !ok || limiter.limit != limit {
+		limiter = newQueryLimiter(datasourceUID, limit)
+		l.byUID[datasourceUID] = limiter
+	}
+	return limiter
+}
+
+type maxConcurrentQueriesSettings struct {
+	MaxConcurrentQueries *int `json:"maxConcurrentQueries"`
+}
+
+// queryLimiter returns the limiter for the datasource of settings. The
+// datasource setting takes precedence over ds.MaxConcurrentQueries.
+func (ds *AsyncAWSDatasource) queryLimiter(ctx context.Context, settings *backend.DataSourceInstanceSettings) *queryLimiter {
+	if settings == nil {
+		return nil
+	}
+	limit := ds.MaxConcurrentQueries
+	if len(settings.JSONData) > 1 {
+		var s maxConcurrentQueriesSettings
+		if err := json.Unmarshal(settings.JSONData, &s); err != nil {
+			backend.Logger.FromContext(ctx).Warn("Could not read max concurrent queries setting", "error", err)
+		} else if s.MaxConcurrentQueries != nil {
+			limit = *s.MaxConcurrentQueries
+		}
+	}
+	return ds.queryLimiters.get(getDatasourceUID(*settings), limit)
+}
+
+// limitedSyncQueryData runs each query of req through the synchronous flow on
+// its own, so no more of them run at the same time than limiter allows.
+func (ds *AsyncAWSDatasource) limitedSyncQueryData(ctx context.Context, req *backend.QueryDataRequest, limiter *queryLimiter) (*backend.QueryDataResponse, error) {
+	var (
+		response = sqlds.NewResponse(backend.NewQueryDataResponse())
+		wg       = sync.WaitGroup{}
+	)
+	for _, q := range req.Queries {
+		wg.Add(1)
+		go func(query backend.DataQuery) {
+			defer wg.Done()
+			release, err := limiter.acquire(ctx)
+			if err != nil {
+				response.Set(query.RefID, backend.ErrorResponseWithErrorSource(err))
+				return
+			}
+			defer release()
+
+			single := *req
+			single.Queries = []backend.DataQuery{query}
+			res, err := ds.sqldsQueryDataHandler.QueryData(ctx, &single)
+			if err != nil {
+				response.Set(query.RefID, backend.ErrorResponseWithErrorSource(err))
+				return
+			}
+			if res == nil {
+				return
+			}
+			for refID, r := range res.Responses {
+				response.Set(refID, r)
+			}
+		}(q)
+	}
+	wg.Wait()
+	return response.Response(), nil
+}
@@ -0,0 +1,222 @@
+package awsds
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_queryLimiter(t *testing.T) {
+	l := newQueryLimiter("limiter-test", 2)
+	running := runningQueriesMetric.WithLabelValues("limiter-test")
+	queued := queuedQueriesMetric.WithLabelValues("limiter-test")
+
+	first, err := l.acquire(context.Background())
+	require.NoError(t, err)
+	second, err := l.acquire(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, float64(2), testutil.ToFloat64(running))
+
+	acquired := make(chan func())
+	go func() {
+		release, _ := l.acquire(context.Background())
+		acquired <- release
+	}()
+	require.Eventually(t, func() bool { return testutil.ToFloat64(queued) == 1 }, time.Second, time.Millisecond)
+	select {
+	case <-acquired:
+		t.Fatal("a third query should wait for a free slot")
+	default:
+	}
+
+	first()
+	first() // releasing twice frees a single slot
+	third := <-acquired
+	assert.Equal(t, float64(0), testutil.ToFloat64(queued))
+	assert.Equal(t, float64(2), testutil.ToFloat64(running))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = l.acquire(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, float64(0), testutil.ToFloat64(queued))
+
+	second()
+	third()
+	assert.Equal(t, float64(0), testutil.ToFloat64(running))
+
+	var unlimited *queryLimiter
+	release, err := unlimited.acquire(context.Background())
+	require.NoError(t, err)
+	release()
+}
+
+func Test_queryLimiters(t *testing.T) {
+	var l queryLimiters
+	assert.Nil(t, l.get("uid1", 0))
+	limiter := l.get("uid1", 2)
+	assert.Same(t, limiter, l.get("uid1", 2))
+	assert.NotSame(t, limiter, l.get("uid2", 2))
+	changed := l.get("uid1", 3)
+	assert.NotSame(t, limiter, changed)
+	assert.Equal(t, 3, cap(changed.slots))
+}
+
+func TestAsyncAWSDatasource_queryLimiter(t *testing.T) {
+	ds := &AsyncAWSDatasource{MaxConcurrentQueries: 4}
+	assert.Nil(t, ds.queryLimiter(context.Background(), nil))
+	assert.Equal(t, 4, ds.queryLimiter(context.Background(), &backend.DataSourceInstanceSettings{UID: "uid1"}).limit)
+	assert.Equal(t, 2, ds.queryLimiter(context.Background(), &backend.DataSourceInstanceSettings{UID: "uid1", JSONData: []byte(`{"maxConcurrentQueries":2}`)}).limit)
+	assert.Nil(t, ds.queryLimiter(context.Background(), &backend.DataSourceInstanceSettings{UID: "uid1", JSONData: []byte(`{"maxConcurrentQueries":0}`)}))
+}
+
+// concurrencyTracker records the highest number of calls running at once.
+type concurrencyTracker struct {
+	current atomic.Int32
+	max     atomic.Int32
+}
+
+func (c *concurrencyTracker) run() {
+	n := c.current.Add(1)
+	for {
+		m := c.max.Load()
+		if n <= m || c.max.CompareAndSwap(m, n) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	c.current.Add(-1)
+}
+
+// slowAsyncDB starts queries slowly, tracking how many start at once.
+type slowAsyncDB struct {
+	fakeAsyncDB
+	tracker *concurrencyTracker
+}
+
+func (db slowAsyncDB) StartQuery(_ context.Context, query string, _ ...interface{}) (string, error) {
+	db.tracker.run()
+	return "id-" + query, nil
+}
+
+func TestAsyncAWSDatasource_QueryData_limitsConcurrency(t *testing.T) {
+	settings := &backend.DataSourceInstanceSettings{UID: "limited", JSONData: []byte(`{"maxConcurrentQueries":2}`)}
+
+	t.Run("async flow", func(t *testing.T) {
+		db := new(MockDB)
+		db.On("GetQueryID", mock.Anything, mock.Anything, mock.Anything).Return(false, "", nil)
+		for i := 1; i <= 3; i++ {
+			db.On("StartQuery", mock.Anything, fmt.Sprintf("SELECT %d", i), mock.Anything).Return(fmt.Sprintf("qid-%d", i), nil).Once()
+		}
+		db.On("QueryStatus", mock.Anything, "qid-1").Return(QueryFailed, nil)
+		db.On("CancelQuery", mock.Anything, mock.Anything).Return(nil)
+		ds := NewAsyncAWSDatasource(fakeDriver{})
+		ds.QueryIdleTimeout = time.Hour
+		t.Cleanup(ds.idleQueries.shutdown)
+		ds.storeDBConnection(defaultKey("limited"), dbConnection{db, *settings})
+		running := runningQueriesMetric.WithLabelValues("limited")
+		queued := queuedQueriesMetric.WithLabelValues("limited")
+		runningBefore := testutil.ToFloat64(running)
+
+		queryData := func(queryJSON string) queryMeta {
+			res, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+				PluginContext: backend.PluginContext{DataSourceInstanceSettings: settings},
+				Queries:       []backend.DataQuery{{RefID: "A", JSON: []byte(queryJSON)}},
+			})
+			require.NoError(t, err)
+			require.NoError(t, res.Responses["A"].Error)
+			return res.Responses["A"].Frames[0].Meta.Custom.(queryMeta)
+		}
+
+		assert.Equal(t, "qid-1", queryData(`{"rawSql":"SELECT 1","meta":{"queryFlow":"async"}}`).QueryID)
+		assert.Equal(t, "qid-2", queryData(`{"rawSql":"SELECT 2","meta":{"queryFlow":"async"}}`).QueryID)
+		assert.Equal(t, float64(2), testutil.ToFloat64(running)-runningBefore, "started queries hold their slot")
+
+		third := make(chan queryMeta)
+		go func() {
+			third <- queryData(`{"rawSql":"SELECT 3","meta":{"queryFlow":"async"}}`)
+		}()
+		require.Eventually(t, func() bool { return testutil.ToFloat64(queued) == 1 }, time.Second, time.Millisecond)
+		select {
+		case <-third:
+			t.Fatal("a third query should wait for a running query to end")
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		assert.Equal(t, "failed", queryData(`{"rawSql":"SELECT 1","queryID":"qid-1","meta":{"queryFlow":"async"}}`).Status)
+		assert.Equal(t, "qid-3", (<-third).QueryID, "the slot of an ended query is free again")
+		assert.Equal(t, float64(2), testutil.ToFloat64(running)-runningBefore)
+
+		require.NoError(t, ds.CancelAsyncQuery(context.Background(), "limited", "qid-2"))
+		assert.Equal(t, float64(1), testutil.ToFloat64(running)-runningBefore, "the slot of a cancelled query is free again")
+		require.NoError(t, ds.CancelAsyncQuery(context.Background(), "limited", "qid-3"))
+		assert.Equal(t, float64(0), testutil.ToFloat64(running)-runningBefore)
+	})
+
+	t.Run("abandoned queries", func(t *testing.T) {
+		settings := &backend.DataSourceInstanceSettings{UID: "abandoned", JSONData: []byte(`{"maxConcurrentQueries":1}`)}
+		for _, idleTimeout := range []time.Duration{0, time.Hour} {
+			db := new(MockDB)
+			db.On("GetQueryID", mock.Anything, mock.Anything, mock.Anything).Return(false, "", nil)
+			db.On("StartQuery", mock.Anything, "SELECT 1", mock.Anything).Return("qid-1", nil).Once()
+			db.On("StartQuery", mock.Anything, "SELECT 2", mock.Anything).Return("qid-2", nil).Once()
+			db.On("CancelQuery", mock.Anything, mock.Anything).Return(nil)
+			ds := NewAsyncAWSDatasource(fakeDriver{})
+			ds.QueryIdleTimeout = idleTimeout
+			t.Cleanup(ds.idleQueries.shutdown)
+			ds.storeDBConnection(defaultKey("abandoned"), dbConnection{db, *settings})
+			queryData := func(queryJSON string) error {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+				res, err := ds.QueryData(ctx, &backend.QueryDataRequest{
+					PluginContext: backend.PluginContext{DataSourceInstanceSettings: settings},
+					Queries:       []backend.DataQuery{{RefID: "A", JSON: []byte(queryJSON)}},
+				})
+				require.NoError(t, err)
+				return res.Responses["A"].Error
+			}
+
+			// the dashboard running SELECT 1 is closed before it polls the query
+			require.NoError(t, queryData(`{"rawSql":"SELECT 1","meta":{"queryFlow":"async"}}`))
+			if idleTimeout > 0 {
+				ds.reapIdleQueries(time.Now().Add(2 * idleTimeout))
+			}
+			assert.NoError(t, queryData(`{"rawSql":"SELECT 2","meta":{"queryFlow":"async"}}`), "idle timeout %v", idleTimeout)
+			ds.sharedQueries.finish("qid-2")
+		}
+	})
+
+	t.Run("sync flow", func(t *testing.T) {
+		tracker := &concurrencyTracker{}
+		var mu sync.Mutex
+		var batchSizes []int
+		ds := &AsyncAWSDatasource{sqldsQueryDataHandler: func(_ context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+			mu.Lock()
+			batchSizes = append(batchSizes, len(req.Queries))
+			mu.Unlock()
+			tracker.run()
+			res := backend.NewQueryDataResponse()
+			res.Responses[req.Queries[0].RefID] = backend.DataResponse{}
+			return res, nil
+		}}
+
+		req := &backend.QueryDataRequest{PluginContext: backend.PluginContext{DataSourceInstanceSettings: settings}}
+		for i := range 8 {
+			req.Queries = append(req.Queries, backend.DataQuery{RefID: fmt.Sprintf("%d", i), JSON: []byte(`{"rawSql":"SELECT 1"}`)})
+		}
+		res, err := ds.QueryData(context.Background(), req)
+		require.NoError(t, err)
+		assert.Len(t, res.Responses, 8)
+		assert.Equal(t, []int{1, 1, 1, 1, 1, 1, 1, 1}, batchSizes)
+		assert.LessOrEqual(t, tracker.max.Load(), int32(2))
+	})
+}
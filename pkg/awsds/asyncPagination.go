@@ -0,0 +1,116 @@
+package awsds
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+
+	"github.com/grafana/grafana-aws-sdk/pkg/common"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+	"github.com/grafana/sqlds/v5"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// pageSize returns how many rows of the results of q to return at a time,
+// or zero to return them all at once.
+func (ds *AsyncAWSDatasource) pageSize(q *AsyncQuery) int {
+	if q.PageSize < 0 {
+		return 0
+	}
+	if q.PageSize > 0 {
+		return q.PageSize
+	}
+	return ds.PageSize
+}
+
+// resultsPage returns one page of the results of the finished query q, with
+// the token of the next page in the frame meta. The page is turned into frames
+// like complete results are.
+func (ds *AsyncAWSDatasource) resultsPage(ctx context.Context, pager RowsPager, q *AsyncQuery, pageSize int, settings backend.DataSourceInstanceSettings, fillMode *data.FillMissing, customMeta queryMeta) (data.Frames, error) {
+	rows, nextPageToken, err := getRowsPage(ctx, pager, q.QueryID, q.PageToken, pageSize, ds.Retry)
+	if err != nil {
+		return getErrorFrameFromQuery(q), err
+	}
+	res, err := ds.framesFromRows(ctx, rows, settings, fillMode, &q.Query)
+	if err != nil && !errors.Is(err, sqlds.ErrorNoResults) {
+		return getErrorFrameFromQuery(q), err
+	}
+	if len(res) == 0 {
+		res = append(res, &data.Frame{})
+	}
+	if res[0].Meta == nil {
+		res[0].Meta = &data.FrameMeta{ExecutedQueryString: q.RawSQL}
+	}
+	customMeta.NextPageToken = nextPageToken
+	res[0].Meta.Custom = customMeta
+	res[0].Meta.Stats = append(res[0].Meta.Stats, customMeta.Stats.frameStats()...)
+	return res, nil
+}
+
+type rowsPage struct {
+	rows          driver.Rows
+	nextPageToken string
+}
+
+// getRowsPage returns a page of the results of queryID, retrying transient
+// errors as set by retry.
+func getRowsPage(ctx context.Context, pager RowsPager, queryID string, pageToken string, pageSize int, retry RetryPolicy) (_ driver.Rows, _ string, err error) {
+	ctx, span := common.StartSpan(ctx, "awsds.GetRows",
+		common.AttributeQueryID.String(queryID),
+		attribute.Int("aws.query.page_size", pageSize),
+	)
+	defer func() { common.EndSpan(span, err) }()
+	db, _ := pager.(AsyncDB)
+	page, err := WithRetry(ctx, retry, db, func(ctx context.Context) (rowsPage, error) {
+		rows, nextPageToken, err := pager.GetRowsPage(ctx, queryID, pageToken, pageSize)
+		return rowsPage{rows, nextPageToken}, err
+	})
+	return page.rows, page.nextPageToken, err
+}
+
+// framesFromRows turns rows of the results of query into frames the way
+// complete results are: with the converters of the driver, fillMode and the
+// row limit of the datasource. The rows are closed.
+func (ds *AsyncAWSDatasource) framesFromRows(ctx context.Context, rows driver.Rows, settings backend.DataSourceInstanceSettings, fillMode *data.FillMissing, query *sqlutil.Query) (data.Frames, error) {
+	connector := &rowsConnector{rows: rows}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	res, err := sqlds.NewQuery(db, settings, ds.driver.Converters(), fillMode, ds.GetRowLimit()).Run(ctx, query, nil)
+	if !connector.queried {
+		rows.Close()
+	}
+	return res, err
+}
+
+// rowsConnector is a database/sql connector whose query returns rows that
+// were already read from the database, so sqlds can turn them into frames.
+type rowsConnector struct {
+	rows    driver.Rows
+	queried bool
+}
+
+func (c *rowsConnector) Connect(context.Context) (driver.Conn, error) { return rowsConn{c}, nil }
+func (c *rowsConnector) Driver() driver.Driver                        { return c }
+func (c *rowsConnector) Open(string) (driver.Conn, error)             { return rowsConn{c}, nil }
+
+type rowsConn struct {
+	connector *rowsConnector
+}
+
+func (c rowsConn) QueryContext(context.Context, string, []driver.NamedValue) (driver.Rows, error) {
+	c.connector.queried = true
+	return c.connector.rows, nil
+}
+
+func (rowsConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("prepared statements are not supported")
+}
+
+func (rowsConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions are not supported")
+}
+
+func (rowsConn) Close() error { return nil }
@@ -0,0 +1,221 @@
+package awsds
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+	closed  bool
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { r.closed = true; return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+// pagedDB is a finished query whose results are served page by page. Page
+// tokens are the index of the first row of the page.
+type pagedDB struct {
+	fakeAsyncDB
+	values [][]driver.Value
+}
+
+func (pagedDB) QueryStatus(context.Context, string) (QueryStatus, error) {
+	return QueryFinished, nil
+}
+
+func (db pagedDB) GetRowsPage(_ context.Context, _ string, pageToken string, pageSize int) (driver.Rows, string, error) {
+	start := 0
+	if pageToken != "" {
+		start, _ = strconv.Atoi(pageToken)
+	}
+	end := min(start+pageSize, len(db.values))
+	next := ""
+	if end < len(db.values) {
+		next = strconv.Itoa(end)
+	}
+	return int64Rows{&fakeRows{columns: []string{"n"}, values: db.values[start:end]}}, next, nil
+}
+
+// int64Rows are rows of BIGINT columns.
+type int64Rows struct {
+	*fakeRows
+}
+
+func (int64Rows) ColumnTypeScanType(int) reflect.Type { return reflect.TypeOf(int64(0)) }
+
+func pagedValues(n int) [][]driver.Value {
+	values := make([][]driver.Value, n)
+	for i := range values {
+		values[i] = []driver.Value{int64(i)}
+	}
+	return values
+}
+
+// typedRows are rows of VARCHAR columns, which Athena returns for most types.
+type typedRows struct {
+	*fakeRows
+}
+
+func (typedRows) ColumnTypeDatabaseTypeName(int) string { return "VARCHAR" }
+
+// varcharDriver converts VARCHAR columns to integers.
+type varcharDriver struct {
+	fakeDriver
+}
+
+func (varcharDriver) Converters() []sqlutil.Converter {
+	return []sqlutil.Converter{{
+		Name:          "varchar to int",
+		InputScanType: reflect.TypeOf(sql.NullString{}),
+		InputTypeName: "VARCHAR",
+		FrameConverter: sqlutil.FrameConverter{
+			FieldType: data.FieldTypeNullableInt64,
+			ConverterFunc: func(in interface{}) (interface{}, error) {
+				s := in.(*sql.NullString)
+				if !s.Valid {
+					return (*int64)(nil), nil
+				}
+				n, err := strconv.ParseInt(s.String, 10, 64)
+				return &n, err
+			},
+		},
+	}}
+}
+
+func TestAsyncAWSDatasource_framesFromRows(t *testing.T) {
+	ds := NewAsyncAWSDatasource(varcharDriver{})
+	ds.SetDefaultRowLimit(2)
+	rows := &fakeRows{columns: []string{"n"}, values: [][]driver.Value{{"1"}, {nil}, {"3"}}}
+
+	frames, err := ds.framesFromRows(context.Background(), typedRows{rows}, backend.DataSourceInstanceSettings{}, nil, &sqlutil.Query{RefID: "A", Format: sqlutil.FormatOptionTable})
+	require.NoError(t, err)
+	assert.True(t, rows.closed)
+	require.Len(t, frames, 1)
+	require.Len(t, frames[0].Fields, 1)
+	assert.Equal(t, data.FieldTypeNullableInt64, frames[0].Fields[0].Type(), "the converters of the driver are applied")
+	assert.Equal(t, 2, frames[0].Rows(), "the row limit is applied")
+	v, ok := frames[0].Fields[0].ConcreteAt(0)
+	assert.True(t, ok)
+	assert.Equal(t, int64(1), v)
+	_, ok = frames[0].Fields[0].ConcreteAt(1)
+	assert.False(t, ok)
+}
+
+func Test_handleAsyncQuery_pagination(t *testing.T) {
+	settings := backend.DataSourceInstanceSettings{UID: "uid1"}
+	ds := NewAsyncAWSDatasource(fakeDriver{})
+	ds.SetDefaultRowLimit(-1)
+	ds.storeDBConnection(defaultKey("uid1"), dbConnection{pagedDB{values: pagedValues(5)}, settings})
+
+	var rows []int64
+	pageToken := ""
+	pages := 0
+	for {
+		query := backend.DataQuery{RefID: "A", JSON: []byte(`{"rawSql":"SELECT n","queryID":"qid","pageSize":2,"pageToken":"` + pageToken + `","meta":{"queryFlow":"async"}}`)}
+		frames, err := ds.handleAsyncQuery(context.Background(), query, "uid1")
+		require.NoError(t, err)
+		require.Len(t, frames, 1)
+		pages++
+		for i := 0; i < frames[0].Rows(); i++ {
+			v, _ := frames[0].Fields[0].ConcreteAt(i)
+			rows = append(rows, v.(int64))
+		}
+		meta := frames[0].Meta.Custom.(queryMeta)
+		assert.Equal(t, "finished", meta.Status)
+		if meta.NextPageToken == "" {
+			break
+		}
+		pageToken = meta.NextPageToken
+	}
+	assert.Equal(t, 3, pages)
+	assert.Equal(t, []int64{0, 1, 2, 3, 4}, rows)
+}
+
+func Test_resultsStreamPath(t *testing.T) {
+	path := resultsStreamPath("abc:1", []byte(`{"database":"db"}`))
+	queryID, connectionArgs, err := parseResultsStreamPath(path)
+	require.NoError(t, err)
+	assert.Equal(t, "abc:1", queryID)
+	assert.JSONEq(t, `{"database":"db"}`, string(connectionArgs))
+
+	queryID, connectionArgs, err = parseResultsStreamPath(resultsStreamPath("qid", nil))
+	require.NoError(t, err)
+	assert.Equal(t, "qid", queryID)
+	assert.Nil(t, connectionArgs)
+
+	for _, invalid := range []string{"", "rows", "other/cWlk", "rows/!!", "rows/cWlk/a/b"} {
+		_, _, err := parseResultsStreamPath(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+type collectingPacketSender struct {
+	packets []*backend.StreamPacket
+}
+
+func (s *collectingPacketSender) Send(packet *backend.StreamPacket) error {
+	s.packets = append(s.packets, packet)
+	return nil
+}
+
+func TestAsyncAWSDatasource_streamResults(t *testing.T) {
+	settings := backend.DataSourceInstanceSettings{UID: "uid1"}
+	ds := NewAsyncAWSDatasource(fakeDriver{})
+	ds.PageSize = 2
+	ds.SetDefaultRowLimit(-1)
+	ds.storeDBConnection(defaultKey("uid1"), dbConnection{pagedDB{values: pagedValues(5)}, settings})
+	pluginContext := backend.PluginContext{DataSourceInstanceSettings: &settings}
+
+	query := backend.DataQuery{RefID: "A", JSON: []byte(`{"rawSql":"SELECT n","queryID":"qid","streamResults":true,"meta":{"queryFlow":"async"}}`)}
+	frames, err := ds.handleAsyncQuery(context.Background(), query, "uid1")
+	require.NoError(t, err)
+	require.Len(t, frames, 1)
+	assert.Equal(t, "ds/uid1/"+resultsStreamPath("qid", nil), frames[0].Meta.Channel)
+	assert.Equal(t, 0, frames[0].Rows())
+
+	path := resultsStreamPath("qid", nil)
+	subscription, err := ds.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{PluginContext: pluginContext, Path: path})
+	require.NoError(t, err)
+	assert.Equal(t, backend.SubscribeStreamStatusOK, subscription.Status)
+
+	subscription, err = ds.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{PluginContext: pluginContext, Path: "unknown"})
+	require.NoError(t, err)
+	assert.Equal(t, backend.SubscribeStreamStatusNotFound, subscription.Status)
+
+	publication, err := ds.PublishStream(context.Background(), &backend.PublishStreamRequest{PluginContext: pluginContext, Path: path})
+	require.NoError(t, err)
+	assert.Equal(t, backend.PublishStreamStatusPermissionDenied, publication.Status)
+
+	packets := &collectingPacketSender{}
+	err = ds.RunStream(context.Background(), &backend.RunStreamRequest{PluginContext: pluginContext, Path: path}, backend.NewStreamSender(packets))
+	require.NoError(t, err)
+	require.Len(t, packets.packets, 3)
+	var rows int
+	for _, packet := range packets.packets {
+		frame := &data.Frame{}
+		require.NoError(t, frame.UnmarshalJSON(packet.Data))
+		rows += frame.Rows()
+	}
+	assert.Equal(t, 5, rows)
+}
@@ -0,0 +1,135 @@
+package awsds
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+const (
+	// minReapInterval bounds how often idle queries are looked for
+	minReapInterval = time.Second
+
+	// cancelIdleQueryTimeout bounds a single cancellation made by the reaper
+	cancelIdleQueryTimeout = 30 * time.Second
+)
+
+type polledQuery struct {
+	db         AsyncDB
+	lastPolled time.Time
+}
+
+// idleQueryReaper remembers when each running async query was last polled.
+// The frontend polls a query until it finishes, so a query that is not polled
+// anymore belongs to a dashboard that was closed or refreshed.
+type idleQueryReaper struct {
+	backgroundLoop
+	mu      sync.Mutex
+	queries map[string]*polledQuery
+}
+
+// polled records that queryID, running on db, was just started or polled.
+func (r *idleQueryReaper) polled(queryID string, db AsyncDB, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.queries == nil {
+		r.queries = map[string]*polledQuery{}
+	}
+	r.queries[queryID] = &polledQuery{db: db, lastPolled: now}
+}
+
+func (r *idleQueryReaper) forget(queryID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.queries, queryID)
+}
+
+// idle removes and returns the queries not polled since before deadline.
+func (r *idleQueryReaper) idle(deadline time.Time) map[string]AsyncDB {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	idle := map[string]AsyncDB{}
+	for queryID, q := range r.queries {
+		if q.lastPolled.Before(deadline) {
+			idle[queryID] = q.db
+			delete(r.queries, queryID)
+		}
+	}
+	return idle
+}
+
+// backgroundLoop calls a function periodically until it is shut down.
+type backgroundLoop struct {
+	mu   sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+// ensureRunning starts the background loop calling fn every interval, if it
+// is not running already.
+func (l *backgroundLoop) ensureRunning(interval time.Duration, fn func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stop != nil {
+		return
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	l.stop, l.done = stop, done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fn()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// shutdown stops the background loop and waits for it to exit. The loop can
+// be started again afterwards.
+func (l *backgroundLoop) shutdown() {
+	l.mu.Lock()
+	stop, done := l.stop, l.done
+	l.stop, l.done = nil, nil
+	l.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// trackPoll records that queryID was started or polled, so it can be
+// cancelled once it is not polled for QueryIdleTimeout.
+func (ds *AsyncAWSDatasource) trackPoll(queryID string, db AsyncDB) {
+	if ds.QueryIdleTimeout <= 0 {
+		return
+	}
+	ds.idleQueries.polled(queryID, db, time.Now())
+	ds.idleQueries.ensureRunning(max(ds.QueryIdleTimeout/2, minReapInterval), func() {
+		ds.reapIdleQueries(time.Now())
+	})
+}
+
+// reapIdleQueries cancels the queries that have not been polled for
+// QueryIdleTimeout as of now.
+func (ds *AsyncAWSDatasource) reapIdleQueries(now time.Time) {
+	for queryID, db := range ds.idleQueries.idle(now.Add(-ds.QueryIdleTimeout)) {
+		ds.sharedQueries.finish(queryID)
+		ds.forgetQuery(queryID)
+		asyncQueriesMetric.WithLabelValues(QueryCanceled.String()).Inc()
+		ds.auditedQueries.forget(queryID)
+		backend.Logger.Info("Cancelling async query that is not polled anymore", "queryID", queryID, "idleTimeout", ds.QueryIdleTimeout)
+		ctx, cancel := context.WithTimeout(context.Background(), cancelIdleQueryTimeout)
+		if err := db.CancelQuery(ctx, queryID); err != nil {
+			backend.Logger.Warn("Could not cancel idle async query", "queryID", queryID, "error", err)
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,119 @@
+package awsds
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_reapIdleQueries(t *testing.T) {
+	settings := backend.DataSourceInstanceSettings{UID: "uid1"}
+	start := backend.DataQuery{RefID: "A", JSON: []byte(`{"rawSql":"SELECT 1","meta":{"queryFlow":"async"}}`)}
+	poll := backend.DataQuery{RefID: "A", JSON: []byte(`{"rawSql":"SELECT 1","queryID":"qid","meta":{"queryFlow":"async"}}`)}
+
+	newDatasource := func(db AsyncDB) *AsyncAWSDatasource {
+		ds := NewAsyncAWSDatasource(fakeDriver{})
+		ds.QueryIdleTimeout = time.Minute
+		ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, settings})
+		t.Cleanup(ds.idleQueries.shutdown)
+		return ds
+	}
+
+	t.Run("cancels a query that is not polled anymore", func(t *testing.T) {
+		db := new(MockDB)
+		db.On("GetQueryID", mock.Anything, "SELECT 1", mock.Anything).Return(false, "", nil)
+		db.On("StartQuery", mock.Anything, "SELECT 1", mock.Anything).Return("qid", nil).Once()
+		db.On("StartQuery", mock.Anything, "SELECT 1", mock.Anything).Return("qid2", nil).Once()
+		db.On("CancelQuery", mock.Anything, "qid").Return(nil)
+		ds := newDatasource(db)
+
+		_, err := ds.handleAsyncQuery(context.Background(), start, "uid1")
+		require.NoError(t, err)
+
+		ds.reapIdleQueries(time.Now())
+		db.AssertNotCalled(t, "CancelQuery", mock.Anything, mock.Anything)
+
+		ds.reapIdleQueries(time.Now().Add(2 * time.Minute))
+		db.AssertNumberOfCalls(t, "CancelQuery", 1)
+		_, shared := ds.sharedQueries.byID["qid"]
+		assert.False(t, shared)
+
+		// the cancelled query is not shared with later requests
+		frames, err := ds.handleAsyncQuery(context.Background(), start, "uid1")
+		require.NoError(t, err)
+		assert.Equal(t, queryMeta{QueryID: "qid2", Status: "started"}, frames[0].Meta.Custom)
+	})
+
+	t.Run("polling keeps a query alive", func(t *testing.T) {
+		db := new(MockDB)
+		db.On("QueryStatus", mock.Anything, "qid").Return(QueryRunning, nil)
+		ds := newDatasource(db)
+		ds.idleQueries.polled("qid", db, time.Now().Add(-50*time.Second))
+
+		_, err := ds.handleAsyncQuery(context.Background(), poll, "uid1")
+		require.NoError(t, err)
+		ds.reapIdleQueries(time.Now().Add(30 * time.Second))
+		db.AssertNotCalled(t, "CancelQuery", mock.Anything, mock.Anything)
+	})
+
+	t.Run("finished queries are not tracked", func(t *testing.T) {
+		db := new(MockDB)
+		db.On("QueryStatus", mock.Anything, "qid").Return(QueryCanceled, nil)
+		ds := newDatasource(db)
+		ds.idleQueries.polled("qid", db, time.Now())
+
+		_, err := ds.handleAsyncQuery(context.Background(), poll, "uid1")
+		require.NoError(t, err)
+		ds.reapIdleQueries(time.Now().Add(time.Hour))
+		db.AssertNotCalled(t, "CancelQuery", mock.Anything, mock.Anything)
+	})
+
+	t.Run("nothing is tracked without an idle timeout", func(t *testing.T) {
+		ds := newDatasource(new(MockDB))
+		ds.QueryIdleTimeout = 0
+		ds.trackPoll("qid", nil)
+		assert.Empty(t, ds.idleQueries.queries)
+		assert.Nil(t, ds.idleQueries.stop, "the reaper should not be started")
+	})
+}
+
+func Test_idleQueryReaper_lifecycle(t *testing.T) {
+	var r idleQueryReaper
+	var reaps atomic.Int32
+	reap := func() { reaps.Add(1) }
+
+	r.ensureRunning(time.Millisecond, reap)
+	r.ensureRunning(time.Millisecond, reap) // no second loop
+	require.Eventually(t, func() bool { return reaps.Load() > 0 }, time.Second, time.Millisecond)
+
+	r.shutdown()
+	stopped := reaps.Load()
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, stopped, reaps.Load(), "no reaps after shutdown")
+	r.shutdown() // shutting down twice is fine
+
+	// a disposed datasource starts reaping again when it is reused
+	r.ensureRunning(time.Millisecond, reap)
+	require.Eventually(t, func() bool { return reaps.Load() > stopped }, time.Second, time.Millisecond)
+	r.shutdown()
+}
+
+func TestAsyncAWSDatasource_Dispose(t *testing.T) {
+	ds := &AsyncAWSDatasource{QueryIdleTimeout: time.Minute}
+	ds.trackPoll("qid", new(MockDB))
+	require.NotNil(t, ds.idleQueries.done)
+	done := ds.idleQueries.done
+
+	ds.Dispose()
+	select {
+	case <-done:
+	default:
+		t.Fatal("the reaper should have stopped")
+	}
+}
@@ -0,0 +1,138 @@
+package awsds
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+)
+
+const (
+	// DefaultRetryMaxAttempts is a sensible RetryPolicy.MaxAttempts for
+	// drivers opting into retries
+	DefaultRetryMaxAttempts = 3
+
+	// DefaultRetryInitialBackoff is the longest wait before the first retry
+	// when RetryPolicy.InitialBackoff is not set
+	DefaultRetryInitialBackoff = 200 * time.Millisecond
+
+	// DefaultRetryMaxBackoff is the longest wait between two attempts when
+	// RetryPolicy.MaxBackoff is not set
+	DefaultRetryMaxBackoff = 5 * time.Second
+)
+
+// RetryableErrorClassifier can be implemented by an AsyncDB to decide which
+// of its errors are transient and worth retrying. Without it, the errors the
+// AWS SDK retries by default, such as throttling and connection errors, are
+// retried.
+type RetryableErrorClassifier interface {
+	IsRetryableError(err error) bool
+}
+
+// StartQueryRetryClassifier can be implemented by an AsyncDB to decide which
+// errors of StartQuery can be retried without running the query twice, e.g.
+// because the request never reached AWS or because StartQuery sends a client
+// request token. StartQuery is not idempotent: without this interface, it is
+// never retried, since a timeout may hide a query AWS already started.
+type StartQueryRetryClassifier interface {
+	IsStartQueryRetryable(err error) bool
+}
+
+// RetryPolicy is how the calls to StartQuery, QueryStatus and GetRows of an
+// AsyncDB are retried when they fail with a transient error. The wait before
+// each retry is picked at random up to an exponentially growing backoff.
+//
+// The zero value makes a single attempt: retries are opt-in, as they add up
+// with those of the AWS SDK client the AsyncDB uses. Set MaxAttempts, e.g. to
+// DefaultRetryMaxAttempts, to retry.
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+func (p RetryPolicy) maxAttempts() int {
+	return max(p.MaxAttempts, 1)
+}
+
+// backoff returns the wait before the retry following attempt, counted from 1.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	initial, maxBackoff := p.InitialBackoff, p.MaxBackoff
+	if initial <= 0 {
+		initial = DefaultRetryInitialBackoff
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultRetryMaxBackoff
+	}
+	ceiling := initial
+	for i := 1; i < attempt && ceiling < maxBackoff; i++ {
+		ceiling *= 2
+	}
+	ceiling = min(ceiling, maxBackoff)
+	return time.Duration(rand.Int64N(int64(ceiling) + 1))
+}
+
+var defaultRetryables = retry.IsErrorRetryables(retry.DefaultRetryables)
+
+// isRetryableError tells whether err, returned by db, is transient. Context
+// errors and QueryExecutionErrors are never retried: the first means the
+// request is over, the second that the query itself failed.
+func isRetryableError(db AsyncDB, err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if classifier, ok := db.(RetryableErrorClassifier); ok {
+		return classifier.IsRetryableError(err)
+	}
+	var qeError *QueryExecutionError
+	if errors.As(err, &qeError) {
+		return false
+	}
+	return defaultRetryables.IsErrorRetryable(err) == aws.TrueTernary
+}
+
+// WithRetry calls fn, a call to db, until it succeeds, fails with an error that
+// is not retryable, policy runs out of attempts or ctx is done. The error of
+// the last attempt is returned as is.
+func WithRetry[T any](ctx context.Context, policy RetryPolicy, db AsyncDB, fn func(context.Context) (T, error)) (T, error) {
+	return withRetry(ctx, policy, func(err error) bool { return isRetryableError(db, err) }, fn)
+}
+
+// StartQueryWithRetry calls fn, a call to the StartQuery method of db, like
+// WithRetry does, but only retries the errors db classifies as safe to retry
+// with StartQueryRetryClassifier.
+func StartQueryWithRetry(ctx context.Context, policy RetryPolicy, db AsyncDB, fn func(context.Context) (string, error)) (string, error) {
+	classifier, ok := db.(StartQueryRetryClassifier)
+	if !ok {
+		return fn(ctx)
+	}
+	return withRetry(ctx, policy, func(err error) bool {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return false
+		}
+		return classifier.IsStartQueryRetryable(err)
+	}, fn)
+}
+
+func withRetry[T any](ctx context.Context, policy RetryPolicy, isRetryable func(error) bool, fn func(context.Context) (T, error)) (T, error) {
+	var (
+		res T
+		err error
+	)
+	for attempt := 1; ; attempt++ {
+		res, err = fn(ctx)
+		if err == nil || attempt >= policy.maxAttempts() || !isRetryable(err) {
+			return res, err
+		}
+		timer := time.NewTimer(policy.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return res, err
+		case <-timer.C:
+		}
+	}
+}
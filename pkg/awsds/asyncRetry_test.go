@@ -0,0 +1,301 @@
+package awsds
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/aws/smithy-go"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+var errThrottled = &smithy.GenericAPIError{Code: "ThrottlingException", Message: "Rate exceeded"}
+
+// classifyingDB only retries errTransient.
+type classifyingDB struct {
+	fakeAsyncDB
+}
+
+var errTransient = errors.New("transient")
+
+func (classifyingDB) IsRetryableError(err error) bool {
+	return errors.Is(err, errTransient)
+}
+
+func Test_isRetryableError(t *testing.T) {
+	tests := []struct {
+		desc     string
+		db       AsyncDB
+		err      error
+		expected bool
+	}{
+		{desc: "throttling", db: fakeAsyncDB{}, err: errThrottled, expected: true},
+		{desc: "wrapped throttling", db: fakeAsyncDB{}, err: fmt.Errorf("status: %w", errThrottled), expected: true},
+		{desc: "server error", db: fakeAsyncDB{}, err: &smithy.GenericAPIError{Code: "RequestTimeout"}, expected: true},
+		{desc: "validation error", db: fakeAsyncDB{}, err: &smithy.GenericAPIError{Code: "InvalidRequestException"}, expected: false},
+		{desc: "unknown error", db: fakeAsyncDB{}, err: errors.New("boom"), expected: false},
+		{desc: "query execution error", db: fakeAsyncDB{}, err: &QueryExecutionError{Err: errThrottled, Cause: QueryFailedUser}, expected: false},
+		{desc: "cancelled request", db: fakeAsyncDB{}, err: context.Canceled, expected: false},
+		{desc: "expired request", db: fakeAsyncDB{}, err: context.DeadlineExceeded, expected: false},
+		{desc: "driver classifier retries", db: classifyingDB{}, err: errTransient, expected: true},
+		{desc: "driver classifier overrides the default", db: classifyingDB{}, err: errThrottled, expected: false},
+		{desc: "no driver", db: nil, err: errThrottled, expected: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			assert.Equal(t, tt.expected, isRetryableError(tt.db, tt.err))
+		})
+	}
+}
+
+func TestRetryPolicy_backoff(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	for i := 0; i < 100; i++ {
+		assert.LessOrEqual(t, p.backoff(1), 10*time.Millisecond)
+		assert.LessOrEqual(t, p.backoff(2), 20*time.Millisecond)
+		assert.LessOrEqual(t, p.backoff(10), 50*time.Millisecond)
+		assert.GreaterOrEqual(t, p.backoff(10), time.Duration(0))
+	}
+	assert.Equal(t, 1, RetryPolicy{}.maxAttempts(), "retries are opt-in")
+	assert.LessOrEqual(t, RetryPolicy{}.backoff(100), DefaultRetryMaxBackoff)
+}
+
+func TestWithRetry(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	failing := func(errs ...error) (func(context.Context) (string, error), *int) {
+		calls := 0
+		return func(context.Context) (string, error) {
+			calls++
+			if calls <= len(errs) {
+				return "", errs[calls-1]
+			}
+			return "ok", nil
+		}, &calls
+	}
+
+	t.Run("retries transient errors", func(t *testing.T) {
+		fn, calls := failing(errThrottled, errThrottled)
+		res, err := WithRetry(context.Background(), policy, fakeAsyncDB{}, fn)
+		require.NoError(t, err)
+		assert.Equal(t, "ok", res)
+		assert.Equal(t, 3, *calls)
+	})
+
+	t.Run("gives up after the maximum attempts", func(t *testing.T) {
+		fn, calls := failing(errThrottled, errThrottled, errThrottled)
+		_, err := WithRetry(context.Background(), policy, fakeAsyncDB{}, fn)
+		assert.ErrorIs(t, err, errThrottled)
+		assert.Equal(t, 3, *calls)
+	})
+
+	t.Run("does not retry other errors", func(t *testing.T) {
+		qeErr := &QueryExecutionError{Err: errThrottled, Cause: QueryFailedUser}
+		fn, calls := failing(qeErr)
+		_, err := WithRetry(context.Background(), policy, fakeAsyncDB{}, fn)
+		var got *QueryExecutionError
+		require.ErrorAs(t, err, &got)
+		assert.Equal(t, QueryFailedUser, got.Cause)
+		assert.Equal(t, 1, *calls)
+	})
+
+	t.Run("stops when the request is cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		fn, calls := failing(errThrottled, errThrottled)
+		_, err := WithRetry(ctx, RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Hour, MaxBackoff: time.Hour}, fakeAsyncDB{}, fn)
+		assert.ErrorIs(t, err, errThrottled)
+		assert.Equal(t, 1, *calls)
+	})
+
+	t.Run("the zero policy does not retry", func(t *testing.T) {
+		fn, calls := failing(errThrottled)
+		_, err := WithRetry(context.Background(), RetryPolicy{}, fakeAsyncDB{}, fn)
+		assert.ErrorIs(t, err, errThrottled)
+		assert.Equal(t, 1, *calls)
+	})
+}
+
+// startRetryingDB can safely retry throttled starts.
+type startRetryingDB struct {
+	*MockDB
+}
+
+func (startRetryingDB) IsStartQueryRetryable(err error) bool {
+	return errors.Is(err, errThrottled)
+}
+
+func TestStartQueryWithRetry(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	tests := []struct {
+		desc          string
+		db            AsyncDB
+		err           error
+		expectedCalls int
+	}{
+		{desc: "starts are not retried by default", db: fakeAsyncDB{}, err: errThrottled, expectedCalls: 1},
+		{desc: "the driver allows retrying a start", db: startRetryingDB{}, err: errThrottled, expectedCalls: 3},
+		{desc: "the driver does not allow retrying a start", db: startRetryingDB{}, err: errTransient, expectedCalls: 1},
+		{desc: "expired requests are not retried", db: startRetryingDB{}, err: context.DeadlineExceeded, expectedCalls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			calls := 0
+			_, err := StartQueryWithRetry(context.Background(), policy, tt.db, func(context.Context) (string, error) {
+				calls++
+				return "", tt.err
+			})
+			assert.ErrorIs(t, err, tt.err)
+			assert.Equal(t, tt.expectedCalls, calls)
+		})
+	}
+}
+
+func Test_handleAsyncQuery_retriesTransientErrors(t *testing.T) {
+	settings := backend.DataSourceInstanceSettings{UID: "uid1"}
+	newDatasource := func(db AsyncDB) *AsyncAWSDatasource {
+		ds := NewAsyncAWSDatasource(fakeDriver{})
+		ds.Retry = RetryPolicy{MaxAttempts: DefaultRetryMaxAttempts, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+		ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, settings})
+		return ds
+	}
+
+	t.Run("starting a query is not retried by default", func(t *testing.T) {
+		db := new(MockDB)
+		db.On("GetQueryID", mock.Anything, "SELECT 1", mock.Anything).Return(false, "", nil)
+		db.On("StartQuery", mock.Anything, "SELECT 1", mock.Anything).Return("", errThrottled).Once()
+		ds := newDatasource(db)
+
+		query := backend.DataQuery{RefID: "A", JSON: []byte(`{"rawSql":"SELECT 1","meta":{"queryFlow":"async"}}`)}
+		_, err := ds.handleAsyncQuery(context.Background(), query, "uid1")
+		assert.ErrorIs(t, err, errThrottled)
+		db.AssertNumberOfCalls(t, "StartQuery", 1)
+	})
+
+	t.Run("starting a query the driver can start again", func(t *testing.T) {
+		db := new(MockDB)
+		db.On("GetQueryID", mock.Anything, "SELECT 1", mock.Anything).Return(false, "", nil)
+		db.On("StartQuery", mock.Anything, "SELECT 1", mock.Anything).Return("", errThrottled).Once()
+		db.On("StartQuery", mock.Anything, "SELECT 1", mock.Anything).Return("qid", nil).Once()
+		ds := newDatasource(startRetryingDB{db})
+
+		query := backend.DataQuery{RefID: "A", JSON: []byte(`{"rawSql":"SELECT 1","meta":{"queryFlow":"async"}}`)}
+		frames, err := ds.handleAsyncQuery(context.Background(), query, "uid1")
+		require.NoError(t, err)
+		assert.Equal(t, "qid", frames[0].Meta.Custom.(queryMeta).QueryID)
+		db.AssertNumberOfCalls(t, "StartQuery", 2)
+	})
+
+	t.Run("polling a query", func(t *testing.T) {
+		db := new(MockDB)
+		db.On("QueryStatus", mock.Anything, "qid").Return(QueryUnknown, errThrottled).Twice()
+		db.On("QueryStatus", mock.Anything, "qid").Return(QueryRunning, nil).Once()
+		ds := newDatasource(db)
+
+		query := backend.DataQuery{RefID: "A", JSON: []byte(`{"rawSql":"SELECT 1","queryID":"qid","meta":{"queryFlow":"async"}}`)}
+		frames, err := ds.handleAsyncQuery(context.Background(), query, "uid1")
+		require.NoError(t, err)
+		assert.Equal(t, QueryRunning.String(), frames[0].Meta.Custom.(queryMeta).Status)
+		db.AssertNumberOfCalls(t, "QueryStatus", 3)
+	})
+
+	t.Run("preserves query execution errors", func(t *testing.T) {
+		db := new(MockDB)
+		db.On("QueryStatus", mock.Anything, "qid").Return(QueryFailed, &QueryExecutionError{Err: errors.New("syntax error"), Cause: QueryFailedUser})
+		ds := newDatasource(db)
+
+		query := backend.DataQuery{RefID: "A", JSON: []byte(`{"rawSql":"SELECT 1","queryID":"qid","meta":{"queryFlow":"async"}}`)}
+		res := ds.asyncQueryData(context.Background(), query, "uid1")
+		require.Error(t, res.Error)
+		assert.Equal(t, backend.StatusBadRequest, res.Status)
+		db.AssertNumberOfCalls(t, "QueryStatus", 1)
+	})
+}
+
+// flakyConnector opens connections whose queries fail with errThrottled
+// until failures queries were made, then return a single row.
+type flakyConnector struct {
+	failures int
+	queries  int
+}
+
+func (c *flakyConnector) Connect(context.Context) (driver.Conn, error) { return flakyConn{c}, nil }
+func (c *flakyConnector) Driver() driver.Driver                        { return nil }
+
+type flakyConn struct {
+	connector *flakyConnector
+}
+
+func (flakyConn) Prepare(string) (driver.Stmt, error)      { return nil, driver.ErrSkip }
+func (flakyConn) Close() error                             { return nil }
+func (flakyConn) Begin() (driver.Tx, error)                { return nil, driver.ErrSkip }
+func (flakyConn) CheckNamedValue(*driver.NamedValue) error { return nil }
+
+func (c flakyConn) QueryContext(context.Context, string, []driver.NamedValue) (driver.Rows, error) {
+	c.connector.queries++
+	if c.connector.queries <= c.connector.failures {
+		return nil, errThrottled
+	}
+	return &oneRow{}, nil
+}
+
+type oneRow struct {
+	done bool
+}
+
+func (*oneRow) Columns() []string { return []string{"n"} }
+func (*oneRow) Close() error      { return nil }
+
+func (r *oneRow) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = "1"
+	return nil
+}
+
+func Test_queryAsync_retriesTransientErrors(t *testing.T) {
+	retry := RetryPolicy{MaxAttempts: DefaultRetryMaxAttempts, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	q := &AsyncQuery{QueryID: "qid"}
+	q.RawSQL = "SELECT 1"
+
+	t.Run("retries getting the rows", func(t *testing.T) {
+		connector := &flakyConnector{failures: 2}
+		conn := sql.OpenDB(connector)
+		defer conn.Close()
+
+		frames, err := queryAsync(context.Background(), conn, &fakeAsyncDB{}, retry, backend.DataSourceInstanceSettings{}, nil, nil, q, -1)
+		require.NoError(t, err)
+		require.Len(t, frames, 1)
+		assert.Equal(t, 1, frames[0].Rows())
+		assert.Equal(t, 3, connector.queries)
+	})
+
+	t.Run("gives up after the maximum attempts", func(t *testing.T) {
+		connector := &flakyConnector{failures: 5}
+		conn := sql.OpenDB(connector)
+		defer conn.Close()
+
+		_, err := queryAsync(context.Background(), conn, &fakeAsyncDB{}, retry, backend.DataSourceInstanceSettings{}, nil, nil, q, -1)
+		assert.ErrorIs(t, err, errThrottled)
+		assert.Equal(t, DefaultRetryMaxAttempts, connector.queries)
+	})
+
+	t.Run("the zero policy does not retry", func(t *testing.T) {
+		connector := &flakyConnector{failures: 1}
+		conn := sql.OpenDB(connector)
+		defer conn.Close()
+
+		_, err := queryAsync(context.Background(), conn, &fakeAsyncDB{}, RetryPolicy{}, backend.DataSourceInstanceSettings{}, nil, nil, q, -1)
+		assert.ErrorIs(t, err, errThrottled)
+		assert.Equal(t, 1, connector.queries)
+	})
+}
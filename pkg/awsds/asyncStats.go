@@ -0,0 +1,51 @@
+package awsds
+
+import (
+	"context"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// queryStats returns the statistics of queryID when db reports them. They
+// are informational, so failing to get them does not fail the query.
+func queryStats(ctx context.Context, db AsyncDB, queryID string) *QueryStats {
+	provider, ok := db.(QueryStatsProvider)
+	if !ok {
+		return nil
+	}
+	stats, err := provider.QueryStats(ctx, queryID)
+	if err != nil {
+		backend.Logger.FromContext(ctx).Debug("Could not get async query stats", "queryID", queryID, "error", err)
+		return nil
+	}
+	return &stats
+}
+
+// frameStats returns the statistics in the form Grafana shows in the query
+// inspector.
+func (s *QueryStats) frameStats() []data.QueryStat {
+	if s == nil {
+		return nil
+	}
+	var stats []data.QueryStat
+	add := func(name string, unit string, value float64) {
+		stats = append(stats, data.QueryStat{FieldConfig: data.FieldConfig{DisplayName: name, Unit: unit}, Value: value})
+	}
+	if s.BytesScanned != nil {
+		add("Bytes scanned", "decbytes", float64(*s.BytesScanned))
+	}
+	if s.RowsProcessed != nil {
+		add("Rows processed", "short", float64(*s.RowsProcessed))
+	}
+	if s.PercentComplete != nil {
+		add("Percent complete", "percent", *s.PercentComplete)
+	}
+	if s.EstimatedCost != nil {
+		add("Estimated cost", "currencyUSD", *s.EstimatedCost)
+	}
+	if s.ExecutionTime != nil {
+		add("Execution time", "ms", float64(*s.ExecutionTime))
+	}
+	return stats
+}
@@ -0,0 +1,87 @@
+package awsds
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// statsDB is a MockDB that also reports query statistics.
+type statsDB struct {
+	*MockDB
+	stats QueryStats
+	err   error
+}
+
+func (db statsDB) QueryStats(_ context.Context, _ string) (QueryStats, error) {
+	return db.stats, db.err
+}
+
+func TestQueryStats_frameStats(t *testing.T) {
+	var none *QueryStats
+	assert.Nil(t, none.frameStats())
+	assert.Empty(t, (&QueryStats{}).frameStats())
+
+	stats := &QueryStats{
+		BytesScanned:    aws.Int64(1024),
+		RowsProcessed:   aws.Int64(0),
+		PercentComplete: aws.Float64(42.5),
+		EstimatedCost:   aws.Float64(0.01),
+		ExecutionTime:   aws.Int64(1500),
+	}
+	assert.Equal(t, []data.QueryStat{
+		{FieldConfig: data.FieldConfig{DisplayName: "Bytes scanned", Unit: "decbytes"}, Value: 1024},
+		{FieldConfig: data.FieldConfig{DisplayName: "Rows processed", Unit: "short"}, Value: 0},
+		{FieldConfig: data.FieldConfig{DisplayName: "Percent complete", Unit: "percent"}, Value: 42.5},
+		{FieldConfig: data.FieldConfig{DisplayName: "Estimated cost", Unit: "currencyUSD"}, Value: 0.01},
+		{FieldConfig: data.FieldConfig{DisplayName: "Execution time", Unit: "ms"}, Value: 1500},
+	}, stats.frameStats())
+}
+
+func Test_handleAsyncQuery_stats(t *testing.T) {
+	settings := backend.DataSourceInstanceSettings{UID: "uid1"}
+	poll := backend.DataQuery{RefID: "A", JSON: []byte(`{"rawSql":"SELECT 1","queryID":"qid","meta":{"queryFlow":"async"}}`)}
+
+	tests := []struct {
+		desc          string
+		db            AsyncDB
+		expectedStats *QueryStats
+	}{
+		{
+			desc:          "running query reports progress",
+			db:            statsDB{MockDB: new(MockDB), stats: QueryStats{BytesScanned: aws.Int64(2048), PercentComplete: aws.Float64(50)}},
+			expectedStats: &QueryStats{BytesScanned: aws.Int64(2048), PercentComplete: aws.Float64(50)},
+		},
+		{
+			desc: "stats errors are ignored",
+			db:   statsDB{MockDB: new(MockDB), err: assert.AnError},
+		},
+		{
+			desc: "drivers without stats report none",
+			db:   new(MockDB),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			mockDB, ok := tt.db.(*MockDB)
+			if !ok {
+				mockDB = tt.db.(statsDB).MockDB
+			}
+			mockDB.On("QueryStatus", mock.Anything, "qid").Return(QueryRunning, nil)
+			ds := NewAsyncAWSDatasource(fakeDriver{})
+			ds.storeDBConnection(defaultKey("uid1"), dbConnection{tt.db, settings})
+
+			frames, err := ds.handleAsyncQuery(context.Background(), poll, "uid1")
+			require.NoError(t, err)
+			require.Len(t, frames, 1)
+			assert.Equal(t, queryMeta{QueryID: "qid", Status: "running", Stats: tt.expectedStats}, frames[0].Meta.Custom)
+			assert.Equal(t, tt.expectedStats.frameStats(), frames[0].Meta.Stats)
+		})
+	}
+}
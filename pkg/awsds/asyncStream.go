@@ -0,0 +1,166 @@
+package awsds
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+	"github.com/grafana/grafana-plugin-sdk-go/live"
+	"github.com/grafana/sqlds/v5"
+)
+
+const (
+	// resultsStreamPrefix is the first part of the path of results streams
+	resultsStreamPrefix = "rows"
+
+	// defaultStreamPageSize is how many rows are sent at a time on results
+	// streams when no page size is set
+	defaultStreamPageSize = 10000
+)
+
+var _ backend.StreamHandler = (*AsyncAWSDatasource)(nil)
+
+// resultsStreamPath returns the path of the stream of the results of queryID.
+// The query ID and connection args are encoded to only use characters valid
+// in a channel path.
+func resultsStreamPath(queryID string, connectionArgs json.RawMessage) string {
+	path := resultsStreamPrefix + "/" + base64.RawURLEncoding.EncodeToString([]byte(queryID))
+	if len(connectionArgs) > 0 {
+		path += "/" + base64.RawURLEncoding.EncodeToString(connectionArgs)
+	}
+	return path
+}
+
+func parseResultsStreamPath(path string) (string, json.RawMessage, error) {
+	parts := strings.Split(path, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] != resultsStreamPrefix {
+		return "", nil, fmt.Errorf("invalid results stream path %q", path)
+	}
+	queryID, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || len(queryID) == 0 {
+		return "", nil, fmt.Errorf("invalid results stream path %q", path)
+	}
+	var connectionArgs json.RawMessage
+	if len(parts) == 3 {
+		connectionArgs, err = base64.RawURLEncoding.DecodeString(parts[2])
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid results stream path %q", path)
+		}
+	}
+	return string(queryID), connectionArgs, nil
+}
+
+// streamingFrames returns the frame pointing the frontend to the stream of
+// the results of the finished query q. It returns false when no valid channel
+// can be built for q, e.g. because its connection args are too long.
+func streamingFrames(datasourceUID string, q *AsyncQuery, customMeta queryMeta) (data.Frames, bool) {
+	channel := live.Channel{
+		Scope:     live.ScopeDatasource,
+		Namespace: datasourceUID,
+		Path:      resultsStreamPath(q.QueryID, q.ConnectionArgs),
+	}
+	if _, err := live.ParseChannel(channel.String()); err != nil {
+		return nil, false
+	}
+	return data.Frames{
+		{Meta: &data.FrameMeta{
+			ExecutedQueryString: q.RawSQL,
+			Custom:              customMeta,
+			Channel:             channel.String(),
+			Stats:               customMeta.Stats.frameStats(),
+		}},
+	}, true
+}
+
+// resultsPager returns the RowsPager holding the results of a stream and the
+// function to call once done with it.
+func (ds *AsyncAWSDatasource) resultsPager(ctx context.Context, datasourceUID string, connectionArgs json.RawMessage) (RowsPager, func(), error) {
+	db, release, err := ds.getAsyncDBFromQuery(ctx, &AsyncQuery{Query: sqlutil.Query{ConnectionArgs: connectionArgs}}, datasourceUID)
+	if err != nil {
+		return nil, nil, err
+	}
+	pager, ok := db.(RowsPager)
+	if !ok {
+		release()
+		return nil, nil, fmt.Errorf("the database does not support streaming results")
+	}
+	return pager, release, nil
+}
+
+// SubscribeStream allows subscribing to the results streams of finished
+// async queries.
+func (ds *AsyncAWSDatasource) SubscribeStream(ctx context.Context, req *backend.SubscribeStreamRequest) (*backend.SubscribeStreamResponse, error) {
+	if req.PluginContext.DataSourceInstanceSettings == nil {
+		return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusNotFound}, nil
+	}
+	_, connectionArgs, err := parseResultsStreamPath(req.Path)
+	if err != nil {
+		return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusNotFound}, nil
+	}
+	_, release, err := ds.resultsPager(ctx, getDatasourceUID(*req.PluginContext.DataSourceInstanceSettings), connectionArgs)
+	if err != nil {
+		return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusNotFound}, nil
+	}
+	release()
+	return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusOK}, nil
+}
+
+// PublishStream rejects publications: results streams are read only.
+func (ds *AsyncAWSDatasource) PublishStream(_ context.Context, _ *backend.PublishStreamRequest) (*backend.PublishStreamResponse, error) {
+	return &backend.PublishStreamResponse{Status: backend.PublishStreamStatusPermissionDenied}, nil
+}
+
+// RunStream sends the results of a finished async query one page at a time,
+// so they never have to be held in memory at once.
+func (ds *AsyncAWSDatasource) RunStream(ctx context.Context, req *backend.RunStreamRequest, sender *backend.StreamSender) error {
+	if req.PluginContext.DataSourceInstanceSettings == nil {
+		return fmt.Errorf("missing datasource settings")
+	}
+	queryID, connectionArgs, err := parseResultsStreamPath(req.Path)
+	if err != nil {
+		return err
+	}
+	pager, release, err := ds.resultsPager(ctx, getDatasourceUID(*req.PluginContext.DataSourceInstanceSettings), connectionArgs)
+	if err != nil {
+		return err
+	}
+	defer release()
+	pageSize := ds.PageSize
+	if pageSize <= 0 {
+		pageSize = defaultStreamPageSize
+	}
+
+	// the stream only knows the query ID, so the rows are sent as a table
+	query := &sqlutil.Query{RefID: queryID, Format: sqlutil.FormatOptionTable}
+	fillMode := ds.DriverSettings().FillMode
+
+	pageToken := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rows, nextPageToken, err := getRowsPage(ctx, pager, queryID, pageToken, pageSize, ds.Retry)
+		if err != nil {
+			return err
+		}
+		frames, err := ds.framesFromRows(ctx, rows, *req.PluginContext.DataSourceInstanceSettings, fillMode, query)
+		if err != nil && !errors.Is(err, sqlds.ErrorNoResults) {
+			return err
+		}
+		for _, frame := range frames {
+			if err := sender.SendFrame(frame, data.IncludeAll); err != nil {
+				return err
+			}
+		}
+		if nextPageToken == "" {
+			return nil
+		}
+		pageToken = nextPageToken
+	}
+}
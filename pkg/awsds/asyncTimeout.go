@@ -0,0 +1,151 @@
+package awsds
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/gtime"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// MaxExecutionDurationSettingKey is the datasource JSON data key holding the
+// maximum execution duration of async queries, e.g. "10m"
+const MaxExecutionDurationSettingKey = "asyncQueryMaxExecutionDuration"
+
+// queryStatusTimeout is the status reported in the frame meta of a query that
+// was cancelled for running longer than its maximum execution duration
+const queryStatusTimeout = "timeout"
+
+type maxExecutionDurationSettings struct {
+	MaxExecutionDuration string `json:"asyncQueryMaxExecutionDuration"`
+}
+
+// maxExecutionDuration returns how long q may run before it is cancelled.
+// The query's own value takes precedence over the datasource setting, which
+// takes precedence over ds.MaxExecutionDuration. Zero means no limit.
+func (ds *AsyncAWSDatasource) maxExecutionDuration(q *AsyncQuery, settings backend.DataSourceInstanceSettings) (time.Duration, error) {
+	if q.MaxExecutionDuration != "" {
+		return parseMaxExecutionDuration(q.MaxExecutionDuration)
+	}
+	if len(settings.JSONData) > 1 {
+		var s maxExecutionDurationSettings
+		if err := json.Unmarshal(settings.JSONData, &s); err != nil {
+			return 0, backend.DownstreamError(fmt.Errorf("could not unmarshal datasource settings: %w", err))
+		}
+		if s.MaxExecutionDuration != "" {
+			return parseMaxExecutionDuration(s.MaxExecutionDuration)
+		}
+	}
+	return ds.MaxExecutionDuration, nil
+}
+
+func parseMaxExecutionDuration(value string) (time.Duration, error) {
+	d, err := gtime.ParseDuration(value)
+	if err != nil {
+		return 0, backend.DownstreamError(fmt.Errorf("invalid max execution duration %q: %w", value, err))
+	}
+	if d < 0 {
+		return 0, backend.DownstreamErrorf("invalid max execution duration %q: must not be negative", value)
+	}
+	return d, nil
+}
+
+type queryStart struct {
+	started     time.Time
+	maxDuration time.Duration
+	timedOut    bool
+}
+
+// queryStartTimes remembers when each running query with a max execution
+// duration was first seen, until maxSharedQueryAge past its deadline. The zero
+// value is ready to use.
+type queryStartTimes struct {
+	mu      sync.Mutex
+	queries map[string]queryStart
+}
+
+// startTime returns when queryID, which may run for maxDuration, was first
+// seen, recording now if it was not seen yet. Queries started before a restart
+// are timed from their first poll.
+func (t *queryStartTimes) startTime(queryID string, maxDuration time.Duration, now time.Time) time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if q, ok := t.queries[queryID]; ok {
+		return q.started
+	}
+	if t.queries == nil {
+		t.queries = map[string]queryStart{}
+	}
+	for id, q := range t.queries {
+		if now.Sub(q.started) > q.maxDuration+maxSharedQueryAge {
+			delete(t.queries, id)
+		}
+	}
+	t.queries[queryID] = queryStart{started: now, maxDuration: maxDuration}
+	return now
+}
+
+// setTimedOut records whether queryID was cancelled for running longer than
+// its max execution duration. It returns false if that was recorded already.
+func (t *queryStartTimes) setTimedOut(queryID string, timedOut bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	q, ok := t.queries[queryID]
+	if !ok || q.timedOut == timedOut {
+		return false
+	}
+	q.timedOut = timedOut
+	t.queries[queryID] = q
+	return true
+}
+
+// timedOut tells whether queryID was cancelled for running longer than its
+// max execution duration.
+func (t *queryStartTimes) timedOut(queryID string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.queries[queryID].timedOut
+}
+
+func (t *queryStartTimes) forget(queryID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.queries, queryID)
+}
+
+// forgetQuery stops tracking queryID once it has finished or was cancelled.
+func (ds *AsyncAWSDatasource) forgetQuery(queryID string) {
+	ds.queryStartTimes.forget(queryID)
+	ds.idleQueries.forget(queryID)
+}
+
+// cancelTimedOutQuery cancels a query that ran longer than maxDuration and
+// returns the frame reporting it. Requests sharing a query share its max
+// execution duration, so the query is cancelled for all of them by the first
+// poll past its deadline; the following polls get the same report.
+func (ds *AsyncAWSDatasource) cancelTimedOutQuery(ctx context.Context, db AsyncDB, q *AsyncQuery, maxDuration time.Duration) (data.Frames, error) {
+	if ds.queryStartTimes.setTimedOut(q.QueryID, true) {
+		backend.Logger.FromContext(ctx).Info("Cancelling async query that exceeded its max execution duration", "queryID", q.QueryID, "maxExecutionDuration", maxDuration)
+		if err := db.CancelQuery(ctx, q.QueryID); err != nil {
+			ds.queryStartTimes.setTimedOut(q.QueryID, false)
+			return getErrorFrameFromQuery(q), fmt.Errorf("could not cancel query after it exceeded its max execution duration: %w", err)
+		}
+		ds.sharedQueries.finish(q.QueryID)
+		ds.idleQueries.forget(q.QueryID)
+		asyncQueriesMetric.WithLabelValues(queryStatusTimeout).Inc()
+	}
+	return data.Frames{
+		{Meta: &data.FrameMeta{
+			ExecutedQueryString: q.RawSQL,
+			Custom:              queryMeta{QueryID: q.QueryID, Status: queryStatusTimeout},
+			Notices: []data.Notice{{
+				Severity: data.NoticeSeverityWarning,
+				Text:     fmt.Sprintf("Query was cancelled because it ran longer than the maximum execution duration of %s", maxDuration),
+			}},
+		}},
+	}, nil
+}
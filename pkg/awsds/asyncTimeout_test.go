@@ -0,0 +1,175 @@
+package awsds
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_maxExecutionDuration(t *testing.T) {
+	tests := []struct {
+		desc          string
+		dsDefault     time.Duration
+		jsonData      string
+		query         string
+		expected      time.Duration
+		expectedError bool
+	}{
+		{desc: "no limit by default", expected: 0},
+		{desc: "plugin default", dsDefault: time.Hour, expected: time.Hour},
+		{desc: "datasource setting overrides the plugin default", dsDefault: time.Hour, jsonData: `{"asyncQueryMaxExecutionDuration":"10m"}`, expected: 10 * time.Minute},
+		{desc: "query overrides the datasource setting", dsDefault: time.Hour, jsonData: `{"asyncQueryMaxExecutionDuration":"10m"}`, query: "30s", expected: 30 * time.Second},
+		{desc: "invalid datasource setting", jsonData: `{"asyncQueryMaxExecutionDuration":"soon"}`, expectedError: true},
+		{desc: "negative query value", query: "-1m", expectedError: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			ds := &AsyncAWSDatasource{MaxExecutionDuration: tt.dsDefault}
+			settings := backend.DataSourceInstanceSettings{JSONData: []byte(tt.jsonData)}
+			d, err := ds.maxExecutionDuration(&AsyncQuery{MaxExecutionDuration: tt.query}, settings)
+			if tt.expectedError {
+				require.Error(t, err)
+				assert.True(t, backend.IsDownstreamError(err))
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, d)
+		})
+	}
+}
+
+func Test_handleAsyncQuery_maxExecutionDuration(t *testing.T) {
+	settings := backend.DataSourceInstanceSettings{UID: "uid1", JSONData: []byte(`{"asyncQueryMaxExecutionDuration":"10m"}`)}
+	query := backend.DataQuery{RefID: "A", JSON: []byte(`{"rawSql":"SELECT 1","queryID":"qid","meta":{"queryFlow":"async"}}`)}
+
+	newDatasource := func(db AsyncDB) *AsyncAWSDatasource {
+		ds := NewAsyncAWSDatasource(fakeDriver{})
+		ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, settings})
+		return ds
+	}
+
+	t.Run("cancels a query running longer than the limit", func(t *testing.T) {
+		db := new(MockDB)
+		db.On("QueryStatus", mock.Anything, "qid").Return(QueryRunning, nil)
+		db.On("CancelQuery", mock.Anything, "qid").Return(nil)
+		ds := newDatasource(db)
+		ds.queryStartTimes.startTime("qid", 10*time.Minute, time.Now().Add(-11*time.Minute))
+
+		frames, err := ds.handleAsyncQuery(context.Background(), query, "uid1")
+		require.NoError(t, err)
+		require.Len(t, frames, 1)
+		assert.Equal(t, queryMeta{QueryID: "qid", Status: "timeout"}, frames[0].Meta.Custom)
+		require.Len(t, frames[0].Meta.Notices, 1)
+		assert.Equal(t, data.NoticeSeverityWarning, frames[0].Meta.Notices[0].Severity)
+		db.AssertCalled(t, "CancelQuery", mock.Anything, "qid")
+		assert.True(t, ds.queryStartTimes.timedOut("qid"))
+
+		// polling the cancelled query again reports the timeout without cancelling it again
+		frames, err = ds.handleAsyncQuery(context.Background(), query, "uid1")
+		require.NoError(t, err)
+		assert.Equal(t, queryMeta{QueryID: "qid", Status: "timeout"}, frames[0].Meta.Custom)
+		db.AssertNumberOfCalls(t, "CancelQuery", 1)
+		db.AssertNumberOfCalls(t, "QueryStatus", 1)
+	})
+
+	t.Run("cancels a query again if it could not be cancelled", func(t *testing.T) {
+		db := new(MockDB)
+		db.On("QueryStatus", mock.Anything, "qid").Return(QueryRunning, nil)
+		db.On("CancelQuery", mock.Anything, "qid").Return(errors.New("unavailable")).Once()
+		db.On("CancelQuery", mock.Anything, "qid").Return(nil).Once()
+		ds := newDatasource(db)
+		ds.queryStartTimes.startTime("qid", 10*time.Minute, time.Now().Add(-11*time.Minute))
+
+		_, err := ds.handleAsyncQuery(context.Background(), query, "uid1")
+		require.Error(t, err)
+		assert.False(t, ds.queryStartTimes.timedOut("qid"))
+		frames, err := ds.handleAsyncQuery(context.Background(), query, "uid1")
+		require.NoError(t, err)
+		assert.Equal(t, queryMeta{QueryID: "qid", Status: "timeout"}, frames[0].Meta.Custom)
+		db.AssertNumberOfCalls(t, "CancelQuery", 2)
+	})
+
+	t.Run("keeps polling a query within the limit", func(t *testing.T) {
+		db := new(MockDB)
+		db.On("QueryStatus", mock.Anything, "qid").Return(QueryRunning, nil)
+		ds := newDatasource(db)
+		ds.queryStartTimes.startTime("qid", 10*time.Minute, time.Now().Add(-time.Minute))
+
+		frames, err := ds.handleAsyncQuery(context.Background(), query, "uid1")
+		require.NoError(t, err)
+		assert.Equal(t, queryMeta{QueryID: "qid", Status: "running"}, frames[0].Meta.Custom)
+		db.AssertNotCalled(t, "CancelQuery", mock.Anything, mock.Anything)
+	})
+
+	t.Run("times a new query from when it was started", func(t *testing.T) {
+		db := new(MockDB)
+		db.On("GetQueryID", mock.Anything, "SELECT 1", mock.Anything).Return(false, "", nil)
+		db.On("StartQuery", mock.Anything, "SELECT 1", mock.Anything).Return("new-qid", nil)
+		ds := newDatasource(db)
+
+		start := backend.DataQuery{RefID: "A", JSON: []byte(`{"rawSql":"SELECT 1","meta":{"queryFlow":"async"}}`)}
+		_, err := ds.handleAsyncQuery(context.Background(), start, "uid1")
+		require.NoError(t, err)
+		_, tracked := ds.queryStartTimes.queries["new-qid"]
+		assert.True(t, tracked)
+	})
+
+	t.Run("forgets a query once it has failed", func(t *testing.T) {
+		db := new(MockDB)
+		db.On("QueryStatus", mock.Anything, "qid").Return(QueryFailed, nil)
+		ds := newDatasource(db)
+		ds.queryStartTimes.startTime("qid", 10*time.Minute, time.Now().Add(-time.Hour))
+
+		frames, err := ds.handleAsyncQuery(context.Background(), query, "uid1")
+		require.NoError(t, err)
+		assert.Equal(t, queryMeta{QueryID: "qid", Status: "failed"}, frames[0].Meta.Custom)
+		db.AssertNotCalled(t, "CancelQuery", mock.Anything, mock.Anything)
+		_, tracked := ds.queryStartTimes.queries["qid"]
+		assert.False(t, tracked)
+	})
+}
+
+func Test_handleAsyncQuery_startTimesWithoutLimit(t *testing.T) {
+	db := new(MockDB)
+	db.On("GetQueryID", mock.Anything, "SELECT 1", mock.Anything).Return(false, "", nil)
+	db.On("StartQuery", mock.Anything, "SELECT 1", mock.Anything).Return("qid", nil)
+	db.On("QueryStatus", mock.Anything, "qid").Return(QueryRunning, nil)
+	ds := NewAsyncAWSDatasource(fakeDriver{})
+	ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, backend.DataSourceInstanceSettings{UID: "uid1"}})
+
+	for _, queryJSON := range []string{
+		`{"rawSql":"SELECT 1","meta":{"queryFlow":"async"}}`,
+		`{"rawSql":"SELECT 1","queryID":"qid","meta":{"queryFlow":"async"}}`,
+	} {
+		_, err := ds.handleAsyncQuery(context.Background(), backend.DataQuery{RefID: "A", JSON: []byte(queryJSON)}, "uid1")
+		require.NoError(t, err)
+	}
+	assert.Empty(t, ds.queryStartTimes.queries)
+}
+
+func Test_queryStartTimes(t *testing.T) {
+	var times queryStartTimes
+	now := time.Now()
+	assert.Equal(t, now, times.startTime("qid", time.Minute, now))
+	assert.Equal(t, now, times.startTime("qid", time.Minute, now.Add(time.Second)), "a query is timed from when it was first seen")
+
+	// a query that was never polled again is forgotten once long past its deadline
+	later := now.Add(time.Minute + maxSharedQueryAge + time.Second)
+	times.startTime("other", time.Minute, later)
+	assert.NotContains(t, times.queries, "qid")
+	assert.Contains(t, times.queries, "other")
+}
+
+func TestGetQuery_MaxExecutionDuration(t *testing.T) {
+	q, err := GetQuery(backend.DataQuery{JSON: []byte(`{"rawSql":"SELECT 1","maxExecutionDuration":"5m"}`)})
+	require.NoError(t, err)
+	assert.Equal(t, "5m", q.MaxExecutionDuration)
+	assert.Equal(t, "SELECT 1", q.RawSQL)
+}
@@ -134,6 +134,11 @@ func ReadAuthSettingsFromContext(ctx context.Context) (*AuthSettings, bool) {
 		hasSettings = true
 	}
 
+	if retrySettings, ok := readRetrySettingsFromConfig(cfg); ok {
+		settings.Retry = retrySettings
+		hasSettings = true
+	}
+
 	if v := cfg.Get(proxy.PluginSecureSocksProxyEnabled); v != "" {
 		secureSocksDSProxyEnabled, err := strconv.ParseBool(v)
 		if err == nil {
@@ -7,6 +7,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/proxy"
 	"github.com/grafana/grafana-plugin-sdk-go/config"
@@ -63,6 +64,31 @@ func TestReadAuthSettingsFromContext(t *testing.T) {
 			},
 			expectedHasSettings: true,
 		},
+		{
+			name: "retry settings in config",
+			cfg: config.NewGrafanaCfg(map[string]string{
+				RetryMaxAttemptsEnvVarKeyName: "5",
+				RetryMaxBackoffEnvVarKeyName:  "30s",
+				RetryModeEnvVarKeyName:        "adaptive",
+				RetryQuotaTokensEnvVarKeyName: "1000",
+				RateLimitEnvVarKeyName:        "20",
+			}),
+			expectedSettings: func() *AuthSettings {
+				settings := defaultAuthSettings()
+				settings.Retry = RetrySettings{MaxAttempts: 5, MaxBackoff: 30 * time.Second, Mode: aws.RetryModeAdaptive, RetryQuotaTokens: 1000, RateLimit: 20}
+				return settings
+			}(),
+			expectedHasSettings: true,
+		},
+		{
+			name: "invalid retry settings in config",
+			cfg: config.NewGrafanaCfg(map[string]string{
+				RetryMaxAttemptsEnvVarKeyName: "many",
+				RetryModeEnvVarKeyName:        "legacy",
+			}),
+			expectedSettings:    defaultAuthSettings(),
+			expectedHasSettings: true,
+		},
 	}
 	for _, tc := range tcs {
 		t.Run(tc.name, func(t *testing.T) {
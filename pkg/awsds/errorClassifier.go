@@ -0,0 +1,215 @@
+package awsds
+
+import (
+	"errors"
+
+	"github.com/aws/smithy-go"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// AWSErrorClass describes how an AWS API error is reported to Grafana: who is
+// responsible for it, the status of the response and how to fix it.
+type AWSErrorClass struct {
+	Source backend.ErrorSource
+	Status backend.Status
+	// Hint tells the user how to fix the error, if known
+	Hint string
+}
+
+var (
+	accessDeniedClass = AWSErrorClass{
+		Source: backend.ErrorSourceDownstream,
+		Status: backend.StatusForbidden,
+		Hint:   "Check that the IAM policies of the configured credentials, or of the assumed role, allow this action",
+	}
+	expiredTokenClass = AWSErrorClass{
+		Source: backend.ErrorSourceDownstream,
+		Status: backend.StatusUnauthorized,
+		Hint:   "The AWS credentials have expired: refresh them, or check the session duration of the assumed role",
+	}
+	invalidCredentialsClass = AWSErrorClass{
+		Source: backend.ErrorSourceDownstream,
+		Status: backend.StatusUnauthorized,
+		Hint:   "Check that the access key of the datasource exists and is active",
+	}
+	invalidSignatureClass = AWSErrorClass{
+		Source: backend.ErrorSourceDownstream,
+		Status: backend.StatusUnauthorized,
+		Hint:   "Check the secret key of the datasource, and that the clock of the Grafana server is accurate",
+	}
+	invalidIdentityTokenClass = AWSErrorClass{
+		Source: backend.ErrorSourceDownstream,
+		Status: backend.StatusUnauthorized,
+		Hint:   "The web identity token was rejected: check the trust policy of the role and the identity provider configuration",
+	}
+	throttlingClass = AWSErrorClass{
+		Source: backend.ErrorSourceDownstream,
+		Status: backend.StatusTooManyRequests,
+		Hint:   "AWS is throttling requests: reduce how often queries run, or request a higher service quota",
+	}
+	regionDisabledClass = AWSErrorClass{
+		Source: backend.ErrorSourceDownstream,
+		Status: backend.StatusForbidden,
+		Hint:   "STS is not activated in this region: activate it in the IAM console of the account, or use another region",
+	}
+	optInRequiredClass = AWSErrorClass{
+		Source: backend.ErrorSourceDownstream,
+		Status: backend.StatusForbidden,
+		Hint:   "The account is not subscribed to this service or region: enable it in the AWS console",
+	}
+	invalidRequestClass = AWSErrorClass{
+		Source: backend.ErrorSourceDownstream,
+		Status: backend.StatusBadRequest,
+	}
+	notFoundClass = AWSErrorClass{
+		Source: backend.ErrorSourceDownstream,
+		Status: backend.StatusNotFound,
+		Hint:   "Check that the resource exists in the configured region and account",
+	}
+	malformedRequestClass = AWSErrorClass{
+		Source: backend.ErrorSourcePlugin,
+		Status: backend.StatusInternal,
+	}
+	unavailableClass = AWSErrorClass{
+		Source: backend.ErrorSourceDownstream,
+		Status: backend.StatusBadGateway,
+		Hint:   "AWS is temporarily unavailable: try again later",
+	}
+)
+
+// awsErrorClasses are the classes of the AWS API error codes, as returned by
+// smithy.APIError.ErrorCode.
+var awsErrorClasses = map[string]AWSErrorClass{
+	"AccessDenied":                           accessDeniedClass,
+	"AccessDeniedException":                  accessDeniedClass,
+	"UnauthorizedOperation":                  accessDeniedClass,
+	"UnauthorizedAccess":                     accessDeniedClass,
+	"ExpiredToken":                           expiredTokenClass,
+	"ExpiredTokenException":                  expiredTokenClass,
+	"InvalidClientTokenId":                   invalidCredentialsClass,
+	"UnrecognizedClientException":            invalidCredentialsClass,
+	"InvalidAccessKeyId":                     invalidCredentialsClass,
+	"AuthFailure":                            invalidCredentialsClass,
+	"SignatureDoesNotMatch":                  invalidSignatureClass,
+	"InvalidSignatureException":              invalidSignatureClass,
+	"RequestExpired":                         invalidSignatureClass,
+	"InvalidIdentityToken":                   invalidIdentityTokenClass,
+	"IDPRejectedClaim":                       invalidIdentityTokenClass,
+	"Throttling":                             throttlingClass,
+	"ThrottlingException":                    throttlingClass,
+	"ThrottledException":                     throttlingClass,
+	"TooManyRequestsException":               throttlingClass,
+	"RequestLimitExceeded":                   throttlingClass,
+	"RequestThrottled":                       throttlingClass,
+	"RequestThrottledException":              throttlingClass,
+	"ProvisionedThroughputExceededException": throttlingClass,
+	"SlowDown":                               throttlingClass,
+	"LimitExceededException":                 throttlingClass,
+	"RegionDisabled":                         regionDisabledClass,
+	"RegionDisabledException":                regionDisabledClass,
+	"OptInRequired":                          optInRequiredClass,
+	"SubscriptionRequiredException":          optInRequiredClass,
+	"ValidationError":                        invalidRequestClass,
+	"ValidationException":                    invalidRequestClass,
+	"InvalidParameterValue":                  invalidRequestClass,
+	"InvalidParameterValueException":         invalidRequestClass,
+	"InvalidParameterException":              invalidRequestClass,
+	"InvalidParameterCombination":            invalidRequestClass,
+	"InvalidRequestException":                invalidRequestClass,
+	"ResourceNotFoundException":              notFoundClass,
+	"NoSuchEntity":                           notFoundClass,
+	"NotFoundException":                      notFoundClass,
+	"MalformedQueryString":                   malformedRequestClass,
+	"MissingAction":                          malformedRequestClass,
+	"InvalidAction":                          malformedRequestClass,
+	"MissingParameter":                       malformedRequestClass,
+	"SerializationException":                 malformedRequestClass,
+	"UnknownOperationException":              malformedRequestClass,
+	"InternalFailure":                        unavailableClass,
+	"InternalError":                          unavailableClass,
+	"InternalServerError":                    unavailableClass,
+	"InternalServerException":                unavailableClass,
+	"ServiceUnavailable":                     unavailableClass,
+	"ServiceUnavailableException":            unavailableClass,
+	"IDPCommunicationError":                  unavailableClass,
+}
+
+// ClassifiedError is an AWS API error annotated with its class.
+type ClassifiedError struct {
+	// Code is the error code of the AWS API error
+	Code string
+	AWSErrorClass
+	Err error
+}
+
+func (e *ClassifiedError) Error() string {
+	if e.Hint == "" {
+		return e.Err.Error()
+	}
+	return e.Err.Error() + ". " + e.Hint
+}
+
+func (e *ClassifiedError) Unwrap() error {
+	return e.Err
+}
+
+// AWSErrorClassOf returns the class of the AWS API error err is or wraps,
+// and false if it is not an AWS API error with a known code.
+func AWSErrorClassOf(err error) (AWSErrorClass, bool) {
+	var classified *ClassifiedError
+	if errors.As(err, &classified) {
+		return classified.AWSErrorClass, true
+	}
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return AWSErrorClass{}, false
+	}
+	class, ok := awsErrorClasses[apiErr.ErrorCode()]
+	return class, ok
+}
+
+// ClassifyAWSError annotates err with its class when it is, or wraps, an AWS
+// API error with a known code: its message gets the remediation hint and it
+// is marked with the error source of the class. Other errors are returned as
+// is, so callers can still mark them.
+func ClassifyAWSError(err error) error {
+	var classified *ClassifiedError
+	if err == nil || errors.As(err, &classified) {
+		return err
+	}
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+	class, ok := awsErrorClasses[apiErr.ErrorCode()]
+	if !ok {
+		return err
+	}
+	classified = &ClassifiedError{Code: apiErr.ErrorCode(), AWSErrorClass: class, Err: err}
+	if class.Source == backend.ErrorSourcePlugin {
+		return backend.PluginError(classified)
+	}
+	return backend.DownstreamError(classified)
+}
+
+// errorResponse returns the response of a query that failed with err, with
+// the status of its cause when known.
+func errorResponse(err error) backend.DataResponse {
+	err = ClassifyAWSError(err)
+	res := backend.ErrorResponseWithErrorSource(err)
+	var qeError *QueryExecutionError
+	if errors.As(err, &qeError) {
+		// make sure error.status matches the downstream cause, if provided
+		switch qeError.Cause {
+		case QueryFailedUser:
+			res.Status = backend.StatusBadRequest
+		default:
+			res.Status = backend.StatusInternal
+		}
+		return res
+	}
+	if class, ok := AWSErrorClassOf(err); ok {
+		res.Status = class.Status
+	}
+	return res
+}
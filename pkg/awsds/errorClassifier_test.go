@@ -0,0 +1,101 @@
+package awsds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func apiError(code string) error {
+	return &smithy.GenericAPIError{Code: code, Message: code + " message"}
+}
+
+func TestClassifyAWSError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		classified bool
+		source     backend.ErrorSource
+		status     backend.Status
+	}{
+		{name: "access denied", err: apiError("AccessDenied"), classified: true, source: backend.ErrorSourceDownstream, status: backend.StatusForbidden},
+		{name: "expired token", err: apiError("ExpiredToken"), classified: true, source: backend.ErrorSourceDownstream, status: backend.StatusUnauthorized},
+		{name: "invalid access key", err: apiError("InvalidClientTokenId"), classified: true, source: backend.ErrorSourceDownstream, status: backend.StatusUnauthorized},
+		{name: "request signed too long ago", err: apiError("RequestExpired"), classified: true, source: backend.ErrorSourceDownstream, status: backend.StatusUnauthorized},
+		{name: "region disabled", err: apiError("RegionDisabledException"), classified: true, source: backend.ErrorSourceDownstream, status: backend.StatusForbidden},
+		{name: "throttling", err: apiError("Throttling"), classified: true, source: backend.ErrorSourceDownstream, status: backend.StatusTooManyRequests},
+		{name: "malformed request", err: apiError("SerializationException"), classified: true, source: backend.ErrorSourcePlugin, status: backend.StatusInternal},
+		{name: "wrapped by the SDK retryer", err: fmt.Errorf("operation error STS: AssumeRole, %w", &retry.MaxAttemptsError{Attempt: 3, Err: apiError("ThrottlingException")}), classified: true, source: backend.ErrorSourceDownstream, status: backend.StatusTooManyRequests},
+		{name: "unknown code", err: apiError("SomethingElse")},
+		{name: "not an API error", err: errors.New("boom")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ClassifyAWSError(tt.err)
+
+			class, ok := AWSErrorClassOf(err)
+			assert.Equal(t, tt.classified, ok)
+			if !tt.classified {
+				assert.Same(t, tt.err, err, "unclassified errors are returned as is")
+				return
+			}
+			assert.ErrorIs(t, err, tt.err)
+			assert.Equal(t, tt.status, class.Status)
+			assert.Equal(t, tt.source, backend.ErrorResponseWithErrorSource(err).ErrorSource)
+			assert.Contains(t, err.Error(), tt.err.Error())
+			assert.Contains(t, err.Error(), class.Hint)
+			assert.Equal(t, err, ClassifyAWSError(err), "classified errors are not classified again")
+		})
+	}
+	assert.NoError(t, ClassifyAWSError(nil))
+
+	class, _ := AWSErrorClassOf(ClassifyAWSError(apiError("RequestExpired")))
+	assert.Equal(t, invalidSignatureClass, class, "expired requests point at the clock, not at the credentials")
+}
+
+func Test_errorResponse(t *testing.T) {
+	t.Run("the cause of query execution errors wins", func(t *testing.T) {
+		res := errorResponse(&QueryExecutionError{Err: apiError("ThrottlingException"), Cause: QueryFailedUser})
+		assert.Equal(t, backend.StatusBadRequest, res.Status)
+	})
+	t.Run("AWS API errors get the status of their class", func(t *testing.T) {
+		res := errorResponse(apiError("AccessDeniedException"))
+		assert.Equal(t, backend.StatusForbidden, res.Status)
+		assert.Equal(t, backend.ErrorSourceDownstream, res.ErrorSource)
+	})
+	t.Run("other errors are left alone", func(t *testing.T) {
+		res := errorResponse(errors.New("boom"))
+		assert.Equal(t, backend.Status(0), res.Status)
+		assert.Equal(t, backend.ErrorSource(""), res.ErrorSource)
+	})
+}
+
+func TestAsyncAWSDatasource_QueryData_classifiesAWSErrors(t *testing.T) {
+	settings := backend.DataSourceInstanceSettings{UID: "uid1"}
+	db := new(MockDB)
+	db.On("GetQueryID", mock.Anything, "SELECT 1", mock.Anything).Return(false, "", nil)
+	db.On("StartQuery", mock.Anything, "SELECT 1", mock.Anything).Return("", apiError("ThrottlingException"))
+	ds := NewAsyncAWSDatasource(fakeDriver{})
+	ds.Retry = RetryPolicy{MaxAttempts: 1}
+	ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, settings})
+
+	res, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		PluginContext: backend.PluginContext{DataSourceInstanceSettings: &settings},
+		Queries:       []backend.DataQuery{{RefID: "A", JSON: []byte(`{"rawSql":"SELECT 1","meta":{"queryFlow":"async"}}`)}},
+	})
+	require.NoError(t, err)
+
+	response := res.Responses["A"]
+	require.Error(t, response.Error)
+	assert.Equal(t, backend.StatusTooManyRequests, response.Status)
+	assert.Equal(t, backend.ErrorSourceDownstream, response.ErrorSource)
+	assert.Contains(t, response.Error.Error(), "AWS is throttling requests")
+}
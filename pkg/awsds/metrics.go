@@ -0,0 +1,39 @@
+package awsds
+
+import (
+	"github.com/grafana/grafana-aws-sdk/pkg/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// asyncQueryStatusStarted is the status of asyncQueriesMetric counting the
+// queries started. Queries that could not be started have the "error" status.
+const asyncQueryStatusStarted = "started"
+
+var asyncQueriesMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: common.MetricsNamespace,
+	Subsystem: common.MetricsSubsystem,
+	Name:      "async_queries_total",
+	Help:      "Number of async queries started, and of async queries that ended, by status",
+}, []string{"status"})
+
+var connectionCacheSizeMetric = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: common.MetricsNamespace,
+	Subsystem: common.MetricsSubsystem,
+	Name:      "connection_cache_size",
+	Help:      "Number of database connections cached by async datasources",
+})
+
+var queuedQueriesMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: common.MetricsNamespace,
+	Subsystem: common.MetricsSubsystem,
+	Name:      "queries_queued",
+	Help:      "Number of queries waiting for the concurrency limit of their datasource",
+}, []string{"datasource_uid"})
+
+var runningQueriesMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: common.MetricsNamespace,
+	Subsystem: common.MetricsSubsystem,
+	Name:      "queries_running",
+	Help:      "Number of queries running under the concurrency limit of their datasource",
+}, []string{"datasource_uid"})
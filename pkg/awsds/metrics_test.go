@@ -0,0 +1,49 @@
+package awsds
+
+import (
+	"context"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAsyncAWSDatasource_QueryData_metrics(t *testing.T) {
+	settings := backend.DataSourceInstanceSettings{UID: "metrics-test"}
+	db := new(MockDB)
+	db.On("GetQueryID", mock.Anything, "SELECT 1", mock.Anything).Return(false, "", nil)
+	db.On("StartQuery", mock.Anything, "SELECT 1", mock.Anything).Return("qid", nil)
+	db.On("QueryStatus", mock.Anything, "qid").Return(QueryRunning, nil).Once()
+	db.On("QueryStatus", mock.Anything, "qid").Return(QueryFailed, nil)
+	db.On("Close").Return(nil)
+	started := asyncQueriesMetric.WithLabelValues(asyncQueryStatusStarted)
+	failed := asyncQueriesMetric.WithLabelValues(QueryFailed.String())
+	startedBefore, failedBefore := testutil.ToFloat64(started), testutil.ToFloat64(failed)
+	connectionsBefore := testutil.ToFloat64(connectionCacheSizeMetric)
+
+	ds := NewAsyncAWSDatasource(fakeDriver{})
+	ds.Retry = RetryPolicy{MaxAttempts: 1}
+	ds.storeDBConnection(defaultKey("metrics-test"), dbConnection{db, settings})
+	assert.Equal(t, float64(1), testutil.ToFloat64(connectionCacheSizeMetric)-connectionsBefore)
+
+	for _, queryJSON := range []string{
+		`{"rawSql":"SELECT 1","meta":{"queryFlow":"async"}}`,
+		`{"rawSql":"SELECT 1","queryID":"qid","meta":{"queryFlow":"async"}}`,
+		`{"rawSql":"SELECT 1","queryID":"qid","meta":{"queryFlow":"async"}}`,
+		`{"rawSql":"SELECT 1","queryID":"qid","meta":{"queryFlow":"async"}}`,
+	} {
+		_, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			PluginContext: backend.PluginContext{DataSourceInstanceSettings: &settings},
+			Queries:       []backend.DataQuery{{RefID: "A", JSON: []byte(queryJSON)}},
+		})
+		require.NoError(t, err)
+	}
+	assert.Equal(t, float64(1), testutil.ToFloat64(started)-startedBefore)
+	assert.Equal(t, float64(1), testutil.ToFloat64(failed)-failedBefore, "an ended query is counted once however often it is polled")
+
+	ds.Dispose()
+	assert.Equal(t, float64(0), testutil.ToFloat64(connectionCacheSizeMetric)-connectionsBefore)
+}
@@ -3,24 +3,40 @@ package awsds
 import (
 	"context"
 	"fmt"
+
+	"github.com/grafana/grafana-aws-sdk/pkg/common"
 )
 
-func startQuery(ctx context.Context, db AsyncDB, query *AsyncQuery) (string, error) {
+func startQuery(ctx context.Context, db AsyncDB, query *AsyncQuery, retry RetryPolicy) (queryID string, err error) {
 	if db == nil {
 		return "", fmt.Errorf("async handler not defined")
 	}
+	ctx, span := common.StartSpan(ctx, "awsds.StartQuery")
+	defer func() {
+		span.SetAttributes(common.AttributeQueryID.String(queryID))
+		common.EndSpan(span, err)
+	}()
 
 	found, queryID, err := db.GetQueryID(ctx, query.RawSQL)
 	if found || err != nil {
 		return queryID, err
 	}
 
-	return db.StartQuery(ctx, query.RawSQL)
+	return StartQueryWithRetry(ctx, retry, db, func(ctx context.Context) (string, error) {
+		return db.StartQuery(ctx, query.RawSQL)
+	})
 }
 
-func queryStatus(ctx context.Context, db AsyncDB, query *AsyncQuery) (QueryStatus, error) {
+func queryStatus(ctx context.Context, db AsyncDB, query *AsyncQuery, retry RetryPolicy) (status QueryStatus, err error) {
 	if db == nil {
 		return QueryUnknown, fmt.Errorf("async handler not defined")
 	}
-	return db.QueryStatus(ctx, query.QueryID)
+	ctx, span := common.StartSpan(ctx, "awsds.QueryStatus", common.AttributeQueryID.String(query.QueryID))
+	defer func() {
+		span.SetAttributes(common.AttributeQueryStatus.String(status.String()))
+		common.EndSpan(span, err)
+	}()
+	return WithRetry(ctx, retry, db, func(ctx context.Context) (QueryStatus, error) {
+		return db.QueryStatus(ctx, query.QueryID)
+	})
 }
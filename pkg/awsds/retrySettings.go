@@ -0,0 +1,213 @@
+package awsds
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/gtime"
+	"github.com/grafana/grafana-plugin-sdk-go/config"
+)
+
+// Datasource JSON data keys of the retry and rate limit settings of the AWS
+// SDK clients
+const (
+	RetryMaxAttemptsSettingKey = "retryMaxAttempts"
+	RetryMaxBackoffSettingKey  = "retryMaxBackoff"
+	RetryModeSettingKey        = "retryMode"
+	RetryQuotaTokensSettingKey = "retryQuotaTokens"
+	RateLimitSettingKey        = "rateLimit"
+)
+
+const (
+	// RetryMaxAttemptsEnvVarKeyName is the string literal for the AWS SDK retry max attempts variable key name
+	RetryMaxAttemptsEnvVarKeyName = "AWS_SDK_RETRY_MAX_ATTEMPTS"
+
+	// RetryMaxBackoffEnvVarKeyName is the string literal for the AWS SDK retry max backoff variable key name
+	RetryMaxBackoffEnvVarKeyName = "AWS_SDK_RETRY_MAX_BACKOFF"
+
+	// RetryModeEnvVarKeyName is the string literal for the AWS SDK retry mode variable key name
+	RetryModeEnvVarKeyName = "AWS_SDK_RETRY_MODE"
+
+	// RetryQuotaTokensEnvVarKeyName is the string literal for the AWS SDK retry quota tokens variable key name
+	RetryQuotaTokensEnvVarKeyName = "AWS_SDK_RETRY_QUOTA_TOKENS"
+
+	// RateLimitEnvVarKeyName is the string literal for the AWS SDK request rate limit variable key name
+	RateLimitEnvVarKeyName = "AWS_SDK_RATE_LIMIT"
+)
+
+// RetrySettings are how the AWS SDK clients built from a config retry failed
+// requests and how fast they send requests. Zero values keep the defaults of
+// the AWS SDK.
+type RetrySettings struct {
+	// MaxAttempts is how many times a request is made at most
+	MaxAttempts int
+	// MaxBackoff is the longest wait between two attempts
+	MaxBackoff time.Duration
+	// Mode is aws.RetryModeStandard or aws.RetryModeAdaptive, which also
+	// slows requests down when AWS throttles them
+	Mode aws.RetryMode
+	// RetryQuotaTokens is the capacity of the retry quota of the AWS SDK, the
+	// token bucket retries are paid from: once it is empty, failed requests
+	// are not retried until enough requests succeed. It does not limit the
+	// rate of requests. A negative value disables the quota.
+	RetryQuotaTokens int
+	// RateLimit is how many requests per second the clients built from a
+	// config send at most, attempts included, with bursts of as many
+	// requests. Requests beyond it wait for their turn.
+	RateLimit float64
+}
+
+// IsZero reports whether s keeps all the defaults of the AWS SDK.
+func (s RetrySettings) IsZero() bool {
+	return s == RetrySettings{}
+}
+
+// WithDefaults returns s with its unset fields taken from defaults.
+func (s RetrySettings) WithDefaults(defaults RetrySettings) RetrySettings {
+	if s.MaxAttempts == 0 {
+		s.MaxAttempts = defaults.MaxAttempts
+	}
+	if s.MaxBackoff == 0 {
+		s.MaxBackoff = defaults.MaxBackoff
+	}
+	if s.Mode == "" {
+		s.Mode = defaults.Mode
+	}
+	if s.RetryQuotaTokens == 0 {
+		s.RetryQuotaTokens = defaults.RetryQuotaTokens
+	}
+	if s.RateLimit == 0 {
+		s.RateLimit = defaults.RateLimit
+	}
+	return s
+}
+
+// ReadRetrySettings reads the retry settings from the JSON data of a
+// datasource, e.g. {"retryMaxAttempts":5,"retryMaxBackoff":"30s","retryMode":"adaptive","rateLimit":10}.
+// Numbers may be saved as strings. Invalid values are logged and ignored, like
+// those of the Grafana config, so they never break the datasource.
+func ReadRetrySettings(jsonData json.RawMessage) RetrySettings {
+	if len(jsonData) <= 1 {
+		return RetrySettings{}
+	}
+	var values map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(jsonData))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		backend.Logger.Error("could not read retry settings", "error", err)
+		return RetrySettings{}
+	}
+	settings, _ := parseRetrySettings(jsonRetrySettingNames, func(name string) string {
+		if v, ok := values[name]; ok && v != nil {
+			return fmt.Sprint(v)
+		}
+		return ""
+	})
+	return settings
+}
+
+// retrySettingNames are the names of the retry settings in one source of
+// settings.
+type retrySettingNames struct {
+	maxAttempts, maxBackoff, mode, retryQuotaTokens, rateLimit string
+}
+
+var (
+	jsonRetrySettingNames = retrySettingNames{
+		maxAttempts:      RetryMaxAttemptsSettingKey,
+		maxBackoff:       RetryMaxBackoffSettingKey,
+		mode:             RetryModeSettingKey,
+		retryQuotaTokens: RetryQuotaTokensSettingKey,
+		rateLimit:        RateLimitSettingKey,
+	}
+	configRetrySettingNames = retrySettingNames{
+		maxAttempts:      RetryMaxAttemptsEnvVarKeyName,
+		maxBackoff:       RetryMaxBackoffEnvVarKeyName,
+		mode:             RetryModeEnvVarKeyName,
+		retryQuotaTokens: RetryQuotaTokensEnvVarKeyName,
+		rateLimit:        RateLimitEnvVarKeyName,
+	}
+)
+
+func parseRetryMaxBackoff(value string) (time.Duration, error) {
+	d, err := gtime.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid retry max backoff %q: %w", value, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("invalid retry max backoff %q: must not be negative", value)
+	}
+	return d, nil
+}
+
+// readRetrySettingsFromConfig reads the retry settings of all datasources
+// from the Grafana config. Invalid values are logged and ignored. It returns
+// false when cfg holds no retry setting.
+func readRetrySettingsFromConfig(cfg *config.GrafanaCfg) (RetrySettings, bool) {
+	return parseRetrySettings(configRetrySettingNames, cfg.Get)
+}
+
+// parseRetrySettings reads the retry settings called names with get, which
+// returns an empty string for unset settings. Invalid values are logged and
+// ignored. It returns false when no retry setting is set.
+func parseRetrySettings(names retrySettingNames, get func(name string) string) (RetrySettings, bool) {
+	var settings RetrySettings
+	hasSettings := false
+
+	if v := get(names.maxAttempts); v != "" {
+		maxAttempts, err := strconv.Atoi(v)
+		if err == nil && maxAttempts >= 0 {
+			settings.MaxAttempts = maxAttempts
+		} else {
+			backend.Logger.Error("could not parse retry setting", "setting", names.maxAttempts)
+		}
+		hasSettings = true
+	}
+
+	if v := get(names.maxBackoff); v != "" {
+		maxBackoff, err := parseRetryMaxBackoff(v)
+		if err == nil {
+			settings.MaxBackoff = maxBackoff
+		} else {
+			backend.Logger.Error("could not parse retry setting", "setting", names.maxBackoff)
+		}
+		hasSettings = true
+	}
+
+	if v := get(names.mode); v != "" {
+		mode, err := aws.ParseRetryMode(v)
+		if err == nil {
+			settings.Mode = mode
+		} else {
+			backend.Logger.Error("could not parse retry setting", "setting", names.mode)
+		}
+		hasSettings = true
+	}
+
+	if v := get(names.retryQuotaTokens); v != "" {
+		tokens, err := strconv.Atoi(v)
+		if err == nil {
+			settings.RetryQuotaTokens = tokens
+		} else {
+			backend.Logger.Error("could not parse retry setting", "setting", names.retryQuotaTokens)
+		}
+		hasSettings = true
+	}
+
+	if v := get(names.rateLimit); v != "" {
+		rateLimit, err := strconv.ParseFloat(v, 64)
+		if err == nil && rateLimit >= 0 {
+			settings.RateLimit = rateLimit
+		} else {
+			backend.Logger.Error("could not parse retry setting", "setting", names.rateLimit)
+		}
+		hasSettings = true
+	}
+
+	return settings, hasSettings
+}
@@ -0,0 +1,64 @@
+package awsds
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadRetrySettings(t *testing.T) {
+	tests := []struct {
+		desc     string
+		jsonData string
+		expected RetrySettings
+	}{
+		{desc: "no JSON data", jsonData: ``},
+		{desc: "no retry settings", jsonData: `{"region":"us-east-1"}`},
+		{
+			desc:     "all settings",
+			jsonData: `{"retryMaxAttempts":5,"retryMaxBackoff":"1m","retryMode":"adaptive","retryQuotaTokens":1000,"rateLimit":2.5}`,
+			expected: RetrySettings{MaxAttempts: 5, MaxBackoff: time.Minute, Mode: aws.RetryModeAdaptive, RetryQuotaTokens: 1000, RateLimit: 2.5},
+		},
+		{desc: "standard mode", jsonData: `{"retryMode":"standard"}`, expected: RetrySettings{Mode: aws.RetryModeStandard}},
+		{desc: "retry quota disabled", jsonData: `{"retryQuotaTokens":-1}`, expected: RetrySettings{RetryQuotaTokens: -1}},
+		{desc: "numbers as strings", jsonData: `{"retryMaxAttempts":"5","retryQuotaTokens":"100","rateLimit":"2.5"}`, expected: RetrySettings{MaxAttempts: 5, RetryQuotaTokens: 100, RateLimit: 2.5}},
+		{desc: "invalid JSON data", jsonData: `{"retryMaxAttempts":`},
+		{desc: "unknown mode", jsonData: `{"retryMode":"legacy","retryMaxAttempts":3}`, expected: RetrySettings{MaxAttempts: 3}},
+		{desc: "invalid max backoff", jsonData: `{"retryMaxBackoff":"soon"}`},
+		{desc: "negative max backoff", jsonData: `{"retryMaxBackoff":"-1s"}`},
+		{desc: "negative max attempts", jsonData: `{"retryMaxAttempts":-1}`},
+		{desc: "fractional max attempts", jsonData: `{"retryMaxAttempts":2.5}`},
+		{desc: "negative rate limit", jsonData: `{"rateLimit":-1}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			assert.Equal(t, tt.expected, ReadRetrySettings([]byte(tt.jsonData)))
+		})
+	}
+}
+
+func TestRetrySettings_WithDefaults(t *testing.T) {
+	defaults := RetrySettings{MaxAttempts: 5, MaxBackoff: time.Minute, Mode: aws.RetryModeAdaptive, RetryQuotaTokens: 1000, RateLimit: 10}
+
+	assert.Equal(t, defaults, RetrySettings{}.WithDefaults(defaults))
+	assert.Equal(t,
+		RetrySettings{MaxAttempts: 2, MaxBackoff: time.Minute, Mode: aws.RetryModeStandard, RetryQuotaTokens: -1, RateLimit: 10},
+		RetrySettings{MaxAttempts: 2, Mode: aws.RetryModeStandard, RetryQuotaTokens: -1}.WithDefaults(defaults),
+		"the datasource settings take precedence")
+	assert.True(t, RetrySettings{}.WithDefaults(RetrySettings{}).IsZero())
+}
+
+func TestLoadSettings_retry(t *testing.T) {
+	settings := &AWSDatasourceSettings{}
+	err := settings.Load(backend.DataSourceInstanceSettings{JSONData: []byte(`{"authType":"keys","retryMaxAttempts":4,"retryMode":"standard"}`)})
+	require.NoError(t, err)
+	assert.Equal(t, RetrySettings{MaxAttempts: 4, Mode: aws.RetryModeStandard}, settings.Retry)
+
+	err = settings.Load(backend.DataSourceInstanceSettings{JSONData: []byte(`{"retryMode":"fast","retryMaxAttempts":"2"}`)})
+	require.NoError(t, err, "invalid retry settings do not fail the datasource")
+	assert.Equal(t, RetrySettings{MaxAttempts: 2}, settings.Retry)
+}
@@ -118,6 +118,11 @@ type AWSDatasourceSettings struct {
 	ProxyUrl      string `json:"proxyUrl"`
 	ProxyUsername string `json:"proxyUsername"`
 
+	// Retry is read from the retryMaxAttempts, retryMaxBackoff, retryMode,
+	// retryQuotaTokens and rateLimit keys of the json object. It only applies
+	// to the clients of the datasource once copied to awsauth.Settings.Retry.
+	Retry RetrySettings `json:"-"`
+
 	// Loaded from DecryptedSecureJSONData (not the json object)
 	AccessKey     string `json:"-"`
 	SecretKey     string `json:"-"`
@@ -133,6 +138,8 @@ func (s *AWSDatasourceSettings) Load(config backend.DataSourceInstanceSettings)
 		}
 	}
 
+	s.Retry = ReadRetrySettings(config.JSONData)
+
 	if s.Region == defaultRegion || s.Region == "" {
 		s.Region = s.DefaultRegion
 	}
@@ -22,6 +22,8 @@ type AuthSettings struct {
 	ListMetricsPageLimit          int
 	MultiTenantTempCredentials    bool
 	PerDatasourceHTTPProxyEnabled bool
+	// Retry holds the retry settings of the datasources that do not set them
+	Retry RetrySettings
 
 	// necessary for a work around until https://github.com/grafana/grafana/issues/39089 is implemented
 	SecureSocksDSProxyEnabled bool
@@ -99,6 +101,18 @@ type AsyncQuery struct {
 	sqlutil.Query
 	QueryID string    `json:"queryID,omitempty"`
 	Meta    QueryMeta `json:"meta,omitempty"`
+	// MaxExecutionDuration overrides the datasource's maximum execution
+	// duration for this query, e.g. "30m"
+	MaxExecutionDuration string `json:"maxExecutionDuration,omitempty"`
+	// PageSize overrides the datasource's page size for the results of this
+	// query. A negative value returns all the results at once.
+	PageSize int `json:"pageSize,omitempty"`
+	// PageToken selects the page of results to return, as given in the
+	// nextPageToken of the previous page
+	PageToken string `json:"pageToken,omitempty"`
+	// StreamResults requests the results to be streamed page by page through
+	// Grafana Live instead of being returned in the response
+	StreamResults bool `json:"streamResults,omitempty"`
 }
 
 // GetQuery returns a Query object given a backend.DataQuery using json.Unmarshal
@@ -116,9 +130,13 @@ func GetQuery(query backend.DataQuery) (*AsyncQuery, error) {
 	model.MaxDataPoints = query.MaxDataPoints
 
 	return &AsyncQuery{
-		Query:   model.Query,
-		QueryID: model.QueryID,
-		Meta:    model.Meta,
+		Query:                model.Query,
+		QueryID:              model.QueryID,
+		Meta:                 model.Meta,
+		MaxExecutionDuration: model.MaxExecutionDuration,
+		PageSize:             model.PageSize,
+		PageToken:            model.PageToken,
+		StreamResults:        model.StreamResults,
 	}, nil
 }
 
@@ -136,6 +154,30 @@ type AsyncDB interface {
 	GetRows(ctx context.Context, queryID string) (driver.Rows, error)
 }
 
+// QueryStats holds the progress and statistics of an async query. Fields a
+// driver cannot report are left nil.
+type QueryStats struct {
+	BytesScanned    *int64   `json:"bytesScanned,omitempty"`
+	RowsProcessed   *int64   `json:"rowsProcessed,omitempty"`
+	PercentComplete *float64 `json:"percentComplete,omitempty"`
+	// EstimatedCost is the estimated cost of the query in US dollars
+	EstimatedCost *float64 `json:"estimatedCost,omitempty"`
+	// ExecutionTime is how long the query has been running, in milliseconds
+	ExecutionTime *int64 `json:"executionTimeMs,omitempty"`
+}
+
+// QueryStatsProvider can be implemented by an AsyncDB that reports progress
+// and statistics for its queries, while they run and once they finished
+type QueryStatsProvider interface {
+	QueryStats(ctx context.Context, queryID string) (QueryStats, error)
+}
+
+// RowsPager can be implemented by an AsyncDB that returns the results of a
+// finished query page by page. nextPageToken is empty on the last page.
+type RowsPager interface {
+	GetRowsPage(ctx context.Context, queryID string, pageToken string, pageSize int) (rows driver.Rows, nextPageToken string, err error)
+}
+
 // AsyncDriver extends the driver interface to also connect to async SQL datasources
 type AsyncDriver interface {
 	sqlds.Driver
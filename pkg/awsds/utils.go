@@ -36,8 +36,8 @@ func ShouldCacheQuery(resp *backend.QueryDataResponse) bool {
 					continue
 				}
 
-				// we should not cache running queries
-				if metaStatus == QueryRunning.String() || metaStatus == QuerySubmitted.String() {
+				// we should not cache running or timed out queries
+				if metaStatus == QueryRunning.String() || metaStatus == QuerySubmitted.String() || metaStatus == queryStatusTimeout {
 					shouldCache = false
 					break
 				}
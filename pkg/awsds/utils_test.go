@@ -40,6 +40,12 @@ func TestShouldCacheQuery(t *testing.T) {
 			false,
 			false,
 		},
+		{
+			"timed out async query should not cache",
+			map[string]interface{}{"status": "timeout"},
+			false,
+			false,
+		},
 		{
 			"done async query should cache",
 			map[string]interface{}{"status": "done"},
@@ -0,0 +1,149 @@
+package awstest
+
+import (
+	"context"
+	"sync"
+
+	"github.com/grafana/grafana-aws-sdk/pkg/sql/api"
+	"github.com/grafana/sqlds/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// API is an api.AWSAPI with fixed resources whose queries go through scripted
+// statuses. Set its fields before using it.
+type API struct {
+	// RegionNames and DatabaseNames are returned by Regions and Databases
+	RegionNames   []string
+	DatabaseNames []string
+	// ResourcesErr is returned by Regions and Databases
+	ResourcesErr error
+	// Steps are the results of the successive Status calls of each query.
+	// The last step repeats; without steps queries are finished.
+	Steps []StatusStep
+	// ExecuteErr is returned by Execute
+	ExecuteErr error
+
+	mu               sync.Mutex
+	script           statusScript
+	executed         []string
+	stopped          []string
+	cancelled        []string
+	databasesOptions []sqlds.Options
+}
+
+// NewAPI returns an API in the us-east-1 region, with a "default" database,
+// whose queries have statuses in order, the last one repeating.
+func NewAPI(steps ...StatusStep) *API {
+	return &API{
+		RegionNames:   []string{"us-east-1"},
+		DatabaseNames: []string{"default"},
+		Steps:         steps,
+	}
+}
+
+// Execute starts a query with ID "query-N", N counting from 1, unless input
+// has an ID.
+func (a *API) Execute(_ context.Context, input *api.ExecuteQueryInput) (*api.ExecuteQueryOutput, error) {
+	if a.ExecuteErr != nil {
+		return nil, a.ExecuteErr
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.executed = append(a.executed, input.Query)
+	id := input.ID
+	if id == "" {
+		id = fakeQueryID(len(a.executed))
+	}
+	return &api.ExecuteQueryOutput{ID: id}, nil
+}
+
+func (a *API) Status(_ context.Context, output *api.ExecuteQueryOutput) (*api.ExecuteQueryStatus, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	step := a.script.next(a.Steps, output.ID)
+	if step.Err != nil {
+		return nil, step.Err
+	}
+	return &api.ExecuteQueryStatus{
+		ID:       output.ID,
+		Finished: step.Status.Finished(),
+		State:    step.Status.String(),
+	}, nil
+}
+
+// Stop makes the following Status calls of the query return QueryCanceled.
+func (a *API) Stop(output *api.ExecuteQueryOutput) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.stopped = append(a.stopped, output.ID)
+	a.script.cancel(output.ID)
+	return nil
+}
+
+func (a *API) Regions(context.Context) ([]string, error) {
+	if a.ResourcesErr != nil {
+		return nil, a.ResourcesErr
+	}
+	return a.RegionNames, nil
+}
+
+func (a *API) Databases(_ context.Context, options sqlds.Options) ([]string, error) {
+	a.mu.Lock()
+	a.databasesOptions = append(a.databasesOptions, options)
+	a.mu.Unlock()
+	if a.ResourcesErr != nil {
+		return nil, a.ResourcesErr
+	}
+	return a.DatabaseNames, nil
+}
+
+// CancelQuery makes the following Status calls of queryID return
+// QueryCanceled.
+func (a *API) CancelQuery(_ context.Context, _ sqlds.Options, queryID string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.cancelled = append(a.cancelled, queryID)
+	a.script.cancel(queryID)
+	return nil
+}
+
+// ExecutedQueries returns the SQL of the queries executed so far, in order.
+func (a *API) ExecutedQueries() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]string(nil), a.executed...)
+}
+
+// StoppedQueries returns the IDs of the queries stopped or cancelled so far,
+// in order.
+func (a *API) StoppedQueries() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append(append([]string(nil), a.stopped...), a.cancelled...)
+}
+
+// DatabasesOptions returns the options of the Databases calls so far.
+func (a *API) DatabasesOptions() []sqlds.Options {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]sqlds.Options(nil), a.databasesOptions...)
+}
+
+// Polls returns how many times the status of queryID was requested.
+func (a *API) Polls(queryID string) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.script.polls[queryID]
+}
+
+// AssertExecuted asserts that a query was executed with exactly this SQL.
+func (a *API) AssertExecuted(t assert.TestingT, query string) bool {
+	return assert.Contains(t, a.ExecutedQueries(), query, "query should be executed")
+}
+
+// AssertStopped asserts that queryID was stopped or cancelled.
+func (a *API) AssertStopped(t assert.TestingT, queryID string) bool {
+	return assert.Contains(t, a.StoppedQueries(), queryID, "query should be stopped")
+}
+
+var _ api.AWSAPI = (*API)(nil)
@@ -0,0 +1,155 @@
+package awstest
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/grafana/grafana-aws-sdk/pkg/awsauth"
+)
+
+// ErrNoSTSServer is returned by the AssumeRole requests of an APIClient
+// without STSServer.
+var ErrNoSTSServer = errors.New("awstest: no fake STS server configured")
+
+// APIClient is an awsauth.AWSAPIClient which never reaches AWS: endpoint
+// discovery is disabled, roles are assumed with an STSServer and instance
+// metadata is served by an IMDSServer. Use it with
+// awsauth.NewConfigProviderWithClient.
+type APIClient struct {
+	// STS answers the AssumeRole requests. Without it they fail with
+	// ErrNoSTSServer.
+	STS *STSServer
+	// IMDS serves the instance metadata. Without it instance metadata is
+	// disabled and EC2 role credentials are EC2Credentials.
+	IMDS *IMDSServer
+	// EC2Credentials are returned by the EC2 role credentials provider when
+	// there is no IMDS
+	EC2Credentials aws.Credentials
+}
+
+// NewAPIClient returns an APIClient assuming roles with sts, which may be nil.
+func NewAPIClient(sts *STSServer) *APIClient {
+	return &APIClient{
+		STS: sts,
+		EC2Credentials: aws.Credentials{
+			AccessKeyID:     "ec2-access-key",
+			SecretAccessKey: "ec2-secret-key",
+		},
+	}
+}
+
+// LoadDefaultConfig builds the config from options alone. Unlike
+// config.LoadDefaultConfig it ignores the AWS_* environment variables and the
+// default shared config files of the host, so tests behave the same on every
+// machine. Without credentials in options, the credentials of a shared
+// credentials file set in options are used, then those of NewEC2RoleCreds.
+func (c *APIClient) LoadDefaultConfig(ctx context.Context, options ...awsauth.LoadOptionsFunc) (aws.Config, error) {
+	var opts config.LoadOptions
+	for _, option := range options {
+		if err := option(&opts); err != nil {
+			return aws.Config{}, err
+		}
+	}
+	opts.EnableEndpointDiscovery = aws.EndpointDiscoveryDisabled
+
+	provider, err := c.credentials(ctx, opts)
+	if err != nil {
+		return aws.Config{}, err
+	}
+	if _, ok := provider.(*aws.CredentialsCache); !ok {
+		provider = aws.NewCredentialsCache(provider)
+	}
+	cfg := aws.Config{
+		Region:           opts.Region,
+		Credentials:      provider,
+		HTTPClient:       opts.HTTPClient,
+		Retryer:          opts.Retryer,
+		RetryMaxAttempts: opts.RetryMaxAttempts,
+		RetryMode:        opts.RetryMode,
+		APIOptions:       opts.APIOptions,
+		Logger:           opts.Logger,
+		// the services read their remaining options, e.g. FIPS endpoints,
+		// from the config sources
+		ConfigSources: []interface{}{opts},
+	}
+	if opts.BaseEndpoint != "" {
+		cfg.BaseEndpoint = aws.String(opts.BaseEndpoint)
+	}
+	if opts.ClientLogMode != nil {
+		cfg.ClientLogMode = *opts.ClientLogMode
+	}
+	return cfg, nil
+}
+
+// credentials returns the credentials provider of a config loaded with opts.
+func (c *APIClient) credentials(ctx context.Context, opts config.LoadOptions) (aws.CredentialsProvider, error) {
+	if opts.Credentials != nil {
+		return opts.Credentials, nil
+	}
+	if len(opts.SharedCredentialsFiles) == 0 {
+		return c.NewEC2RoleCreds(), nil
+	}
+	profile := opts.SharedConfigProfile
+	if profile == "" {
+		profile = "default"
+	}
+	shared, err := config.LoadSharedConfigProfile(ctx, profile, func(o *config.LoadSharedConfigOptions) {
+		o.CredentialsFiles = opts.SharedCredentialsFiles
+		o.ConfigFiles = append([]string{}, opts.SharedConfigFiles...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return credentials.StaticCredentialsProvider{Value: shared.Credentials}, nil
+}
+
+func (c *APIClient) NewStaticCredentialsProvider(key, secret, session string) aws.CredentialsProvider {
+	return credentials.NewStaticCredentialsProvider(key, secret, session)
+}
+
+func (c *APIClient) NewSTSClientFromConfig(cfg aws.Config) stscreds.AssumeRoleAPIClient {
+	if c.STS == nil {
+		return noSTSClient{}
+	}
+	return sts.NewFromConfig(cfg, func(o *sts.Options) {
+		o.BaseEndpoint = aws.String(c.STS.URL)
+		if o.Region == "" {
+			o.Region = "us-east-1"
+		}
+		if o.Credentials == nil {
+			o.Credentials = aws.AnonymousCredentials{}
+		}
+	})
+}
+
+func (c *APIClient) NewAssumeRoleProvider(client stscreds.AssumeRoleAPIClient, roleARN string, optFns ...func(*stscreds.AssumeRoleOptions)) aws.CredentialsProvider {
+	return stscreds.NewAssumeRoleProvider(client, roleARN, optFns...)
+}
+
+func (c *APIClient) NewCredentialsCache(provider aws.CredentialsProvider, optFns ...func(options *aws.CredentialsCacheOptions)) aws.CredentialsProvider {
+	return aws.NewCredentialsCache(provider, optFns...)
+}
+
+func (c *APIClient) NewEC2RoleCreds() aws.CredentialsProvider {
+	if c.IMDS != nil {
+		return ec2rolecreds.New(func(o *ec2rolecreds.Options) {
+			o.Client = imds.New(imds.Options{Endpoint: c.IMDS.URL})
+		})
+	}
+	return credentials.StaticCredentialsProvider{Value: c.EC2Credentials}
+}
+
+type noSTSClient struct{}
+
+func (noSTSClient) AssumeRole(context.Context, *sts.AssumeRoleInput, ...func(*sts.Options)) (*sts.AssumeRoleOutput, error) {
+	return nil, ErrNoSTSServer
+}
+
+var _ awsauth.AWSAPIClient = (*APIClient)(nil)
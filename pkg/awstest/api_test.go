@@ -0,0 +1,63 @@
+package awstest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
+	"github.com/grafana/grafana-aws-sdk/pkg/sql/api"
+	"github.com/grafana/sqlds/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPI_WaitOnQuery(t *testing.T) {
+	fake := NewAPI(StatusStep{Status: awsds.QueryRunning}, StatusStep{Status: awsds.QueryFinished})
+
+	output, err := fake.Execute(context.Background(), &api.ExecuteQueryInput{Query: "SELECT 1"})
+	require.NoError(t, err)
+	require.NoError(t, api.WaitOnQuery(context.Background(), fake, output))
+
+	assert.Equal(t, "query-1", output.ID)
+	assert.Equal(t, 2, fake.Polls(output.ID))
+	fake.AssertExecuted(t, "SELECT 1")
+}
+
+func TestAPI_Status(t *testing.T) {
+	throttled := errors.New("throttled")
+	fake := NewAPI(StatusStep{Status: awsds.QueryRunning}, StatusStep{Err: throttled})
+	output := &api.ExecuteQueryOutput{ID: "qid"}
+
+	status, err := fake.Status(context.Background(), output)
+	require.NoError(t, err)
+	assert.Equal(t, &api.ExecuteQueryStatus{ID: "qid", State: "running"}, status)
+	_, err = fake.Status(context.Background(), output)
+	assert.ErrorIs(t, err, throttled)
+
+	require.NoError(t, fake.Stop(output))
+	status, err = fake.Status(context.Background(), output)
+	require.NoError(t, err)
+	assert.True(t, status.Finished)
+	assert.Equal(t, "canceled", status.State)
+	fake.AssertStopped(t, "qid")
+}
+
+func TestAPI_Resources(t *testing.T) {
+	fake := NewAPI()
+	fake.DatabaseNames = []string{"db1", "db2"}
+
+	regions, err := fake.Regions(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"us-east-1"}, regions)
+	databases, err := fake.Databases(context.Background(), sqlds.Options{"region": "eu-west-1"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"db1", "db2"}, databases)
+	assert.Equal(t, []sqlds.Options{{"region": "eu-west-1"}}, fake.DatabasesOptions())
+	require.NoError(t, fake.CancelQuery(context.Background(), sqlds.Options{}, "qid"))
+	fake.AssertStopped(t, "qid")
+
+	fake.ResourcesErr = errors.New("access denied")
+	_, err = fake.Regions(context.Background())
+	assert.EqualError(t, err, "access denied")
+}
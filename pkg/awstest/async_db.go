@@ -0,0 +1,228 @@
+package awstest
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
+	"github.com/stretchr/testify/assert"
+)
+
+// ErrNotSupported is returned by the methods of the fakes that the async
+// flow does not use.
+var ErrNotSupported = errors.New("awstest: not supported")
+
+// StatusStep is the result of a status poll of a fake query.
+type StatusStep struct {
+	Status awsds.QueryStatus
+	Err    error
+}
+
+// statusScript returns the steps of a script in order to the successive polls
+// of each query. The last step repeats; cancelled queries are canceled.
+type statusScript struct {
+	polls     map[string]int
+	cancelled map[string]bool
+}
+
+func (s *statusScript) next(steps []StatusStep, queryID string) StatusStep {
+	if s.polls == nil {
+		s.polls = map[string]int{}
+	}
+	s.polls[queryID]++
+	if s.cancelled[queryID] {
+		return StatusStep{Status: awsds.QueryCanceled}
+	}
+	if len(steps) == 0 {
+		return StatusStep{Status: awsds.QueryFinished}
+	}
+	return steps[min(s.polls[queryID], len(steps))-1]
+}
+
+func (s *statusScript) cancel(queryID string) {
+	if s.cancelled == nil {
+		s.cancelled = map[string]bool{}
+	}
+	s.cancelled[queryID] = true
+}
+
+// AsyncDB is an awsds.AsyncDB whose queries go through scripted statuses and
+// all return the same rows. Set its fields before using it.
+type AsyncDB struct {
+	// Steps are the results of the successive QueryStatus calls of each
+	// query. The last step repeats; without steps queries are finished.
+	Steps []StatusStep
+	// Columns and Values are the rows returned by GetRows
+	Columns []string
+	Values  [][]driver.Value
+	// StartErr, PingErr and RowsErr are returned by StartQuery, Ping and
+	// GetRows
+	StartErr error
+	PingErr  error
+	RowsErr  error
+	// ReuseRunningQueries makes GetQueryID return the last query started with
+	// the same SQL, unless it ended
+	ReuseRunningQueries bool
+
+	mu        sync.Mutex
+	script    statusScript
+	started   []string
+	ended     map[string]bool
+	cancelled []string
+	closed    bool
+}
+
+// NewAsyncDB returns an AsyncDB whose queries have statuses in order, the
+// last one repeating.
+func NewAsyncDB(statuses ...awsds.QueryStatus) *AsyncDB {
+	db := &AsyncDB{}
+	for _, status := range statuses {
+		db.Steps = append(db.Steps, StatusStep{Status: status})
+	}
+	return db
+}
+
+func (db *AsyncDB) Begin() (driver.Tx, error) { return nil, ErrNotSupported }
+
+func (db *AsyncDB) Prepare(string) (driver.Stmt, error) { return nil, ErrNotSupported }
+
+func (db *AsyncDB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.closed = true
+	return nil
+}
+
+func (db *AsyncDB) Ping(context.Context) error { return db.PingErr }
+
+// StartQuery starts a query with ID "query-N", N counting from 1.
+func (db *AsyncDB) StartQuery(_ context.Context, query string, _ ...interface{}) (string, error) {
+	if db.StartErr != nil {
+		return "", db.StartErr
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.started = append(db.started, query)
+	return fakeQueryID(len(db.started)), nil
+}
+
+func (db *AsyncDB) GetQueryID(_ context.Context, query string, _ ...interface{}) (bool, string, error) {
+	if !db.ReuseRunningQueries {
+		return false, "", nil
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for i := len(db.started); i > 0; i-- {
+		if db.started[i-1] == query && !db.ended[fakeQueryID(i)] {
+			return true, fakeQueryID(i), nil
+		}
+	}
+	return false, "", nil
+}
+
+func (db *AsyncDB) QueryStatus(_ context.Context, queryID string) (awsds.QueryStatus, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	step := db.script.next(db.Steps, queryID)
+	if step.Status.Finished() || step.Err != nil {
+		if db.ended == nil {
+			db.ended = map[string]bool{}
+		}
+		db.ended[queryID] = true
+	}
+	return step.Status, step.Err
+}
+
+// CancelQuery makes the following polls of queryID return QueryCanceled.
+func (db *AsyncDB) CancelQuery(_ context.Context, queryID string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.cancelled = append(db.cancelled, queryID)
+	db.script.cancel(queryID)
+	return nil
+}
+
+func (db *AsyncDB) GetRows(context.Context, string) (driver.Rows, error) {
+	if db.RowsErr != nil {
+		return nil, db.RowsErr
+	}
+	return NewRows(db.Columns, db.Values...), nil
+}
+
+// StartedQueries returns the SQL of the queries started so far, in order.
+func (db *AsyncDB) StartedQueries() []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return append([]string(nil), db.started...)
+}
+
+// CancelledQueries returns the IDs of the queries cancelled so far, in order.
+func (db *AsyncDB) CancelledQueries() []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return append([]string(nil), db.cancelled...)
+}
+
+// Polls returns how many times the status of queryID was requested.
+func (db *AsyncDB) Polls(queryID string) int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.script.polls[queryID]
+}
+
+// Closed returns whether Close was called.
+func (db *AsyncDB) Closed() bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.closed
+}
+
+// AssertStarted asserts that a query was started with exactly this SQL.
+func (db *AsyncDB) AssertStarted(t assert.TestingT, query string) bool {
+	return assert.Contains(t, db.StartedQueries(), query, "query should be started")
+}
+
+// AssertCancelled asserts that queryID was cancelled.
+func (db *AsyncDB) AssertCancelled(t assert.TestingT, queryID string) bool {
+	return assert.Contains(t, db.CancelledQueries(), queryID, "query should be cancelled")
+}
+
+// AssertClosed asserts that the connection was closed.
+func (db *AsyncDB) AssertClosed(t assert.TestingT) bool {
+	return assert.True(t, db.Closed(), "connection should be closed")
+}
+
+func fakeQueryID(n int) string {
+	return fmt.Sprintf("query-%d", n)
+}
+
+// Rows is a driver.Rows returning a fixed set of rows.
+type Rows struct {
+	columns []string
+	values  [][]driver.Value
+	next    int
+}
+
+// NewRows returns rows with the given columns and values, one slice per row.
+func NewRows(columns []string, values ...[]driver.Value) *Rows {
+	return &Rows{columns: columns, values: values}
+}
+
+func (r *Rows) Columns() []string { return r.columns }
+
+func (r *Rows) Close() error { return nil }
+
+func (r *Rows) Next(dest []driver.Value) error {
+	if r.next >= len(r.values) {
+		return io.EOF
+	}
+	copy(dest, r.values[r.next])
+	r.next++
+	return nil
+}
+
+var _ awsds.AsyncDB = (*AsyncDB)(nil)
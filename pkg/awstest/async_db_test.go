@@ -0,0 +1,143 @@
+package awstest
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
+	"github.com/grafana/grafana-aws-sdk/pkg/sql/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAsyncDB_QueryStatus(t *testing.T) {
+	failure := &awsds.QueryExecutionError{Err: errors.New("syntax error"), Cause: awsds.QueryFailedUser}
+	tests := []struct {
+		name  string
+		db    *AsyncDB
+		want  []awsds.QueryStatus
+		err   error
+		after int
+	}{
+		{
+			name: "finished without steps",
+			db:   &AsyncDB{},
+			want: []awsds.QueryStatus{awsds.QueryFinished, awsds.QueryFinished},
+		},
+		{
+			name: "last status repeats",
+			db:   NewAsyncDB(awsds.QuerySubmitted, awsds.QueryRunning, awsds.QueryFinished),
+			want: []awsds.QueryStatus{awsds.QuerySubmitted, awsds.QueryRunning, awsds.QueryFinished, awsds.QueryFinished},
+		},
+		{
+			name:  "error",
+			db:    &AsyncDB{Steps: []StatusStep{{Status: awsds.QueryRunning}, {Status: awsds.QueryFailed, Err: failure}}},
+			want:  []awsds.QueryStatus{awsds.QueryRunning, awsds.QueryFailed},
+			err:   failure,
+			after: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queryID, err := tt.db.StartQuery(context.Background(), "SELECT 1")
+			require.NoError(t, err)
+			for i, want := range tt.want {
+				status, err := tt.db.QueryStatus(context.Background(), queryID)
+				assert.Equal(t, want, status)
+				if tt.err != nil && i >= tt.after {
+					assert.ErrorIs(t, err, tt.err)
+				} else {
+					assert.NoError(t, err)
+				}
+			}
+			assert.Equal(t, len(tt.want), tt.db.Polls(queryID))
+		})
+	}
+}
+
+func TestAsyncDB_CancelQuery(t *testing.T) {
+	db := NewAsyncDB(awsds.QueryRunning)
+	first, err := db.StartQuery(context.Background(), "SELECT 1")
+	require.NoError(t, err)
+	second, err := db.StartQuery(context.Background(), "SELECT 2")
+	require.NoError(t, err)
+	assert.Equal(t, "query-1", first)
+	assert.Equal(t, "query-2", second)
+
+	require.NoError(t, db.CancelQuery(context.Background(), first))
+
+	status, err := db.QueryStatus(context.Background(), first)
+	require.NoError(t, err)
+	assert.Equal(t, awsds.QueryCanceled, status)
+	status, err = db.QueryStatus(context.Background(), second)
+	require.NoError(t, err)
+	assert.Equal(t, awsds.QueryRunning, status)
+	db.AssertStarted(t, "SELECT 2")
+	db.AssertCancelled(t, first)
+	assert.Equal(t, []string{first}, db.CancelledQueries())
+}
+
+func TestAsyncDB_GetQueryID(t *testing.T) {
+	db := NewAsyncDB(awsds.QueryRunning, awsds.QueryFinished)
+	found, _, err := db.GetQueryID(context.Background(), "SELECT 1")
+	require.NoError(t, err)
+	assert.False(t, found, "running queries are not reused by default")
+
+	db.ReuseRunningQueries = true
+	queryID, err := db.StartQuery(context.Background(), "SELECT 1")
+	require.NoError(t, err)
+	found, reused, err := db.GetQueryID(context.Background(), "SELECT 1")
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, queryID, reused)
+	found, _, err = db.GetQueryID(context.Background(), "SELECT 2")
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	_, _ = db.QueryStatus(context.Background(), queryID)
+	_, _ = db.QueryStatus(context.Background(), queryID)
+	found, _, err = db.GetQueryID(context.Background(), "SELECT 1")
+	require.NoError(t, err)
+	assert.False(t, found, "finished queries are not reused")
+}
+
+func TestAsyncDB_GetRows(t *testing.T) {
+	db := &AsyncDB{
+		Columns: []string{"id", "name"},
+		Values:  [][]driver.Value{{int64(1), "a"}, {int64(2), "b"}},
+	}
+
+	rows, err := db.GetRows(context.Background(), "query-1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"id", "name"}, rows.Columns())
+	var got [][]driver.Value
+	for {
+		dest := make([]driver.Value, 2)
+		err := rows.Next(dest)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		got = append(got, dest)
+	}
+	assert.Equal(t, db.Values, got)
+
+	db.RowsErr = errors.New("expired")
+	_, err = db.GetRows(context.Background(), "query-1")
+	assert.EqualError(t, err, "expired")
+}
+
+func TestAsyncDB_WaitOnQueryID(t *testing.T) {
+	db := NewAsyncDB(awsds.QueryRunning, awsds.QueryFinished)
+	queryID, err := db.StartQuery(context.Background(), "SELECT 1")
+	require.NoError(t, err)
+
+	require.NoError(t, api.WaitOnQueryID(context.Background(), queryID, db))
+
+	assert.Equal(t, 2, db.Polls(queryID))
+	require.NoError(t, db.Close())
+	db.AssertClosed(t)
+}
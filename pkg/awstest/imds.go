@@ -0,0 +1,228 @@
+package awstest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	imdsTokenPath       = "/latest/api/token"
+	imdsCredentialsPath = "/latest/meta-data/iam/security-credentials/"
+	imdsRegionPath      = "/latest/meta-data/placement/region"
+	imdsTokenHeader     = "X-Aws-Ec2-Metadata-Token"
+	imdsTokenTTLHeader  = "X-Aws-Ec2-Metadata-Token-Ttl-Seconds"
+)
+
+// IMDSServer is a fake EC2 instance metadata service (IMDSv2) serving the
+// credentials of an instance role and the region of the instance. Requests
+// without a session token are rejected, as IMDSv1 is disabled. It records
+// the paths requested.
+type IMDSServer struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	roleName    string
+	region      string
+	credentials aws.Credentials
+	ttl         time.Duration
+	errorStatus int
+	throttled   int
+	tokens      map[string]bool
+	requests    []string
+}
+
+// NewIMDSServer starts an IMDSServer which is closed when the test ends. The
+// credentials of its "awstest-instance-role" role expire after an hour.
+func NewIMDSServer(t testing.TB) *IMDSServer {
+	s := &IMDSServer{
+		roleName: "awstest-instance-role",
+		region:   "us-east-1",
+		credentials: aws.Credentials{
+			AccessKeyID:     "instance-access-key",
+			SecretAccessKey: "instance-secret-key",
+			SessionToken:    "instance-session-token",
+		},
+		ttl: time.Hour,
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Setenv points the AWS SDK default configuration at the server for the rest
+// of the test.
+func (s *IMDSServer) Setenv(t testing.TB) {
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "false")
+	t.Setenv("AWS_EC2_METADATA_SERVICE_ENDPOINT", s.URL)
+}
+
+// SetRole sets the name of the instance role.
+func (s *IMDSServer) SetRole(roleName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.roleName = roleName
+}
+
+// SetRegion sets the region of the instance.
+func (s *IMDSServer) SetRegion(region string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.region = region
+}
+
+// SetCredentials sets the credentials of the instance role. Unless
+// credentials.Expires is set, they expire after the TTL of the server.
+func (s *IMDSServer) SetCredentials(credentials aws.Credentials) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.credentials = credentials
+}
+
+// SetCredentialsTTL sets how long the credentials returned by the following
+// requests are valid, so that tests can make them expire.
+func (s *IMDSServer) SetCredentialsTTL(ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ttl = ttl
+}
+
+// FailWith makes the following metadata requests fail with status, e.g.
+// http.StatusNotFound for an instance without role. A zero status makes them
+// succeed again.
+func (s *IMDSServer) FailWith(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errorStatus = status
+}
+
+// Throttle makes the next n requests fail with http.StatusTooManyRequests.
+func (s *IMDSServer) Throttle(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.throttled = n
+}
+
+// Requests returns the method and path of the requests received so far,
+// e.g. "PUT /latest/api/token".
+func (s *IMDSServer) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+// CredentialsRequests returns how many times the credentials of the instance
+// role were requested.
+func (s *IMDSServer) CredentialsRequests() int {
+	n := 0
+	for _, request := range s.Requests() {
+		if strings.HasPrefix(request, http.MethodGet+" "+imdsCredentialsPath) && !strings.HasSuffix(request, "/") {
+			n++
+		}
+	}
+	return n
+}
+
+// AssertCredentialsRequested asserts that the credentials of the instance
+// role were requested times times.
+func (s *IMDSServer) AssertCredentialsRequested(t assert.TestingT, times int) bool {
+	return assert.Equal(t, times, s.CredentialsRequests(), "unexpected number of instance credentials requests")
+}
+
+func (s *IMDSServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+	throttled := s.throttled > 0
+	if throttled {
+		s.throttled--
+	}
+	s.mu.Unlock()
+	if throttled {
+		http.Error(w, "throttled", http.StatusTooManyRequests)
+		return
+	}
+
+	if r.URL.Path == imdsTokenPath {
+		s.serveToken(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.mu.Lock()
+	validToken := s.tokens[r.Header.Get(imdsTokenHeader)]
+	roleName, region, credentials, ttl, errorStatus := s.roleName, s.region, s.credentials, s.ttl, s.errorStatus
+	s.mu.Unlock()
+	if !validToken {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if errorStatus != 0 {
+		http.Error(w, http.StatusText(errorStatus), errorStatus)
+		return
+	}
+
+	switch r.URL.Path {
+	case imdsRegionPath:
+		_, _ = w.Write([]byte(region))
+	case imdsCredentialsPath:
+		_, _ = w.Write([]byte(roleName))
+	case imdsCredentialsPath + roleName:
+		if credentials.Expires.IsZero() {
+			credentials.Expires = time.Now().Add(ttl)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(imdsCredentials{
+			Code:            "Success",
+			LastUpdated:     time.Now().UTC().Format(time.RFC3339),
+			Type:            "AWS-HMAC",
+			AccessKeyID:     credentials.AccessKeyID,
+			SecretAccessKey: credentials.SecretAccessKey,
+			Token:           credentials.SessionToken,
+			Expiration:      credentials.Expires.UTC().Format(time.RFC3339),
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *IMDSServer) serveToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ttl := r.Header.Get(imdsTokenTTLHeader)
+	if ttl == "" {
+		http.Error(w, "missing token TTL", http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	if s.tokens == nil {
+		s.tokens = map[string]bool{}
+	}
+	token := fmt.Sprintf("imds-token-%d", len(s.tokens)+1)
+	s.tokens[token] = true
+	s.mu.Unlock()
+	w.Header().Set(imdsTokenTTLHeader, ttl)
+	_, _ = w.Write([]byte(token))
+}
+
+type imdsCredentials struct {
+	Code            string `json:"Code"`
+	LastUpdated     string `json:"LastUpdated"`
+	Type            string `json:"Type"`
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	Token           string `json:"Token"`
+	Expiration      string `json:"Expiration"`
+}
@@ -0,0 +1,87 @@
+package awstest
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/grafana/grafana-aws-sdk/pkg/awsauth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIMDSServer_defaultCredentialsChain(t *testing.T) {
+	isolateEnv(t)
+	imds := NewIMDSServer(t)
+	imds.Setenv(t)
+
+	cfg, err := awsauth.NewConfigProvider().GetConfig(grafanaContext(), awsauth.Settings{
+		AuthType: awsauth.AuthTypeEC2IAMRole,
+		Region:   "us-east-1",
+	})
+	require.NoError(t, err)
+	credentials, err := cfg.Credentials.Retrieve(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, "instance-access-key", credentials.AccessKeyID)
+	assert.Equal(t, "instance-secret-key", credentials.SecretAccessKey)
+	assert.Equal(t, "instance-session-token", credentials.SessionToken)
+	imds.AssertCredentialsRequested(t, 1)
+	assert.Contains(t, imds.Requests(), "PUT /latest/api/token")
+}
+
+func TestIMDSServer_NewEC2RoleCreds(t *testing.T) {
+	imds := NewIMDSServer(t)
+	imds.SetRole("reader")
+	imds.SetCredentials(aws.Credentials{AccessKeyID: "reader-key", SecretAccessKey: "reader-secret"})
+	imds.SetCredentialsTTL(-time.Minute)
+	client := NewAPIClient(nil)
+	client.IMDS = imds
+	provider := aws.NewCredentialsCache(client.NewEC2RoleCreds())
+
+	credentials, err := provider.Retrieve(context.Background())
+	require.NoError(t, err)
+	_, err = provider.Retrieve(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, "reader-key", credentials.AccessKeyID)
+	assert.Contains(t, imds.Requests(), "GET /latest/meta-data/iam/security-credentials/reader")
+	imds.AssertCredentialsRequested(t, 2)
+}
+
+func TestIMDSServer_FailWith(t *testing.T) {
+	imds := NewIMDSServer(t)
+	imds.FailWith(http.StatusNotFound)
+	client := NewAPIClient(nil)
+	client.IMDS = imds
+
+	_, err := client.NewEC2RoleCreds().Retrieve(context.Background())
+
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "404")
+	imds.AssertCredentialsRequested(t, 0)
+}
+
+func TestIMDSServer_Throttle(t *testing.T) {
+	imds := NewIMDSServer(t)
+	imds.Throttle(1)
+	client := NewAPIClient(nil)
+	client.IMDS = imds
+
+	credentials, err := client.NewEC2RoleCreds().Retrieve(context.Background())
+
+	require.NoError(t, err, "throttled requests should be retried")
+	assert.Equal(t, "instance-access-key", credentials.AccessKeyID)
+}
+
+func TestIMDSServer_rejectsRequestsWithoutToken(t *testing.T) {
+	imds := NewIMDSServer(t)
+
+	resp, err := http.Get(imds.URL + "/latest/meta-data/iam/security-credentials/")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
@@ -0,0 +1,311 @@
+// Package awstest provides fakes of the AWS services and interfaces used by
+// this SDK, so plugins can test their integration with it offline.
+package awstest
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+// STS actions answered by an STSServer.
+const (
+	ActionAssumeRole                = "AssumeRole"
+	ActionAssumeRoleWithWebIdentity = "AssumeRoleWithWebIdentity"
+	ActionGetCallerIdentity         = "GetCallerIdentity"
+)
+
+// DefaultAccount is the AWS account of the identities of an STSServer.
+const DefaultAccount = "123456789012"
+
+// STSCall is a request received by an STSServer.
+type STSCall struct {
+	Action          string
+	RoleARN         string
+	RoleSessionName string
+	ExternalID      string
+	// WebIdentityToken is the token of AssumeRoleWithWebIdentity requests
+	WebIdentityToken string
+	DurationSeconds  int
+	// AccessKeyID is the access key of the credentials that signed the
+	// request, if it was signed
+	AccessKeyID string
+}
+
+// STSServer is a fake STS endpoint answering AssumeRole,
+// AssumeRoleWithWebIdentity and GetCallerIdentity requests. Roles are assumed
+// with static credentials. It records the requests it receives.
+//
+// Point the AWS SDK at it with an APIClient, or with Settings.Endpoint when
+// using the real AWS API client.
+type STSServer struct {
+	*httptest.Server
+
+	mu           sync.Mutex
+	credentials  aws.Credentials
+	ttl          time.Duration
+	errorCode    string
+	errorMessage string
+	throttled    int
+	assumedRole  string
+	calls        []STSCall
+}
+
+// NewSTSServer starts an STSServer which is closed when the test ends. The
+// credentials it returns expire after an hour.
+func NewSTSServer(t testing.TB) *STSServer {
+	s := &STSServer{
+		credentials: aws.Credentials{
+			AccessKeyID:     "assumed-access-key",
+			SecretAccessKey: "assumed-secret-key",
+			SessionToken:    "assumed-session-token",
+		},
+		ttl: time.Hour,
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// SetCredentials sets the credentials returned by the following requests
+// assuming a role. Unless credentials.Expires is set, they expire after the
+// TTL of the server.
+func (s *STSServer) SetCredentials(credentials aws.Credentials) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.credentials = credentials
+}
+
+// Credentials returns the credentials returned by requests assuming a role.
+func (s *STSServer) Credentials() aws.Credentials {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.credentials
+}
+
+// SetCredentialsTTL sets how long the credentials returned by the following
+// requests are valid, so that tests can make them expire.
+func (s *STSServer) SetCredentialsTTL(ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ttl = ttl
+}
+
+// FailWith makes the following requests fail with an STS error, e.g.
+// "AccessDenied" or "ExpiredToken". An empty code makes them succeed again.
+func (s *STSServer) FailWith(code, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errorCode, s.errorMessage = code, message
+}
+
+// Throttle makes the next n requests fail with a Throttling error.
+func (s *STSServer) Throttle(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.throttled = n
+}
+
+// Calls returns the requests received so far, failed or not.
+func (s *STSServer) Calls() []STSCall {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]STSCall(nil), s.calls...)
+}
+
+// CallsOf returns the requests for action received so far, failed or not.
+func (s *STSServer) CallsOf(action string) []STSCall {
+	var calls []STSCall
+	for _, call := range s.Calls() {
+		if call.Action == action {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// AssertAssumedRole asserts that roleARN was assumed with externalID, which
+// may be empty, with or without web identity.
+func (s *STSServer) AssertAssumedRole(t assert.TestingT, roleARN string, externalID string) bool {
+	calls := s.Calls()
+	for _, call := range calls {
+		if call.Action != ActionGetCallerIdentity && call.RoleARN == roleARN && call.ExternalID == externalID {
+			return true
+		}
+	}
+	return assert.Fail(t, "role was not assumed", "role %q with external ID %q not found in %+v", roleARN, externalID, calls)
+}
+
+// AssertCalled asserts that action was requested times times.
+func (s *STSServer) AssertCalled(t assert.TestingT, action string, times int) bool {
+	return assert.Len(t, s.CallsOf(action), times, "unexpected number of %s requests", action)
+}
+
+// AssertNotCalled asserts that no request was received.
+func (s *STSServer) AssertNotCalled(t assert.TestingT) bool {
+	return assert.Empty(t, s.Calls(), "STS should not be called")
+}
+
+var credentialAccessKey = regexp.MustCompile(`Credential=([^/,\s]+)/`)
+
+func (s *STSServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeSTSError(w, http.StatusBadRequest, "MalformedInput", err.Error())
+		return
+	}
+	call := STSCall{
+		Action:           r.Form.Get("Action"),
+		RoleARN:          r.Form.Get("RoleArn"),
+		RoleSessionName:  r.Form.Get("RoleSessionName"),
+		ExternalID:       r.Form.Get("ExternalId"),
+		WebIdentityToken: r.Form.Get("WebIdentityToken"),
+	}
+	call.DurationSeconds, _ = strconv.Atoi(r.Form.Get("DurationSeconds"))
+	if m := credentialAccessKey.FindStringSubmatch(r.Header.Get("Authorization")); m != nil {
+		call.AccessKeyID = m[1]
+	}
+
+	s.mu.Lock()
+	s.calls = append(s.calls, call)
+	credentials, ttl, assumedRole := s.credentials, s.ttl, s.assumedRole
+	errorCode, errorMessage := s.errorCode, s.errorMessage
+	if s.throttled > 0 {
+		s.throttled--
+		errorCode, errorMessage = "Throttling", "Rate exceeded"
+	}
+	if errorCode == "" && (call.Action == ActionAssumeRole || call.Action == ActionAssumeRoleWithWebIdentity) {
+		s.assumedRole = call.RoleARN + "/" + call.RoleSessionName
+	}
+	s.mu.Unlock()
+
+	if errorCode != "" {
+		status := http.StatusBadRequest
+		if errorCode == "AccessDenied" {
+			status = http.StatusForbidden
+		}
+		writeSTSError(w, status, errorCode, errorMessage)
+		return
+	}
+
+	if credentials.Expires.IsZero() {
+		credentials.Expires = time.Now().Add(ttl)
+	}
+	switch call.Action {
+	case ActionAssumeRole:
+		var response assumeRoleResponse
+		response.Result = newAssumeRoleResult(call, credentials)
+		response.RequestID = fakeRequestID
+		writeXML(w, http.StatusOK, response)
+	case ActionAssumeRoleWithWebIdentity:
+		if call.WebIdentityToken == "" {
+			writeSTSError(w, http.StatusBadRequest, "InvalidIdentityToken", "missing web identity token")
+			return
+		}
+		var response assumeRoleWithWebIdentityResponse
+		response.Result.assumeRoleResult = newAssumeRoleResult(call, credentials)
+		response.Result.SubjectFromWebIdentityToken = "awstest"
+		response.RequestID = fakeRequestID
+		writeXML(w, http.StatusOK, response)
+	case ActionGetCallerIdentity:
+		var response getCallerIdentityResponse
+		response.Result.Account = DefaultAccount
+		response.Result.UserID = call.AccessKeyID
+		response.Result.Arn = "arn:aws:iam::" + DefaultAccount + ":user/awstest"
+		if assumedRole != "" && call.AccessKeyID == credentials.AccessKeyID {
+			response.Result.Arn = assumedRole
+		}
+		response.RequestID = fakeRequestID
+		writeXML(w, http.StatusOK, response)
+	default:
+		writeSTSError(w, http.StatusBadRequest, "InvalidAction", "unsupported action "+call.Action)
+	}
+}
+
+const fakeRequestID = "fake-request-id"
+
+type assumeRoleResult struct {
+	AssumedRoleUser struct {
+		Arn           string `xml:"Arn"`
+		AssumedRoleID string `xml:"AssumedRoleId"`
+	} `xml:"AssumedRoleUser"`
+	Credentials struct {
+		AccessKeyID     string `xml:"AccessKeyId"`
+		SecretAccessKey string `xml:"SecretAccessKey"`
+		SessionToken    string `xml:"SessionToken"`
+		Expiration      string `xml:"Expiration"`
+	} `xml:"Credentials"`
+}
+
+func newAssumeRoleResult(call STSCall, credentials aws.Credentials) assumeRoleResult {
+	var result assumeRoleResult
+	result.AssumedRoleUser.Arn = call.RoleARN + "/" + call.RoleSessionName
+	result.AssumedRoleUser.AssumedRoleID = "AROAFAKE:" + call.RoleSessionName
+	result.Credentials.AccessKeyID = credentials.AccessKeyID
+	result.Credentials.SecretAccessKey = credentials.SecretAccessKey
+	result.Credentials.SessionToken = credentials.SessionToken
+	result.Credentials.Expiration = credentials.Expires.UTC().Format(time.RFC3339)
+	return result
+}
+
+type assumeRoleResponse struct {
+	XMLName   xml.Name         `xml:"https://sts.amazonaws.com/doc/2011-06-15/ AssumeRoleResponse"`
+	Result    assumeRoleResult `xml:"AssumeRoleResult"`
+	RequestID string           `xml:"ResponseMetadata>RequestId"`
+}
+
+type assumeRoleWithWebIdentityResponse struct {
+	XMLName xml.Name `xml:"https://sts.amazonaws.com/doc/2011-06-15/ AssumeRoleWithWebIdentityResponse"`
+	Result  struct {
+		assumeRoleResult
+		SubjectFromWebIdentityToken string `xml:"SubjectFromWebIdentityToken"`
+	} `xml:"AssumeRoleWithWebIdentityResult"`
+	RequestID string `xml:"ResponseMetadata>RequestId"`
+}
+
+type getCallerIdentityResponse struct {
+	XMLName xml.Name `xml:"https://sts.amazonaws.com/doc/2011-06-15/ GetCallerIdentityResponse"`
+	Result  struct {
+		Arn     string `xml:"Arn"`
+		UserID  string `xml:"UserId"`
+		Account string `xml:"Account"`
+	} `xml:"GetCallerIdentityResult"`
+	RequestID string `xml:"ResponseMetadata>RequestId"`
+}
+
+type stsErrorResponse struct {
+	XMLName xml.Name `xml:"https://sts.amazonaws.com/doc/2011-06-15/ ErrorResponse"`
+	Error   struct {
+		Type    string `xml:"Type"`
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	} `xml:"Error"`
+	RequestID string `xml:"RequestId"`
+}
+
+func writeSTSError(w http.ResponseWriter, status int, code, message string) {
+	var response stsErrorResponse
+	response.Error.Type = "Sender"
+	response.Error.Code = code
+	response.Error.Message = message
+	response.RequestID = fakeRequestID
+	writeXML(w, status, response)
+}
+
+func writeXML(w http.ResponseWriter, status int, v interface{}) {
+	body, err := xml.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(status)
+	_, _ = w.Write(append([]byte(xml.Header), body...))
+}
@@ -0,0 +1,240 @@
+package awstest
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	stsclient "github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/grafana/grafana-aws-sdk/pkg/awsauth"
+	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
+	"github.com/grafana/grafana-plugin-sdk-go/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func grafanaContext() context.Context {
+	return config.WithGrafanaConfig(context.Background(), config.NewGrafanaCfg(map[string]string{
+		awsds.AllowedAuthProvidersEnvVarKeyName:  "keys,credentials,default,ec2_iam_role",
+		awsds.AssumeRoleEnabledEnvVarKeyName:     "true",
+		awsds.GrafanaAssumeRoleExternalIdKeyName: "stack",
+	}))
+}
+
+// isolateEnv keeps the AWS configuration of the environment out of the test.
+func isolateEnv(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_PROFILE", "AWS_REGION", "AWS_ROLE_ARN", "AWS_WEB_IDENTITY_TOKEN_FILE", "AWS_CONTAINER_CREDENTIALS_FULL_URI", "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "AWS_ENDPOINT_URL", "AWS_ENDPOINT_URL_STS", "AWS_CA_BUNDLE", "AWS_DEFAULT_REGION", "AWS_DEFAULT_PROFILE"} {
+		t.Setenv(name, "")
+	}
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+}
+
+func TestSTSServer_assumeRole(t *testing.T) {
+	sts := NewSTSServer(t)
+	expires := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	sts.SetCredentials(aws.Credentials{
+		AccessKeyID:     "role-key",
+		SecretAccessKey: "role-secret",
+		SessionToken:    "role-token",
+		Expires:         expires,
+	})
+	provider := awsauth.NewConfigProviderWithClient(NewAPIClient(sts))
+
+	cfg, err := provider.GetConfig(grafanaContext(), awsauth.Settings{
+		AuthType:      awsauth.AuthTypeKeys,
+		AccessKey:     "source-key",
+		SecretKey:     "source-secret",
+		Region:        "eu-west-1",
+		AssumeRoleARN: "arn:aws:iam::123456789012:role/test",
+		ExternalID:    "external",
+	})
+	require.NoError(t, err)
+	credentials, err := cfg.Credentials.Retrieve(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, "role-key", credentials.AccessKeyID)
+	assert.Equal(t, "role-secret", credentials.SecretAccessKey)
+	assert.Equal(t, "role-token", credentials.SessionToken)
+	assert.True(t, credentials.Expires.Equal(expires))
+	sts.AssertAssumedRole(t, "arn:aws:iam::123456789012:role/test", "external")
+	require.Len(t, sts.Calls(), 1)
+	assert.Equal(t, "source-key", sts.Calls()[0].AccessKeyID, "the request should be signed with the source credentials")
+}
+
+func TestSTSServer_FailWith(t *testing.T) {
+	sts := NewSTSServer(t)
+	sts.FailWith("AccessDenied", "not authorized to assume role")
+	provider := awsauth.NewConfigProviderWithClient(NewAPIClient(sts))
+
+	cfg, err := provider.GetConfig(grafanaContext(), awsauth.Settings{
+		AuthType:      awsauth.AuthTypeKeys,
+		AccessKey:     "key",
+		SecretKey:     "secret",
+		Region:        "us-east-1",
+		AssumeRoleARN: "arn:aws:iam::123456789012:role/denied",
+	})
+	require.NoError(t, err)
+	_, err = cfg.Credentials.Retrieve(context.Background())
+
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "AccessDenied")
+	assert.Contains(t, err.Error(), "not authorized to assume role")
+	sts.AssertAssumedRole(t, "arn:aws:iam::123456789012:role/denied", "")
+}
+
+func TestAPIClient_withoutSTSServer(t *testing.T) {
+	provider := awsauth.NewConfigProviderWithClient(NewAPIClient(nil))
+
+	cfg, err := provider.GetConfig(grafanaContext(), awsauth.Settings{
+		AuthType:      awsauth.AuthTypeKeys,
+		AccessKey:     "key",
+		SecretKey:     "secret",
+		Region:        "us-east-1",
+		AssumeRoleARN: "arn:aws:iam::123456789012:role/test",
+	})
+	require.NoError(t, err)
+	_, err = cfg.Credentials.Retrieve(context.Background())
+
+	assert.ErrorIs(t, err, ErrNoSTSServer)
+}
+
+func TestAPIClient_NewEC2RoleCreds(t *testing.T) {
+	client := NewAPIClient(nil)
+	client.EC2Credentials = aws.Credentials{AccessKeyID: "instance-key", SecretAccessKey: "instance-secret"}
+
+	credentials, err := client.NewEC2RoleCreds().Retrieve(context.Background())
+
+	require.NoError(t, err)
+	assert.Equal(t, "instance-key", credentials.AccessKeyID)
+	assert.Equal(t, "instance-secret", credentials.SecretAccessKey)
+}
+
+func TestAPIClient_LoadDefaultConfig_ignoresHostEnv(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", filepath.Join(t.TempDir(), "missing.pem"))
+	t.Setenv("AWS_REGION", "ap-south-1")
+	t.Setenv("AWS_ACCESS_KEY_ID", "host-key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "host-secret")
+	t.Setenv("AWS_PROFILE", "missing")
+	client := NewAPIClient(nil)
+
+	cfg, err := client.LoadDefaultConfig(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, cfg.Region)
+	credentials, err := cfg.Credentials.Retrieve(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "ec2-access-key", credentials.AccessKeyID)
+
+	credentialsFile := filepath.Join(t.TempDir(), "credentials")
+	require.NoError(t, os.WriteFile(credentialsFile, []byte("[shared]\naws_access_key_id = shared-key\naws_secret_access_key = shared-secret\n"), 0o600))
+	cfg, err = awsauth.NewConfigProviderWithClient(client).GetConfig(grafanaContext(), awsauth.Settings{
+		AuthType:           awsauth.AuthTypeSharedCreds,
+		CredentialsPath:    credentialsFile,
+		CredentialsProfile: "shared",
+		Region:             "us-east-1",
+	})
+	require.NoError(t, err)
+	credentials, err = cfg.Credentials.Retrieve(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "shared-key", credentials.AccessKeyID)
+}
+
+func TestSTSServer_settingsEndpoint(t *testing.T) {
+	isolateEnv(t)
+	sts := NewSTSServer(t)
+	provider := awsauth.NewConfigProvider()
+
+	cfg, err := provider.GetConfig(grafanaContext(), awsauth.Settings{
+		AuthType:      awsauth.AuthTypeKeys,
+		AccessKey:     "endpoint-key",
+		SecretKey:     "endpoint-secret",
+		Region:        "us-east-1",
+		Endpoint:      sts.URL,
+		AssumeRoleARN: "arn:aws:iam::123456789012:role/endpoint",
+	})
+	require.NoError(t, err)
+	credentials, err := cfg.Credentials.Retrieve(context.Background())
+	require.NoError(t, err)
+	identity, err := stsclient.NewFromConfig(cfg).GetCallerIdentity(context.Background(), &stsclient.GetCallerIdentityInput{})
+	require.NoError(t, err)
+
+	assert.Equal(t, sts.Credentials().AccessKeyID, credentials.AccessKeyID)
+	sts.AssertAssumedRole(t, "arn:aws:iam::123456789012:role/endpoint", "")
+	sts.AssertCalled(t, ActionGetCallerIdentity, 1)
+	assert.Equal(t, DefaultAccount, aws.ToString(identity.Account))
+	assert.Contains(t, aws.ToString(identity.Arn), "arn:aws:iam::123456789012:role/endpoint/")
+}
+
+func TestSTSServer_webIdentity(t *testing.T) {
+	isolateEnv(t)
+	sts := NewSTSServer(t)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("web-identity-token"), 0o600))
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", tokenFile)
+	t.Setenv("AWS_ROLE_ARN", "arn:aws:iam::123456789012:role/web")
+	t.Setenv("AWS_ROLE_SESSION_NAME", "awstest")
+
+	cfg, err := awsauth.NewConfigProvider().GetConfig(grafanaContext(), awsauth.Settings{
+		AuthType: awsauth.AuthTypeDefault,
+		Region:   "us-east-1",
+		Endpoint: sts.URL,
+	})
+	require.NoError(t, err)
+	credentials, err := cfg.Credentials.Retrieve(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, sts.Credentials().AccessKeyID, credentials.AccessKeyID)
+	calls := sts.CallsOf(ActionAssumeRoleWithWebIdentity)
+	require.Len(t, calls, 1)
+	assert.Equal(t, "arn:aws:iam::123456789012:role/web", calls[0].RoleARN)
+	assert.Equal(t, "web-identity-token", calls[0].WebIdentityToken)
+}
+
+func TestSTSServer_expiringCredentials(t *testing.T) {
+	sts := NewSTSServer(t)
+	sts.SetCredentialsTTL(-time.Minute)
+	cfg, err := awsauth.NewConfigProviderWithClient(NewAPIClient(sts)).GetConfig(grafanaContext(), awsauth.Settings{
+		AuthType:      awsauth.AuthTypeKeys,
+		AccessKey:     "key",
+		SecretKey:     "secret",
+		Region:        "us-east-1",
+		AssumeRoleARN: "arn:aws:iam::123456789012:role/test",
+	})
+	require.NoError(t, err)
+
+	_, err = cfg.Credentials.Retrieve(context.Background())
+	require.NoError(t, err)
+	_, err = cfg.Credentials.Retrieve(context.Background())
+	require.NoError(t, err)
+	sts.AssertCalled(t, ActionAssumeRole, 2)
+
+	sts.SetCredentialsTTL(time.Hour)
+	_, err = cfg.Credentials.Retrieve(context.Background())
+	require.NoError(t, err)
+	_, err = cfg.Credentials.Retrieve(context.Background())
+	require.NoError(t, err)
+	sts.AssertCalled(t, ActionAssumeRole, 3)
+}
+
+func TestSTSServer_Throttle(t *testing.T) {
+	sts := NewSTSServer(t)
+	sts.Throttle(1)
+	cfg, err := awsauth.NewConfigProviderWithClient(NewAPIClient(sts)).GetConfig(grafanaContext(), awsauth.Settings{
+		AuthType:      awsauth.AuthTypeKeys,
+		AccessKey:     "key",
+		SecretKey:     "secret",
+		Region:        "us-east-1",
+		AssumeRoleARN: "arn:aws:iam::123456789012:role/test",
+	})
+	require.NoError(t, err)
+
+	_, err = cfg.Credentials.Retrieve(context.Background())
+
+	require.NoError(t, err, "throttled requests should be retried")
+	sts.AssertCalled(t, ActionAssumeRole, 2)
+}
@@ -0,0 +1,57 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// CanonicalJSON returns the canonical form of the JSON document raw: compact,
+// with the keys of every object sorted. Documents that only differ in key
+// order or whitespace have the same canonical form. Numbers are kept as
+// written.
+func CanonicalJSON(raw []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("unexpected data after the JSON document")
+	}
+	// encoding/json sorts map keys
+	return json.Marshal(v)
+}
+
+// JSONKey returns a string identifying v in a cache, the same for values with
+// the same JSON encoding regardless of key order and whitespace. Raw JSON is
+// canonicalized as is; other values are encoded first. Values that cannot be
+// encoded fall back to their raw bytes or fmt representation. Empty raw JSON,
+// null and empty objects, e.g. nil and empty maps, give an empty key.
+func JSONKey(v interface{}) string {
+	var raw []byte
+	switch value := v.(type) {
+	case json.RawMessage:
+		raw = value
+	case []byte:
+		raw = value
+	default:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprintf("%v", v)
+		}
+		raw = encoded
+	}
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return ""
+	}
+	canonical, err := CanonicalJSON(raw)
+	if err != nil {
+		return string(raw)
+	}
+	if key := string(canonical); key != "null" && key != "{}" {
+		return key
+	}
+	return ""
+}
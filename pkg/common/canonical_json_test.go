@@ -0,0 +1,59 @@
+package common
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCanonicalJSON(t *testing.T) {
+	tests := []struct {
+		desc     string
+		raw      string
+		expected string
+	}{
+		{desc: "sorts keys", raw: `{"b":2,"a":1}`, expected: `{"a":1,"b":2}`},
+		{desc: "removes whitespace", raw: " {\n  \"a\" : [1, 2],\t\"b\": \"x y\" }\n", expected: `{"a":[1,2],"b":"x y"}`},
+		{desc: "sorts nested keys", raw: `{"z":{"d":1,"c":{"f":true,"e":null}},"y":[{"b":1,"a":2}]}`, expected: `{"y":[{"a":2,"b":1}],"z":{"c":{"e":null,"f":true},"d":1}}`},
+		{desc: "keeps numbers as written", raw: `{"big":12345678901234567890,"float":1.50}`, expected: `{"big":12345678901234567890,"float":1.50}`},
+		{desc: "scalar", raw: ` "a" `, expected: `"a"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			canonical, err := CanonicalJSON([]byte(tt.raw))
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, string(canonical))
+		})
+	}
+
+	for _, invalid := range []string{``, `{"a":`, `{"a":1} {"b":2}`} {
+		_, err := CanonicalJSON([]byte(invalid))
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestJSONKey(t *testing.T) {
+	t.Run("equivalent documents have the same key", func(t *testing.T) {
+		key := JSONKey(json.RawMessage(`{"region":"us-east-1","catalog":"AwsDataCatalog"}`))
+		assert.Equal(t, key, JSONKey(json.RawMessage(`{ "catalog": "AwsDataCatalog", "region": "us-east-1" }`)))
+		assert.Equal(t, key, JSONKey([]byte("{\n\"catalog\":\"AwsDataCatalog\",\n\"region\":\"us-east-1\"\n}")))
+		assert.Equal(t, key, JSONKey(map[string]string{"region": "us-east-1", "catalog": "AwsDataCatalog"}))
+		assert.NotEqual(t, key, JSONKey(json.RawMessage(`{"region":"us-east-2","catalog":"AwsDataCatalog"}`)))
+	})
+
+	t.Run("values are not confused with each other", func(t *testing.T) {
+		assert.NotEqual(t, JSONKey(map[string]string{"a": "b c:d"}), JSONKey(map[string]string{"a": "b", "c": "d"}))
+	})
+
+	t.Run("empty and invalid documents", func(t *testing.T) {
+		assert.Equal(t, "", JSONKey(json.RawMessage(nil)))
+		assert.Equal(t, "", JSONKey([]byte("  ")))
+		assert.Equal(t, "", JSONKey(json.RawMessage(`{ }`)))
+		assert.Equal(t, "", JSONKey(json.RawMessage(`null`)))
+		assert.Equal(t, "", JSONKey(map[string]string(nil)))
+		assert.Equal(t, "", JSONKey(map[string]string{}))
+		assert.Equal(t, "foo", JSONKey(json.RawMessage("foo")))
+	})
+}
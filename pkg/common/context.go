@@ -0,0 +1,14 @@
+package common
+
+import (
+	"context"
+	"time"
+)
+
+// DetachedContext returns a context bounded by timeout that keeps the values
+// of ctx, such as the Grafana config and logger, but not its cancellation.
+// It is used for work done on behalf of several requests, which must not fail
+// because the request that triggered it went away.
+func DetachedContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), timeout)
+}
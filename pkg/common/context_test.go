@@ -0,0 +1,24 @@
+package common
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type contextKey struct{}
+
+func TestDetachedContext(t *testing.T) {
+	parent, cancelParent := context.WithCancel(context.WithValue(context.Background(), contextKey{}, "value"))
+	ctx, cancel := DetachedContext(parent, time.Hour)
+	defer cancel()
+
+	cancelParent()
+	assert.NoError(t, ctx.Err(), "the cancellation of the parent is not kept")
+	assert.Equal(t, "value", ctx.Value(contextKey{}))
+	deadline, ok := ctx.Deadline()
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), deadline, time.Minute)
+}
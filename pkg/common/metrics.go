@@ -0,0 +1,10 @@
+package common
+
+// Namespace and subsystem of the Prometheus metrics of this SDK. The metrics
+// are registered with the default Prometheus registry, which the plugin SDK
+// exposes with the metrics of the plugin, so their full names start with
+// "plugins_aws_sdk_".
+const (
+	MetricsNamespace = "plugins"
+	MetricsSubsystem = "aws_sdk"
+)
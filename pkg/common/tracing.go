@@ -0,0 +1,36 @@
+package common
+
+import (
+	"context"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Keys of the span attributes set by this SDK. Attributes never hold secrets
+// such as keys, session tokens or external IDs.
+const (
+	AttributeAuthType      = attribute.Key("aws.auth.type")
+	AttributeRegion        = attribute.Key("aws.region")
+	AttributeService       = attribute.Key("aws.service")
+	AttributeAssumeRole    = attribute.Key("aws.assume_role")
+	AttributeCacheHit      = attribute.Key("aws.config.cache_hit")
+	AttributeQueryID       = attribute.Key("aws.query.id")
+	AttributeQueryStatus   = attribute.Key("aws.query.status")
+	AttributeDatasourceUID = attribute.Key("grafana.datasource.uid")
+)
+
+// StartSpan starts a span of the plugin SDK tracer, so that it joins the
+// trace of the request served by the plugin.
+func StartSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracing.DefaultTracer().Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// EndSpan records err on span, if any, and ends it.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		_ = tracing.Error(span, err)
+	}
+	span.End()
+}
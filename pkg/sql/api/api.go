@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
+	"github.com/grafana/grafana-aws-sdk/pkg/common"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
 	"github.com/grafana/sqlds/v5"
 	"github.com/jpillora/backoff"
@@ -53,13 +54,17 @@ type AWSAPI interface {
 }
 
 // WaitOnQuery polls the datasource api until the query finishes, returning an error if it failed.
-func WaitOnQuery(ctx context.Context, api SQL, output *ExecuteQueryOutput) error {
+func WaitOnQuery(ctx context.Context, api SQL, output *ExecuteQueryOutput) (err error) {
+	ctx, span := common.StartSpan(ctx, "api.WaitOnQuery", common.AttributeQueryID.String(output.ID))
+	defer func() { common.EndSpan(span, err) }()
 	backoffInstance := backoff.Backoff{
 		Min:    backoffMin,
 		Max:    backoffMax,
 		Factor: 1.1,
 	}
+	polls := queryPollsMetric.WithLabelValues("WaitOnQuery")
 	for {
+		polls.Inc()
 		status, err := api.Status(ctx, output)
 		if err != nil {
 			return err
@@ -84,14 +89,28 @@ func WaitOnQuery(ctx context.Context, api SQL, output *ExecuteQueryOutput) error
 	}
 }
 
+// WaitOnQueryID polls db until the query queryID finishes, without retrying
+// the errors of the status calls.
 func WaitOnQueryID(ctx context.Context, queryID string, db awsds.AsyncDB) error {
+	return WaitOnQueryIDWithRetry(ctx, queryID, db, awsds.RetryPolicy{})
+}
+
+// WaitOnQueryIDWithRetry polls db until the query queryID finishes, retrying
+// the transient errors of the status calls as set by retry.
+func WaitOnQueryIDWithRetry(ctx context.Context, queryID string, db awsds.AsyncDB, retry awsds.RetryPolicy) (err error) {
+	ctx, span := common.StartSpan(ctx, "api.WaitOnQueryID", common.AttributeQueryID.String(queryID))
+	defer func() { common.EndSpan(span, err) }()
 	backoffInstance := backoff.Backoff{
 		Min:    backoffMin,
 		Max:    backoffMax,
 		Factor: 2,
 	}
+	polls := queryPollsMetric.WithLabelValues("WaitOnQueryID")
 	for {
-		status, err := db.QueryStatus(ctx, queryID)
+		polls.Inc()
+		status, err := awsds.WithRetry(ctx, retry, db, func(ctx context.Context) (awsds.QueryStatus, error) {
+			return db.QueryStatus(ctx, queryID)
+		})
 		if err != nil {
 			return err
 		}
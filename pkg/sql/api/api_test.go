@@ -5,6 +5,10 @@ import (
 	"errors"
 	"testing"
 	"time"
+
+	"github.com/aws/smithy-go"
+	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 type fakeDS struct {
@@ -70,10 +74,15 @@ func TestWaitOnQuery(t *testing.T) {
 
 	for _, tc := range tests {
 		t.Run(tc.description, func(t *testing.T) {
+			polls := queryPollsMetric.WithLabelValues("WaitOnQuery")
+			pollsBefore := testutil.ToFloat64(polls)
 			err := WaitOnQuery(context.Background(), tc.ds, &ExecuteQueryOutput{})
 			if tc.ds.statusCounter != len(tc.ds.status) {
 				t.Errorf("status not called the right amount of times. Want %d got %d", len(tc.ds.status), tc.ds.statusCounter)
 			}
+			if got := testutil.ToFloat64(polls) - pollsBefore; got != float64(len(tc.ds.status)) {
+				t.Errorf("polls not counted. Want %d got %v", len(tc.ds.status), got)
+			}
 			if (err != nil || tc.ds.statusErr != nil) && !errors.Is(err, tc.ds.statusErr) {
 				t.Errorf("unexpected error %v", err)
 			}
@@ -109,3 +118,37 @@ func TestConnection_waitOnQueryCancelled(t *testing.T) {
 		t.Errorf("failed to cancel the request")
 	}
 }
+
+// throttledAsyncDB fails its first status calls with a throttling error.
+type throttledAsyncDB struct {
+	awsds.AsyncDB
+	throttled int
+	calls     int
+}
+
+func (db *throttledAsyncDB) QueryStatus(context.Context, string) (awsds.QueryStatus, error) {
+	db.calls++
+	if db.calls <= db.throttled {
+		return awsds.QueryUnknown, &smithy.GenericAPIError{Code: "ThrottlingException"}
+	}
+	return awsds.QueryFinished, nil
+}
+
+func TestWaitOnQueryIDWithRetry(t *testing.T) {
+	retry := awsds.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	db := &throttledAsyncDB{throttled: 2}
+	if err := WaitOnQueryIDWithRetry(context.Background(), "qid", db, retry); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if db.calls != 3 {
+		t.Errorf("expected 3 status calls, got %d", db.calls)
+	}
+
+	db = &throttledAsyncDB{throttled: 1}
+	if err := WaitOnQueryID(context.Background(), "qid", db); err == nil {
+		t.Errorf("expected the throttling error, as WaitOnQueryID does not retry")
+	}
+	if db.calls != 1 {
+		t.Errorf("expected 1 status call, got %d", db.calls)
+	}
+}
@@ -0,0 +1,14 @@
+package api
+
+import (
+	"github.com/grafana/grafana-aws-sdk/pkg/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var queryPollsMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: common.MetricsNamespace,
+	Subsystem: common.MetricsSubsystem,
+	Name:      "query_polls_total",
+	Help:      "Number of times the status of a query was polled while waiting for it to finish, by waiting function",
+}, []string{"function"})
@@ -4,12 +4,13 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/grafana/grafana-aws-sdk/pkg/common"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/sqlds/v5"
 )
 
 func connectionKey(id int64, args sqlds.Options) string {
-	return fmt.Sprintf("%d-%v", id, args)
+	return fmt.Sprintf("%d-%s", id, common.JSONKey(args))
 }
 
 func GetDatasourceID(ctx context.Context) int64 {
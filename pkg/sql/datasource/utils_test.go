@@ -3,6 +3,8 @@ package datasource
 import (
 	"context"
 	"testing"
+
+	"github.com/grafana/sqlds/v5"
 )
 
 func TestGetDatasourceID(t *testing.T) {
@@ -22,3 +24,20 @@ func TestGetDatasourceLastUpdatedTime(t *testing.T) {
 		t.Errorf("unexpected time: %s", time)
 	}
 }
+
+func TestConnectionKey(t *testing.T) {
+	key := connectionKey(1, sqlds.Options{"region": "us-east-1", "catalog": "AwsDataCatalog"})
+	if other := connectionKey(1, sqlds.Options{"catalog": "AwsDataCatalog", "region": "us-east-1"}); other != key {
+		t.Errorf("equivalent options should have the same key: %s != %s", other, key)
+	}
+	if other := connectionKey(2, sqlds.Options{"region": "us-east-1", "catalog": "AwsDataCatalog"}); other == key {
+		t.Errorf("other datasources should have another key: %s", other)
+	}
+	if connectionKey(1, nil) != connectionKey(1, sqlds.Options{}) {
+		t.Errorf("nil and empty options should have the same key: %s != %s", connectionKey(1, nil), connectionKey(1, sqlds.Options{}))
+	}
+	// fmt would print both as map[a:b c:d]
+	if connectionKey(1, sqlds.Options{"a": "b c:d"}) == connectionKey(1, sqlds.Options{"a": "b", "c": "d"}) {
+		t.Errorf("different options should have different keys")
+	}
+}
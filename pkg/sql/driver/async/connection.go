@@ -11,13 +11,22 @@ import (
 
 // Implements "*sql.DB"
 type Conn struct {
-	db awsds.AsyncDB
+	db    awsds.AsyncDB
+	retry awsds.RetryPolicy
 }
 
 func NewConnection(db awsds.AsyncDB) *Conn {
 	return &Conn{db: db}
 }
 
+// NewConnectionWithRetry returns a connection retrying the transient errors of
+// db as set by retry. Connections returned by NewConnection do not retry.
+// StartQuery is only retried when db implements
+// awsds.StartQueryRetryClassifier.
+func NewConnectionWithRetry(db awsds.AsyncDB, retry awsds.RetryPolicy) *Conn {
+	return &Conn{db: db, retry: retry}
+}
+
 func (c *Conn) CheckNamedValue(v *driver.NamedValue) error {
 	if v.Name != "queryID" {
 		return fmt.Errorf("only queryID parameters are supported")
@@ -34,19 +43,27 @@ func (c *Conn) QueryContext(ctx context.Context, query string, args []driver.Nam
 		}
 	}
 	if queryID != "" {
-		return c.db.GetRows(ctx, queryID)
+		return c.getRows(ctx, queryID)
 	}
 	// Synchronous flow
-	queryID, err := c.db.StartQuery(ctx, query, args)
+	queryID, err := awsds.StartQueryWithRetry(ctx, c.retry, c.db, func(ctx context.Context) (string, error) {
+		return c.db.StartQuery(ctx, query, args)
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	if err := api.WaitOnQueryID(ctx, queryID, c.db); err != nil {
+	if err := api.WaitOnQueryIDWithRetry(ctx, queryID, c.db, c.retry); err != nil {
 		return nil, err
 	}
 
-	return c.db.GetRows(ctx, queryID)
+	return c.getRows(ctx, queryID)
+}
+
+func (c *Conn) getRows(ctx context.Context, queryID string) (driver.Rows, error) {
+	return awsds.WithRetry(ctx, c.retry, c.db, func(ctx context.Context) (driver.Rows, error) {
+		return c.db.GetRows(ctx, queryID)
+	})
 }
 
 func (c *Conn) Ping() error {